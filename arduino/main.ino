@@ -11,6 +11,10 @@
 #define UDP_RECEIVE_PORT 4210
 #define UDP_SEND_PORT 4211
 
+// Boards with more outputs need a status pin per output and enough select
+// pins to address them all, which is checked when compiling
+#define NUM_OUTPUTS 4
+
 #define STAT1 5
 #define STAT2 4
 #define STAT3 0
@@ -47,14 +51,23 @@ class StatusPin {
     int pin;
 };
 
-StatusPin statusPins[4] = {{STAT1}, {STAT2}, {STAT3}, {STAT4}};
+StatusPin statusPins[] = {{STAT1}, {STAT2}, {STAT3}, {STAT4}};
+
+const int selectPins[] = {SEL1, SEL2};
+
+// Select pins needed to address n outputs
+constexpr unsigned int selectBits(unsigned int n) {
+    return n <= 1 ? 0 : 1 + selectBits((n + 1) / 2);
+}
+
+static_assert(sizeof(statusPins) / sizeof(statusPins[0]) == NUM_OUTPUTS,
+              "statusPins needs one pin for every output");
+static_assert(sizeof(selectPins) / sizeof(selectPins[0]) >= selectBits(NUM_OUTPUTS),
+              "selectPins has too few pins to address every output");
 
+// Outputs are numbered 0 to NUM_OUTPUTS - 1, the next number is mute
 enum class Status {
-    OUT1 = 0,
-    OUT2 = 1,
-    OUT3 = 2,
-    OUT4 = 3,
-    Muted = 4,
+    Muted = NUM_OUTPUTS,
     Error = -1,
     ClientCheck = -2,
 };
@@ -100,16 +113,17 @@ Status setOutput(int output) {
         case Status::ClientCheck:
             return isMuted() ? Status::Muted : getCurrentOutput();
         case Status::Muted:
-            if (mute()) return Status::Muted;
+            return mute() ? Status::Muted : getCurrentOutput();
         default:
+            if (output < 0 || output >= NUM_OUTPUTS) return Status::Error;
             if (isMuted()) return Status::Error;
     }
 
     currentOutput = output;
 
     mute(true);
-    digitalWrite(SEL1, (currentOutput >> 0) & 1);
-    digitalWrite(SEL2, (currentOutput >> 1) & 1);
+    for (unsigned int i = 0; i < sizeof(selectPins) / sizeof(selectPins[0]); i++)
+        digitalWrite(selectPins[i], (currentOutput >> i) & 1);
     mute(false);
 
     return getCurrentOutput();
@@ -155,9 +169,10 @@ void setup() {
     Serial.begin(115200);
     Serial.println();
 
-    for (const int &n : {SEL1, SEL2, MUTE}) {
+    for (const int &n : selectPins) {
         pinMode(n, OUTPUT);
     }
+    pinMode(MUTE, OUTPUT);
     setOutput(0);
 
     ESPConnect.autoConnect("SoundSwitch-Setup");
@@ -188,8 +203,13 @@ void loop() {
     Serial.println(packet);
 
     int val = static_cast<int>(managePacket(packet));
-    char buf[8];
-    itoa(val, buf, 10);
+    char buf[16];
+
+    // Client checks also report the number of outputs, as "<status>/<outputs>"
+    if (atoi(packet) == static_cast<int>(Status::ClientCheck))
+        snprintf(buf, sizeof(buf), "%d/%d", val, NUM_OUTPUTS);
+    else
+        itoa(val, buf, 10);
 
     Serial.printf("Sending Packet: %d\n", val);
     UDP.beginPacket(UDP.remoteIP(), UDP_SEND_PORT);
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Actions that hotkeys and other triggers can run. Mute toggles, while
+// mute_on and mute_off leave the device as it is if it already is.
+var actions = []string{"cycle", "reverse", "mute", "mute_on", "mute_off", "previous", CANCEL_MACRO}
+
+func validAction(action string) error {
+	if _, ok := outputAction(action); ok {
+		return nil
+	}
+
+	if name, _, ok := cycleAction(action); ok {
+		return validCycleName(name)
+	}
+
+	if name, ok := macroAction(action); ok {
+		return validMacroName(name)
+	}
+
+	if slices.Contains(actions, action) {
+		return nil
+	}
+
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// outputAction returns the index selected by an action like output2
+func outputAction(action string) (int, bool) {
+	if !strings.HasPrefix(action, "output") {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(action, "output"))
+	if err != nil || n < 1 || n > MAX_OUTPUTS {
+		return 0, false
+	}
+
+	return n - 1, true
+}
+
+func (switcher *Switcher) run(action string) error {
+	return switcher.runAction(action, false)
+}
+
+// Quiet actions don't show the output changed notification, for macros that
+// show their own once they finish
+func (switcher *Switcher) runAction(action string, quiet bool) error {
+	if x, ok := outputAction(action); ok {
+		return switcher.selectOutput(x, quiet)
+	}
+
+	if name, step, ok := cycleAction(action); ok {
+		return switcher.cycle(name, step, quiet)
+	}
+
+	if name, ok := macroAction(action); ok {
+		return switcher.startMacro(name)
+	}
+
+	switch action {
+	case "cycle":
+		return switcher.cycle("", 1, quiet)
+	case "reverse":
+		return switcher.cycle("", -1, quiet)
+	case "mute":
+		return switcher.muteToggle(quiet)
+	case "mute_on", "mute_off":
+		cur, _ := switcher.config.Section("").Key("current_output").Int()
+		if (cur == switcher.muted()) != (action == "mute_on") {
+			return switcher.muteToggle(quiet)
+		}
+	case CANCEL_MACRO:
+		switcher.cancelMacro()
+	case "previous":
+		return switcher.togglePrevious(quiet)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	return nil
+}
+
+// Switch to output x. The device refuses while muted, unless the
+// switch_unmutes policy lets us unmute first.
+func (switcher *Switcher) selectOutput(x int, quiet bool) error {
+	if !switcher.isOutput(x) {
+		return fmt.Errorf("the device has no output %d", x+1)
+	}
+
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+	if cur == switcher.muted() && switcher.config.Section("").Key("switch_unmutes").MustBool(false) {
+		return switcher.unmuteTo(x, quiet)
+	}
+
+	if !switcher.sendUDP(x, quiet) {
+		return fmt.Errorf("could not switch to output %d", x+1)
+	}
+	return nil
+}
+
+// Unmute, which restores the output used before, then switch to x
+func (switcher *Switcher) unmuteTo(x int, quiet bool) error {
+	if !switcher.sendUDP(switcher.muted(), quiet) {
+		return fmt.Errorf("could not unmute")
+	}
+
+	if cur, _ := switcher.config.Section("").Key("current_output").Int(); cur == x {
+		return nil
+	}
+
+	if !switcher.sendUDP(x, quiet) {
+		return fmt.Errorf("could not switch to output %d", x+1)
+	}
+	return nil
+}
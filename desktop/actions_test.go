@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The device won't change outputs while muted, unless switch_unmutes has the
+// app unmute first
+func TestSwitchUnmutes(t *testing.T) {
+	tests := []struct {
+		unmutes bool
+		target  int
+		want    int
+		err     bool
+	}{
+		{false, 1, 3, true},
+		{true, 1, 1, false},
+		// Unmuting is enough when it restores the output asked for
+		{true, 0, 0, false},
+		{false, 0, 3, true},
+	}
+
+	for _, test := range tests {
+		switcher := testSwitcher(t, fmt.Sprintf("outputs = 3\ncurrent_output = 0\nswitch_unmutes = %t\ndbus = false\n", test.unmutes))
+		switcher.setIP(fakeDevice(t, "127.0.0.1:0", 3))
+
+		if err := switcher.muteToggle(true); err != nil {
+			t.Fatal(err)
+		}
+		settle(switcher)
+
+		err := switcher.selectOutput(test.target, true)
+		if (err != nil) != test.err {
+			t.Errorf("switch_unmutes = %t, selecting %d: got error %v", test.unmutes, test.target, err)
+		}
+		settle(switcher)
+
+		if got, _ := switcher.config.Section("").Key("current_output").Int(); got != test.want {
+			t.Errorf("switch_unmutes = %t, selecting %d: went to %d, want %d", test.unmutes, test.target, got, test.want)
+		}
+	}
+}
+
+func TestValidAction(t *testing.T) {
+	tests := []struct {
+		action string
+		ok     bool
+	}{
+		{"mute", true},
+		{"output1", true},
+		{fmt.Sprintf("output%d", MAX_OUTPUTS), true},
+		{fmt.Sprintf("output%d", MAX_OUTPUTS+1), false},
+		{"output0", false},
+		{"cycle.ab", true},
+		{"reverse.ab", true},
+		{"cycle.", false},
+		{"cycle.a/b", false},
+		{MACRO_PREFIX + "night", true},
+		{"unmute", false},
+	}
+
+	for _, test := range tests {
+		if err := validAction(test.action); (err == nil) != test.ok {
+			t.Errorf("%q: got %v", test.action, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// The API only listens on loopback, so it's on by default for the CLI
+const API_HOST = "127.0.0.1"
+const API_PORT = "4212"
+
+type apiState struct {
+	CurrentOutput int      `json:"current_output"`
+	Outputs       []string `json:"outputs"`
+	Enabled       []bool   `json:"enabled"`
+	Profile       string   `json:"profile"`
+	Profiles      []string `json:"profiles"`
+	History       []int    `json:"history"`
+	RevertOutput  *int     `json:"revert_output,omitempty"`
+	RevertAt      string   `json:"revert_at,omitempty"`
+	Macro         string   `json:"macro,omitempty"`
+}
+
+func (switcher *Switcher) setupAPI() {
+	port := apiPort(switcher.config)
+	if port == "0" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", switcher.apiState)
+	mux.HandleFunc("/profile", post(switcher.apiProfile))
+	mux.HandleFunc("/output", post(switcher.apiOutput))
+	mux.HandleFunc("/action", post(switcher.apiAction))
+	mux.HandleFunc("/timer", post(switcher.apiTimer))
+	mux.HandleFunc("/previous", post(switcher.apiPrevious))
+
+	go func() {
+		err := http.ListenAndServe(API_HOST+":"+port, local(mux))
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			utils.Alert("Error!", fmt.Sprintf("Could not start the API on port %s!", port), 1)
+		}
+	}()
+}
+
+// Configs saved while the API was off by default have an empty api_port, which
+// is taken as the default too. 0 turns it off.
+func apiPort(cfg *ini.File) string {
+	if port := cfg.Section("").Key("api_port").String(); port != "" {
+		return port
+	}
+	return API_PORT
+}
+
+// Reject requests made by web pages, which always send an Origin, and ones
+// for another host, which is what a DNS rebinding page sends
+func local(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		if !localHost(r.Host) {
+			http.Error(w, "requests must be for localhost", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return host == "localhost" || host == API_HOST || host == "::1"
+}
+
+func post(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (switcher *Switcher) state() apiState {
+	Key := switcher.config.Section("").Key
+
+	state := apiState{
+		Profile:  Key("profile").String(),
+		Profiles: profileNames(switcher.config),
+		History:  switcher.history(),
+	}
+	state.CurrentOutput, _ = Key("current_output").Int()
+
+	if x, at, ok := switcher.revertTimer(); ok {
+		state.RevertOutput = &x
+		state.RevertAt = at.Format(time.RFC3339)
+	}
+
+	if status, ok := switcher.macroStatus(); ok {
+		state.Macro = status
+	}
+
+	for i, enabled := range switcher.enabled() {
+		state.Outputs = append(state.Outputs, switcher.label(i))
+		state.Enabled = append(state.Enabled, enabled == "ON")
+	}
+
+	return state
+}
+
+func (switcher *Switcher) apiState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(switcher.state())
+}
+
+// POST /profile?name=<profile>, an empty name deactivates profiles
+func (switcher *Switcher) apiProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+
+	if err := switcher.useProfile(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switcher.apiState(w, r)
+}
+
+// POST /output?n=<output>[&for=<duration>], counting from 1. With a
+// duration it switches back afterwards.
+func (switcher *Switcher) apiOutput(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%q is not an output", r.FormValue("n")), http.StatusBadRequest)
+		return
+	}
+
+	if value := r.FormValue("for"); value != "" {
+		if err := validDuration(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d, _ := time.ParseDuration(value)
+		err = switcher.switchFor(n-1, d)
+	} else {
+		err = switcher.selectOutput(n-1, false)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switcher.apiState(w, r)
+}
+
+// POST /action?name=<action>, e.g. cycle, mute or output2
+func (switcher *Switcher) apiAction(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimSpace(r.FormValue("name"))
+
+	if err := validAction(action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := switcher.run(action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switcher.apiState(w, r)
+}
+
+// POST /timer?action=cancel or /timer?action=extend[&by=<duration>]
+func (switcher *Switcher) apiTimer(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.FormValue("action") {
+	case "cancel":
+		err = switcher.cancelTimer()
+	case "extend":
+		d := switcher.extendBy()
+		if by := r.FormValue("by"); by != "" {
+			if err := validDuration(by); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d, _ = time.ParseDuration(by)
+		}
+		err = switcher.extendTimer(d)
+	default:
+		err = fmt.Errorf("unknown timer action %q, expected cancel or extend", r.FormValue("action"))
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switcher.apiState(w, r)
+}
+
+// POST /previous toggles back to the previous output
+func (switcher *Switcher) apiPrevious(w http.ResponseWriter, r *http.Request) {
+	if err := switcher.togglePrevious(false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switcher.apiState(w, r)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestLocal(t *testing.T) {
+	handler := local(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		host   string
+		origin string
+		status int
+	}{
+		{"127.0.0.1:4212", "", http.StatusOK},
+		{"localhost:4212", "", http.StatusOK},
+		{"localhost", "", http.StatusOK},
+		{"[::1]:4212", "", http.StatusOK},
+		{"127.0.0.1:4212", "http://example.com", http.StatusForbidden},
+		{"rebind.example.com:4212", "", http.StatusForbidden},
+		{"192.168.1.20:4212", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/state", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Host %q, Origin %q: got %d, want %d", test.host, test.origin, w.Code, test.status)
+		}
+	}
+}
+
+// The CLI reaches the app on the default port without any setup
+func TestAPIPort(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"", API_PORT},
+		{"api_port =\n", API_PORT},
+		{"api_port = 5000\n", "5000"},
+		{"api_port = 0\n", "0"},
+	}
+
+	for _, test := range tests {
+		cfg, err := ini.Load([]byte(test.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := apiPort(cfg); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.config, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/teambition/rrule-go"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// An event, or every occurrence of it if it recurs
+type event struct {
+	uid        string
+	title      string
+	categories []string
+	attendees  []string
+
+	// The first start as a wall clock time in zone, and how long each lasts
+	start  time.Time
+	zone   zone
+	length time.Duration
+
+	rule    *rrule.RRule
+	rdates  []time.Time
+	exdates []time.Time
+
+	// Set on an occurrence that was moved or changed
+	recurrenceID time.Time
+}
+
+// The events of a file, kept until the file changes
+type calendarFile struct {
+	modified time.Time
+	size     int64
+	events   []event
+	err      error
+}
+
+// Paths are relative to the config
+func calendarPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(utils.ConfigPath()), path)
+}
+
+// Parse the times of a property, which can be a list. All-day dates are
+// reported so they can be left out.
+func parseTimes(p property, zones map[string]zone) ([]time.Time, zone, bool, error) {
+	var z zone = locationZone{time.Local}
+
+	switch tzid := strings.TrimPrefix(p.params["TZID"], "/"); {
+	case strings.HasSuffix(p.value, "Z"):
+		z = locationZone{time.UTC}
+	case tzid != "":
+		// Go's zones are preferred over the VTIMEZONE, which is often out of date
+		if loc, err := time.LoadLocation(tzid); err == nil {
+			z = locationZone{loc}
+		} else if vz, ok := zones[p.params["TZID"]]; ok {
+			z = vz
+		} else {
+			return nil, nil, false, fmt.Errorf("unknown time zone %q", tzid)
+		}
+	}
+
+	allDay := p.params["VALUE"] == "DATE"
+
+	var times []time.Time
+	for _, value := range strings.Split(p.value, ",") {
+		t, err := parseWall(value)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		allDay = allDay || len(value) == 8
+		times = append(times, t)
+	}
+
+	return times, z, allDay, nil
+}
+
+// The timed events of a parsed calendar. Cancelled and all-day events are
+// left out.
+func parseEvents(components []*component) ([]event, []string) {
+	var events []event
+	var errs []string
+
+	zones := map[string]zone{}
+	var vevents []*component
+
+	for _, cal := range components {
+		for _, c := range cal.children {
+			switch c.name {
+			case "VTIMEZONE":
+				id, _ := c.prop("TZID")
+				if z, err := parseVTimezone(c); err == nil {
+					zones[id.value] = z
+				} else {
+					errs = append(errs, fmt.Sprintf("time zone %s: %s", id.value, err.Error()))
+				}
+			case "VEVENT":
+				vevents = append(vevents, c)
+			}
+		}
+	}
+
+	for _, c := range vevents {
+		e, ok, err := parseEvent(c, zones)
+		if err != nil {
+			title, _ := c.prop("SUMMARY")
+			errs = append(errs, fmt.Sprintf("event %q: %s", unescapeText(title.value), err.Error()))
+			continue
+		}
+		if ok {
+			events = append(events, e)
+		}
+	}
+
+	return events, errs
+}
+
+func parseEvent(c *component, zones map[string]zone) (event, bool, error) {
+	var e event
+
+	if status, _ := c.prop("STATUS"); strings.EqualFold(status.value, "CANCELLED") {
+		return e, false, nil
+	}
+
+	uid, _ := c.prop("UID")
+	e.uid = uid.value
+
+	title, _ := c.prop("SUMMARY")
+	e.title = unescapeText(title.value)
+
+	for _, p := range c.all("CATEGORIES") {
+		for _, category := range splitList(p.value) {
+			e.categories = append(e.categories, strings.TrimSpace(category))
+		}
+	}
+
+	// Both the name and address of everyone invited, and the organizer
+	for _, p := range append(c.all("ATTENDEE"), c.all("ORGANIZER")...) {
+		address := p.value
+		if strings.HasPrefix(strings.ToLower(address), "mailto:") {
+			address = address[len("mailto:"):]
+		}
+		e.attendees = append(e.attendees, address)
+		if name := p.params["CN"]; name != "" {
+			e.attendees = append(e.attendees, name)
+		}
+	}
+
+	start, ok := c.prop("DTSTART")
+	if !ok {
+		return e, false, fmt.Errorf("no DTSTART")
+	}
+
+	times, z, allDay, err := parseTimes(start, zones)
+	if err != nil || allDay {
+		return e, false, err
+	}
+	e.start, e.zone = times[0], z
+
+	if end, ok := c.prop("DTEND"); ok {
+		ends, endZone, _, err := parseTimes(end, zones)
+		if err != nil {
+			return e, false, err
+		}
+		e.length = endZone.instant(ends[0]).Sub(z.instant(e.start))
+	} else if p, ok := c.prop("DURATION"); ok {
+		if e.length, err = parseICSDuration(p.value); err != nil {
+			return e, false, err
+		}
+	}
+
+	if p, ok := c.prop("RRULE"); ok {
+		if e.rule, err = parseRule(p.value, e.start, z); err != nil {
+			return e, false, err
+		}
+	}
+
+	// Extra and excluded occurrences are kept as instants
+	for name, list := range map[string]*[]time.Time{"RDATE": &e.rdates, "EXDATE": &e.exdates} {
+		for _, p := range c.all(name) {
+			times, tz, _, err := parseTimes(p, zones)
+			if err != nil {
+				return e, false, err
+			}
+			for _, t := range times {
+				*list = append(*list, tz.instant(t))
+			}
+		}
+	}
+
+	if p, ok := c.prop("RECURRENCE-ID"); ok {
+		times, tz, _, err := parseTimes(p, zones)
+		if err != nil {
+			return e, false, err
+		}
+		e.recurrenceID = tz.instant(times[0])
+	}
+
+	return e, true, nil
+}
+
+// Whether an occurrence of e is on at t, leaving out the ones in skip, which
+// were moved or changed
+func (e event) onAt(t time.Time, skip []time.Time) bool {
+	on := func(start time.Time) bool {
+		for _, list := range [][]time.Time{skip, e.exdates} {
+			for _, s := range list {
+				if s.Equal(start) {
+					return false
+				}
+			}
+		}
+		return !start.After(t) && t.Before(start.Add(e.length))
+	}
+
+	first := e.zone.instant(e.start)
+
+	if e.rule == nil {
+		if on(first) {
+			return true
+		}
+	} else {
+		// A day either side covers DST changes while the event is on
+		wall := e.zone.wall(t)
+		for _, start := range e.rule.Between(wall.Add(-e.length-24*time.Hour), wall.Add(24*time.Hour), true) {
+			if on(e.zone.instant(start)) {
+				return true
+			}
+		}
+	}
+
+	for _, start := range e.rdates {
+		if on(start) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The events on at t. Occurrences that were changed are replaced by their
+// changed version.
+func eventsAt(events []event, t time.Time) []event {
+	moved := map[string][]time.Time{}
+	for _, e := range events {
+		if !e.recurrenceID.IsZero() {
+			moved[e.uid] = append(moved[e.uid], e.recurrenceID)
+		}
+	}
+
+	var on []event
+	for _, e := range events {
+		var skip []time.Time
+		if e.recurrenceID.IsZero() {
+			skip = moved[e.uid]
+		}
+
+		if e.onAt(t, skip) {
+			on = append(on, e)
+		}
+	}
+
+	return on
+}
+
+// Read the events of an .ics file, or every .ics file in a directory, such
+// as one kept in sync with CalDAV. Files are only parsed again once they
+// change.
+func (switcher *Switcher) calendarEvents(path string) ([]event, error) {
+	if switcher.calendars == nil {
+		switcher.calendars = map[string]calendarFile{}
+	}
+
+	var files []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (p == path || strings.EqualFold(filepath.Ext(p), ".ics")) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("calendar %s: %w", path, err)
+	}
+
+	var events []event
+	var errs []string
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		cached, ok := switcher.calendars[file]
+		if !ok || !cached.modified.Equal(info.ModTime()) || cached.size != info.Size() {
+			cached = readCalendar(file)
+			cached.modified, cached.size = info.ModTime(), info.Size()
+			switcher.calendars[file] = cached
+		}
+
+		if cached.err != nil {
+			errs = append(errs, fmt.Sprintf("calendar %s: %s", file, cached.err.Error()))
+		}
+		events = append(events, cached.events...)
+	}
+
+	if len(errs) > 0 {
+		return events, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return events, nil
+}
+
+// Events that can't be read are left out and logged, so one bad event
+// doesn't stop the rest of the file from working
+func readCalendar(file string) calendarFile {
+	f, err := os.Open(file)
+	if err != nil {
+		return calendarFile{err: err}
+	}
+	defer f.Close()
+
+	components, err := parseICS(f)
+	if err != nil {
+		return calendarFile{err: err}
+	}
+
+	events, errs := parseEvents(components)
+	for _, err := range errs {
+		fmt.Printf("Error: calendar %s: %s\n", file, err)
+	}
+
+	return calendarFile{events: events}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	// The fixtures use zones by name, which shouldn't depend on the system
+	_ "time/tzdata"
+)
+
+func loadFixture(t *testing.T, name string) []event {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", "calendars", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	components, err := parseICS(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, errs := parseEvents(components)
+	if len(errs) > 0 {
+		t.Fatalf("%s: %s", name, strings.Join(errs, "\n"))
+	}
+	return events
+}
+
+// Check which events are on at each time, given in UTC
+func checkEventsAt(t *testing.T, events []event, want map[string]string) {
+	t.Helper()
+
+	for at, title := range want {
+		instant, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []string
+		for _, e := range eventsAt(events, instant) {
+			titles = append(titles, e.title)
+		}
+
+		if got := strings.Join(titles, ", "); got != title {
+			t.Errorf("at %s: got %q, want %q", at, got, title)
+		}
+	}
+}
+
+// A weekday standup with one day excluded and one moved to the afternoon
+func TestCalendarExdateAndRecurrenceID(t *testing.T) {
+	events := loadFixture(t, "standup.ics")
+
+	checkEventsAt(t, events, map[string]string{
+		"2024-01-08T08:30:00Z": "Standup",
+		"2024-01-09T08:40:00Z": "Standup",
+		"2024-01-09T08:45:00Z": "",
+		"2024-01-10T08:35:00Z": "",
+		"2024-01-11T08:35:00Z": "",
+		"2024-01-11T13:05:00Z": "Standup (moved)",
+		"2024-01-12T08:35:00Z": "Standup",
+		"2024-01-13T08:35:00Z": "",
+		"2024-01-31T08:35:00Z": "Standup",
+		"2024-02-01T08:35:00Z": "",
+	})
+}
+
+// Outlook names zones after Windows, which Go doesn't know, so the
+// VTIMEZONE's rules are used. Europe moved to summer time on 31 March 2024.
+func TestCalendarOutlookTimezone(t *testing.T) {
+	events := loadFixture(t, "outlook.ics")
+
+	if _, ok := events[0].zone.(*vtimezone); !ok {
+		t.Fatalf("zone is %T, want the VTIMEZONE", events[0].zone)
+	}
+
+	checkEventsAt(t, events, map[string]string{
+		// 09:00 CET is 08:00 UTC
+		"2024-03-04T07:30:00Z": "",
+		"2024-03-04T08:30:00Z": "Planning",
+		"2024-03-25T08:30:00Z": "Planning",
+		"2024-03-25T09:00:00Z": "",
+		// 09:00 CEST is 07:00 UTC
+		"2024-04-01T07:30:00Z": "Planning",
+		"2024-04-01T08:30:00Z": "",
+		"2024-04-08T07:00:00Z": "Planning",
+		// COUNT=6 ends on 8 April
+		"2024-04-15T07:30:00Z": "",
+	})
+
+	if attendees := strings.Join(events[0].attendees, ", "); attendees != "alice@example.com, Alice Example" {
+		t.Errorf("attendees are %q", attendees)
+	}
+}
+
+// A weekly meeting keeps its local time when New York moves to daylight
+// saving time on 10 March 2024
+func TestCalendarWeeklyAcrossDST(t *testing.T) {
+	events := loadFixture(t, "weekly.ics")
+
+	checkEventsAt(t, events, map[string]string{
+		// 10:00 EST is 15:00 UTC
+		"2024-03-04T15:30:00Z": "1:1",
+		"2024-03-04T14:30:00Z": "",
+		// 10:00 EDT is 14:00 UTC
+		"2024-03-11T14:30:00Z": "1:1",
+		"2024-03-11T15:30:00Z": "",
+		"2024-11-04T15:30:00Z": "1:1",
+		"2024-03-12T14:30:00Z": "",
+	})
+}
+
+// Instants either side of a change are compared with when it happens in UTC,
+// not its wall clock time. Europe changes at 01:00 UTC.
+func TestVTimezoneWall(t *testing.T) {
+	events := loadFixture(t, "outlook.ics")
+	z, ok := events[0].zone.(*vtimezone)
+	if !ok {
+		t.Fatalf("zone is %T, want the VTIMEZONE", events[0].zone)
+	}
+
+	tests := []struct {
+		instant string
+		wall    string
+	}{
+		{"2024-03-31T00:30:00Z", "2024-03-31T01:30:00Z"},
+		// 02:00 CET became 03:00 CEST, ahead of 02:00 UTC
+		{"2024-03-31T01:00:00Z", "2024-03-31T03:00:00Z"},
+		{"2024-03-31T01:30:00Z", "2024-03-31T03:30:00Z"},
+		{"2024-07-01T12:00:00Z", "2024-07-01T14:00:00Z"},
+		// 03:00 CEST became 02:00 CET, so 02:30 comes twice
+		{"2024-10-27T00:30:00Z", "2024-10-27T02:30:00Z"},
+		{"2024-10-27T01:30:00Z", "2024-10-27T02:30:00Z"},
+		{"2024-10-27T02:30:00Z", "2024-10-27T03:30:00Z"},
+		{"2024-12-01T12:00:00Z", "2024-12-01T13:00:00Z"},
+	}
+
+	for _, test := range tests {
+		instant, _ := time.Parse(time.RFC3339, test.instant)
+		want, _ := time.Parse(time.RFC3339, test.wall)
+
+		if got := z.wall(instant); !got.Equal(want) {
+			t.Errorf("%s: wall is %s, want %s", test.instant, got.Format("15:04"), want.Format("15:04"))
+		}
+	}
+}
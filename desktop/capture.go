@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gen2brain/iup-go/iup"
+	"golang.org/x/exp/slices"
+)
+
+// IUP codes of keys that aren't written as themselves
+var iupKeys = map[int]string{
+	iup.K_SP:    "space",
+	iup.K_BS:    "backspace",
+	iup.K_TAB:   "tab",
+	iup.K_CR:    "enter",
+	iup.K_ESC:   "escape",
+	iup.K_HOME:  "home",
+	iup.K_END:   "end",
+	iup.K_PGUP:  "pageup",
+	iup.K_PGDN:  "pagedown",
+	iup.K_LEFT:  "left",
+	iup.K_UP:    "up",
+	iup.K_RIGHT: "right",
+	iup.K_DOWN:  "down",
+	iup.K_INS:   "insert",
+	iup.K_DEL:   "delete",
+}
+
+// Pressing one of these alone doesn't finish a combo
+var iupModifiers = []int{
+	iup.K_LSHIFT, iup.K_RSHIFT,
+	iup.K_LCTRL, iup.K_RCTRL,
+	iup.K_LALT, iup.K_RALT,
+}
+
+// IUP reports shifted punctuation as the character it types, assume a US
+// layout to get the key back
+var shifted = map[rune]string{
+	'~': "`", '!': "1", '@': "2", '#': "3", '$': "4", '%': "5", '^': "6",
+	'&': "7", '*': "8", '(': "9", ')': "0", '_': "-", '+': "=", '{': "[",
+	'}': "]", '|': "\\", ':': ";", '"': "'", '<': ",", '>': ".", '?': "/",
+}
+
+// Translate a K_ANY code to a combo, false for lone modifiers and keys that
+// can't be bound
+func iupCombo(code int) (combo, bool) {
+	var c combo
+
+	if iup.IsCtrlXKey(code) {
+		c.mods = append(c.mods, "ctrl")
+	}
+	if iup.IsAltXKey(code) {
+		c.mods = append(c.mods, "alt")
+	}
+	if iup.IsShiftXKey(code) {
+		c.mods = append(c.mods, "shift")
+	}
+	if iup.IsSysXKey(code) {
+		c.mods = append(c.mods, "super")
+	}
+
+	base := iup.XKeyBase(code)
+	if slices.Contains(iupModifiers, base) {
+		return combo{}, false
+	}
+
+	// Shift is only flagged alongside other modifiers
+	addShift := func() {
+		if len(c.mods) == 0 {
+			c.mods = []string{"shift"}
+		}
+	}
+
+	switch {
+	case iupKeys[base] != "":
+		c.key = iupKeys[base]
+	case base >= iup.K_F1 && base < iup.K_F1+24:
+		c.key = fmt.Sprintf("f%d", base-iup.K_F1+1)
+	case base >= 'A' && base <= 'Z':
+		addShift()
+		c.key = strings.ToLower(string(rune(base)))
+	case shifted[rune(base)] != "":
+		addShift()
+		c.key = shifted[rune(base)]
+	case iup.IsPrint(base):
+		c.key = strings.ToLower(string(rune(base)))
+	}
+
+	if _, ok := vkCodes[c.key]; !ok {
+		return combo{}, false
+	}
+
+	return c, true
+}
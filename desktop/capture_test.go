@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gen2brain/iup-go/iup"
+)
+
+func TestIupCombo(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+		ok   bool
+	}{
+		{'a', "a", true},
+		{'A', "shift+a", true},
+		{iup.XKeyCtrl('a'), "ctrl+a", true},
+		{iup.XKeyCtrl(iup.XKeyShift('A')), "ctrl+shift+a", true},
+		{iup.XKeyAlt(iup.K_F1 + 8), "alt+F9", true},
+		{iup.XKeySys(iup.K_SP), "super+space", true},
+		{iup.K_LEFT, "left", true},
+		// Shifted punctuation comes back as the key it's typed with
+		{'|', "shift+\\", true},
+		{'?', "shift+/", true},
+		{iup.XKeyCtrl('_'), "ctrl+-", true},
+		{'\\', "\\", true},
+		// Still waiting for the key
+		{iup.K_LSHIFT, "", false},
+		{iup.XKeyCtrl(iup.K_RALT), "", false},
+		// No such key to bind
+		{iup.K_Print, "", false},
+		{iup.K_ccedilla, "", false},
+	}
+
+	for _, test := range tests {
+		c, ok := iupCombo(test.code)
+		if ok != test.ok || (ok && c.String() != test.want) {
+			t.Errorf("%#x: got %q, %v, want %q, %v", test.code, c, ok, test.want, test.ok)
+		}
+
+		// Whatever is recorded can be read back from the config
+		if ok {
+			if parsed, err := parseCombo(c.String()); err != nil || parsed.String() != c.String() {
+				t.Errorf("%#x: recorded %q reads back as %q, %v", test.code, c, parsed, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"restore":  {"restore [backup|number]  List config backups or roll back to one", restoreCommand},
+	"profile":  {"profile [list|use|save|delete] [name]  Manage profiles", profileCommand},
+	"config":   {"config export|import [flags]  Export or import the config as JSON, YAML or INI", configCommand},
+	"switch":   {"switch [--for duration] <output>  Switch the running app to an output, counting from 1", switchCommand},
+	"previous": {"previous  Toggle the running app back to the previous output", previousCommand},
+	"timer":    {"timer [cancel|extend [duration]]  Show, cancel or extend a timed switch", timerCommand},
+	"run":      {"run <action>  Run an action such as cycle, reverse, mute or previous", runActionCommand},
+}
+
+// runCommand runs a CLI subcommand instead of the tray app
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return 2
+	}
+
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: soundbrick [flags] [command]\n\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func restoreCommand(args []string) error {
+	backups := utils.Backups()
+
+	if len(args) == 0 {
+		if len(backups) == 0 {
+			fmt.Printf("No backups in %s\n", utils.BackupDir())
+			return nil
+		}
+
+		for i, name := range backups {
+			fmt.Printf("%2d  %s\n", i+1, name)
+		}
+		return nil
+	}
+
+	name := args[0]
+	if i, err := strconv.Atoi(name); err == nil {
+		if i < 1 || i > len(backups) {
+			return fmt.Errorf("there is no backup %d", i)
+		}
+		name = backups[i-1]
+	}
+
+	if err := utils.Restore(name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s to %s\n", name, utils.ConfigPath())
+	return nil
+}
+
+func profileCommand(args []string) error {
+	cfg := loadConfig()
+
+	if len(args) == 0 || args[0] == "list" {
+		active := cfg.Section("").Key("profile").String()
+		for _, name := range profileNames(cfg) {
+			if name == active {
+				fmt.Printf("* %s\n", name)
+			} else {
+				fmt.Printf("  %s\n", name)
+			}
+		}
+		return nil
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("usage: soundbrick profile %s <name>", args[0])
+	}
+
+	var err error
+	switch name := args[1]; args[0] {
+	case "use":
+		err = useProfile(cfg, name)
+	case "save":
+		err = saveProfile(cfg, name)
+	case "delete":
+		err = deleteProfile(cfg, name)
+	default:
+		err = fmt.Errorf("unknown profile command %q", args[0])
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// A running app picks this up through the config watcher
+	return utils.Save(cfg)
+}
+
+func apiURL(path string) (string, error) {
+	port := apiPort(loadConfig())
+	if port == "0" {
+		return "", fmt.Errorf("the API is turned off with api_port = 0, which this command needs")
+	}
+	return fmt.Sprintf("http://%s:%s%s", API_HOST, port, path), nil
+}
+
+// Ask the running app to do something through its API
+func callAPI(path string, params url.Values) (apiState, error) {
+	u, err := apiURL(path)
+	if err != nil {
+		return apiState{}, err
+	}
+
+	res, err := http.PostForm(u, params)
+	return readState(res, err)
+}
+
+func getState() (apiState, error) {
+	u, err := apiURL("/state")
+	if err != nil {
+		return apiState{}, err
+	}
+
+	res, err := http.Get(u)
+	return readState(res, err)
+}
+
+func readState(res *http.Response, err error) (apiState, error) {
+	var state apiState
+
+	if err != nil {
+		return state, fmt.Errorf("could not reach SoundBrick, is it running? %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return state, fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+
+	return state, json.NewDecoder(res.Body).Decode(&state)
+}
+
+func printOutput(state apiState) {
+	if state.CurrentOutput >= 0 && state.CurrentOutput < len(state.Outputs) {
+		fmt.Printf("Output %d: %s\n", state.CurrentOutput+1, state.Outputs[state.CurrentOutput])
+	} else {
+		fmt.Println("Muted")
+	}
+
+	if x := state.RevertOutput; x != nil && *x < len(state.Outputs) {
+		at, _ := time.Parse(time.RFC3339, state.RevertAt)
+		fmt.Printf("Back to %s at %s\n", state.Outputs[*x], at.Local().Format("15:04"))
+	}
+}
+
+func switchCommand(args []string) error {
+	fs := flag.NewFlagSet("switch", flag.ContinueOnError)
+	d := fs.String("for", "", "Switch back after this long, e.g. 20m")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: soundbrick switch [--for duration] <output>")
+	}
+
+	state, err := callAPI("/output", url.Values{"n": {fs.Arg(0)}, "for": {*d}})
+	if err != nil {
+		return err
+	}
+
+	printOutput(state)
+	return nil
+}
+
+func runActionCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: soundbrick run <action>")
+	}
+
+	state, err := callAPI("/action", url.Values{"name": {args[0]}})
+	if err != nil {
+		return err
+	}
+
+	printOutput(state)
+	return nil
+}
+
+func timerCommand(args []string) error {
+	var state apiState
+	var err error
+
+	switch {
+	case len(args) == 0:
+		state, err = getState()
+		if err == nil && state.RevertOutput == nil {
+			fmt.Println("No timed switch is running")
+			return nil
+		}
+	case args[0] == "cancel" && len(args) == 1:
+		state, err = callAPI("/timer", url.Values{"action": {"cancel"}})
+	case args[0] == "extend" && len(args) <= 2:
+		params := url.Values{"action": {"extend"}}
+		if len(args) == 2 {
+			params.Set("by", args[1])
+		}
+		state, err = callAPI("/timer", params)
+	default:
+		return fmt.Errorf("usage: soundbrick timer [cancel|extend [duration]]")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	printOutput(state)
+	return nil
+}
+
+func previousCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: soundbrick previous")
+	}
+
+	state, err := callAPI("/previous", nil)
+	if err != nil {
+		return err
+	}
+
+	printOutput(state)
+	return nil
+}
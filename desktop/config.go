@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+type configKey struct {
+	fallback string
+	validate func(string) error
+}
+
+// Keys, their default values and how to validate them
+var configKeys = withLabels(map[string]configKey{
+	"outputs":             {"auto", validOutputs},
+	"enabled":             {"ON, ON, ON, ON", validEnabled},
+	"current_output":      {"0", validOutput},
+	"ip":                  {"", validIP},
+	"hotkey":              {"\\", validHotkey},
+	"hotkey_reverse":      {"", validHotkey},
+	"hotkey_mute":         {"", validHotkey},
+	"hotkey_previous":     {"", validHotkey},
+	"hotkey_push_to_mute": {"", validHotkey},
+	"double_tap_ms":       {"300", validMillis},
+	"hold_ms":             {"500", validMillis},
+	"cycle_order":         {"", validOrder},
+	"cycle_mode":          {"wrap", validCycleMode},
+	"cycle_mute":          {"false", validBool},
+	"switch_unmutes":      {"false", validBool},
+	"revert_output":       {"", validRevertOutput},
+	"revert_at":           {"", validTime},
+	"timer_extend":        {"10m", validDuration},
+	"history":             {"", validHistory},
+	"history_size":        {"10", validHistorySize},
+	"rules_interval":      {"2s", validDuration},
+	"rules_dry_run":       {"false", validBool},
+	"focus_delay":         {"1s", validDuration},
+	"backups":             {"5", validCount},
+	"profile":             {"", validProfile},
+	"api_port":            {API_PORT, validPort},
+	"osc_port":            {"", validPort},
+	"osc_bind":            {"127.0.0.1", validOSCBind},
+	"osc_clients":         {"", validOSCClients},
+	"midi_port":           {"", validMIDIPort},
+	"dbus":                {"true", validBool},
+})
+
+// Add output1..outputN label keys and their hotkeys
+func withLabels(keys map[string]configKey) map[string]configKey {
+	for i := 0; i < MAX_OUTPUTS; i++ {
+		keys[outputKey(i)] = configKey{defaultLabel(i), validLabel}
+		keys[BINDING_PREFIX+outputKey(i)] = configKey{"", validHotkey}
+	}
+	return keys
+}
+
+// Sections by name prefix, and the keys they may hold
+var configSections = map[string]map[string]configKey{
+	PROFILE_PREFIX:  subset(isProfileKey),
+	CYCLE_PREFIX:    cycleSchema,
+	RULE_PREFIX:     ruleSchema,
+	SCHEDULE_PREFIX: scheduleSchema,
+	HOOKS_SECTION:   hooksSchema,
+	MACRO_PREFIX:    macroSchema,
+	WEBHOOK_PREFIX:  webhookSchema,
+	MIDI_PREFIX:     midiSchema,
+}
+
+func subset(include func(string) bool) map[string]configKey {
+	schema := map[string]configKey{}
+	for key, v := range configKeys {
+		if include(key) {
+			schema[key] = v
+		}
+	}
+	return schema
+}
+
+// Keys that are picked up when config.ini is edited while running, profile
+// first so that the rest apply to it
+var liveKeys = withLabelKeys([]string{"profile", "outputs", "enabled", "ip", "hotkey", "hotkey_reverse", "hotkey_mute", "hotkey_previous", "hotkey_push_to_mute", "double_tap_ms", "hold_ms", "cycle_order", "cycle_mode", "cycle_mute", "switch_unmutes", "timer_extend", "history_size", "rules_interval", "rules_dry_run", "focus_delay", "midi_port"})
+
+// Keys the app keeps up to date itself, following the device and the timer,
+// so edits to them are written over rather than picked up
+var stateKeys = []string{"current_output", "revert_output", "revert_at"}
+
+// Keys that are read once at startup. Edits to them are kept, but only take
+// effect after a restart.
+var restartKeys = []string{"api_port", "osc_port", "osc_bind", "dbus"}
+
+func withLabelKeys(keys []string) []string {
+	for i := 0; i < MAX_OUTPUTS; i++ {
+		keys = append(keys, outputKey(i), BINDING_PREFIX+outputKey(i))
+	}
+	return keys
+}
+
+// Load config.ini, filling in missing keys with their defaults
+func loadConfig() *ini.File {
+	cfg := utils.Load()
+
+	sec, _ := cfg.GetSection("")
+
+	// Key would add outputs with an empty value, which isn't valid
+	count := 0
+	if sec.HasKey("outputs") {
+		count = configuredOutputs(sec.Key("outputs").String())
+	}
+	if count == 0 {
+		count = DEFAULT_OUTPUTS
+	}
+
+	for k, v := range configKeys {
+		// Only label the outputs we know of
+		if i, ok := labelIndex(strings.TrimPrefix(k, BINDING_PREFIX)); ok && i >= count {
+			continue
+		}
+
+		if !sec.HasKey(k) {
+			sec.NewKey(k, v.fallback)
+		}
+	}
+
+	// Older configs stored hotkeys as keycodes
+	if migrateHotkeys(cfg) {
+		if err := utils.Save(cfg); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+		}
+	}
+
+	return cfg
+}
+
+// Check every key and section of cfg against the schema
+func validateConfig(cfg *ini.File) []string {
+	var errs []string
+
+	check := func(schema map[string]configKey, sec *ini.Section, prefix string) {
+		for _, key := range sec.Keys() {
+			k, ok := schema[key.Name()]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%sunknown key %s", prefix, key.Name()))
+				continue
+			}
+			if err := k.validate(key.String()); err != nil {
+				errs = append(errs, fmt.Sprintf("%s%s: %s", prefix, key.Name(), err.Error()))
+			}
+		}
+	}
+
+	for _, sec := range cfg.Sections() {
+		if isRoot(sec) {
+			check(configKeys, sec, "")
+			continue
+		}
+
+		schema := sectionSchema(sec.Name())
+		if schema == nil {
+			errs = append(errs, fmt.Sprintf("unknown section [%s]", sec.Name()))
+			continue
+		}
+		check(schema, sec, fmt.Sprintf("[%s] ", sec.Name()))
+	}
+
+	if root := cfg.Section(""); root.HasKey("profile") {
+		name := root.Key("profile").String()
+		if _, err := cfg.GetSection(profileSection(name)); name != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("profile: no profile named %q", name))
+		}
+	}
+
+	if root := cfg.Section(""); root.HasKey("osc_bind") {
+		if err := oscBindError(root.Key("osc_bind").String(), root.Key("osc_clients").String()); err != nil {
+			errs = append(errs, "osc_bind: "+err.Error())
+		}
+	}
+
+	return errs
+}
+
+func sectionSchema(name string) map[string]configKey {
+	for prefix, schema := range configSections {
+		if strings.HasPrefix(name, prefix) {
+			return schema
+		}
+	}
+	return nil
+}
+
+func validOutputs(value string) error {
+	if value != "auto" && configuredOutputs(value) == 0 {
+		return fmt.Errorf("%q is not auto or a number from 1 to %d", value, MAX_OUTPUTS)
+	}
+	return nil
+}
+
+func validCount(value string) error {
+	if x, err := strconv.Atoi(value); err != nil || x < 0 {
+		return fmt.Errorf("%q is not a positive number", value)
+	}
+	return nil
+}
+
+func validPort(value string) error {
+	if x, err := strconv.Atoi(value); value != "" && (err != nil || x < 0 || x > 65535) {
+		return fmt.Errorf("%q is not a port", value)
+	}
+	return nil
+}
+
+func validProfile(value string) error {
+	if value == "" {
+		return nil
+	}
+	return validProfileName(value)
+}
+
+func validLabel(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("label cannot be empty")
+	}
+	return nil
+}
+
+func validEnabled(value string) error {
+	states := strings.Split(value, ",")
+	if len(states) > MAX_OUTPUTS {
+		return fmt.Errorf("expected at most %d states, got %d", MAX_OUTPUTS, len(states))
+	}
+
+	for _, state := range states {
+		if s := strings.TrimSpace(state); s != "ON" && s != "OFF" {
+			return fmt.Errorf("%q is not ON or OFF", s)
+		}
+	}
+	return nil
+}
+
+func validOutput(value string) error {
+	x, err := strconv.Atoi(value)
+	if err != nil || x < 0 || x > MAX_OUTPUTS {
+		return fmt.Errorf("%q is not a valid output", value)
+	}
+	return nil
+}
+
+func validIP(value string) error {
+	if value != "" && net.ParseIP(value) == nil {
+		return fmt.Errorf("%q is not an IP address", value)
+	}
+	return nil
+}
+
+func validHotkey(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := parseTrigger(value)
+	return err
+}
+
+func validHistorySize(value string) error {
+	if x, err := strconv.Atoi(value); err != nil || x < 2 || x > 100 {
+		return fmt.Errorf("%q is not a number from 2 to 100", value)
+	}
+	return nil
+}
+
+func validMillis(value string) error {
+	if x, err := strconv.Atoi(value); err != nil || x < 1 || x > 5000 {
+		return fmt.Errorf("%q is not a time between 1 and 5000 ms", value)
+	}
+	return nil
+}
+
+// Values are named by their key in the root section, or <section>/<key>
+func (switcher *Switcher) configValue(id string) string {
+	sec, key, found := strings.Cut(id, "/")
+	if !found {
+		return switcher.config.Section("").Key(id).String()
+	}
+
+	if s, err := switcher.config.GetSection(sec); err == nil && s.HasKey(key) {
+		return s.Key(key).String()
+	}
+	return ""
+}
+
+// Root keys go through their update channel, sections are set directly
+func (switcher *Switcher) setValue(id, value string) {
+	sec, key, found := strings.Cut(id, "/")
+	if !found {
+		switcher.updated[id] <- value
+		return
+	}
+
+	switcher.config.Section(sec).Key(key).SetValue(value)
+	switcher.save()
+}
+
+// Apply changes made to config.ini outside of the app
+func (switcher *Switcher) reload(cfg *ini.File) {
+	sec := cfg.Section("")
+	Key := switcher.config.Section("").Key
+
+	var invalid []string
+
+	switcher.syncProfiles(cfg)
+
+	if switcher.syncSections(cfg, CYCLE_PREFIX) {
+		switcher.updated["new_hotkey"] <- "cycles"
+	}
+
+	switcher.syncSections(cfg, RULE_PREFIX)
+
+	switcher.syncSections(cfg, HOOKS_SECTION)
+
+	switcher.syncSections(cfg, WEBHOOK_PREFIX)
+
+	switcher.syncSections(cfg, MIDI_PREFIX)
+
+	if switcher.syncSections(cfg, SCHEDULE_PREFIX) {
+		switcher.updated["schedule"] <- ""
+	}
+
+	if switcher.syncSections(cfg, MACRO_PREFIX) {
+		switcher.updated["new_hotkey"] <- "macros"
+		switcher.refreshTray("macros")
+	}
+
+	// The active profile takes precedence over the keys it mirrors
+	var profile map[string]string
+	if name := profileName(sec.Key("profile").String()); name != "" {
+		values, err := profileValues(cfg, name)
+		if err != nil {
+			invalid = append(invalid, err.Error())
+			sec.DeleteKey("profile")
+		} else {
+			sec.Key("profile").SetValue(name)
+		}
+		profile = values
+	}
+
+	for _, key := range liveKeys {
+		value, ok := profile[key]
+		if !ok {
+			if !sec.HasKey(key) {
+				continue
+			}
+			value = strings.TrimSpace(sec.Key(key).String())
+		}
+
+		if value == Key(key).String() {
+			continue
+		}
+
+		if err := configKeys[key].validate(value); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", key, err.Error()))
+			continue
+		}
+
+		fmt.Printf("Reloaded %s = %s\n", key, value)
+		switcher.updated[key] <- value
+
+		if key == "ip" {
+			go switcher.connect()
+		} else if isBindingKey(key) {
+			switcher.updated["new_hotkey"] <- key
+		}
+	}
+
+	// Everything else is copied as is, so saving doesn't undo the edit
+	var restart []string
+	for _, key := range sec.Keys() {
+		name := key.Name()
+		if _, ok := configKeys[name]; !ok || slices.Contains(liveKeys, name) || slices.Contains(stateKeys, name) {
+			continue
+		}
+
+		value := strings.TrimSpace(key.String())
+		if value == Key(name).String() {
+			continue
+		}
+
+		if err := configKeys[name].validate(value); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+
+		fmt.Printf("Reloaded %s = %s\n", name, value)
+		switcher.updated[name] <- value
+
+		if slices.Contains(restartKeys, name) {
+			restart = append(restart, name)
+		}
+	}
+
+	if len(restart) > 0 {
+		fmt.Printf("Restart to apply: %s\n", strings.Join(restart, ", "))
+		utils.Alert("Restart needed!", fmt.Sprintf("Restart Sound Brick to apply %s.", strings.Join(restart, ", ")), 2)
+	}
+
+	if len(invalid) > 0 {
+		fmt.Printf("Ignored invalid config: %s\n", strings.Join(invalid, "; "))
+		utils.Alert("Invalid config!", strings.Join(invalid, "\n"), 2)
+	}
+}
+
+// Replace our profiles with the ones in cfg
+func (switcher *Switcher) syncProfiles(cfg *ini.File) {
+	for _, name := range profileNames(switcher.config) {
+		switcher.config.DeleteSection(profileSection(name))
+	}
+
+	for _, name := range profileNames(cfg) {
+		sec := switcher.config.Section(profileSection(name))
+		for _, key := range cfg.Section(profileSection(name)).Keys() {
+			sec.Key(key.Name()).SetValue(key.String())
+		}
+	}
+
+	switcher.refreshTray("profiles")
+}
+
+// Replace our sections starting with prefix with the ones in cfg, returning
+// whether any changed
+func (switcher *Switcher) syncSections(cfg *ini.File, prefix string) bool {
+	before := sectionsString(switcher.config, prefix)
+
+	for _, sec := range switcher.config.Sections() {
+		if strings.HasPrefix(sec.Name(), prefix) {
+			switcher.config.DeleteSection(sec.Name())
+		}
+	}
+
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), prefix) {
+			ours := switcher.config.Section(sec.Name())
+			for _, key := range sec.Keys() {
+				ours.Key(key.Name()).SetValue(key.String())
+			}
+		}
+	}
+
+	return sectionsString(switcher.config, prefix) != before
+}
+
+func sectionsString(cfg *ini.File, prefix string) string {
+	var b strings.Builder
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), prefix) {
+			fmt.Fprintf(&b, "[%s]\n", sec.Name())
+			for _, key := range sec.Keys() {
+				fmt.Fprintf(&b, "%s=%s\n", key.Name(), key.String())
+			}
+		}
+	}
+	return b.String()
+}
+
+func (switcher *Switcher) watchConfig() {
+	utils.WatchConfig(switcher.reload)
+}
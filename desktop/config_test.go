@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Every key has to come back the same after a save, including hotkeys that
+// end in a backslash
+func TestConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	t.Setenv("SOUNDBRICK_CONFIG", path)
+
+	// A keycode from an older release, migrated to \ when loaded
+	old := "hotkey = 220\nhotkey_mute = ctrl+m\nhotkey_reverse = alt+\\\noutput1 = Speakers\n\n[cycle.ab]\norder = 1, 2\nhotkey = shift+\\\n"
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := loadConfig()
+	if got := cfg.Section("").Key("hotkey").String(); got != "\\" {
+		t.Fatalf("hotkey = %q after migrating, want \\", got)
+	}
+
+	if err := utils.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := loadConfig()
+
+	for _, sec := range cfg.Sections() {
+		for _, key := range sec.Keys() {
+			got, err := reloaded.Section(sec.Name()).GetKey(key.Name())
+			if err != nil {
+				t.Errorf("[%s] %s is missing after reloading", sec.Name(), key.Name())
+				continue
+			}
+			if got.String() != key.String() {
+				t.Errorf("[%s] %s = %q after reloading, want %q", sec.Name(), key.Name(), got.String(), key.String())
+			}
+		}
+	}
+
+	if errs := validateConfig(reloaded); len(errs) > 0 {
+		t.Errorf("reloaded config is invalid: %v", errs)
+	}
+}
+
+func TestReloadKeepsEdits(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 2\ncurrent_output = 1\nbackups = 5\nhistory_size = 10\ndbus = false\n")
+	Key := switcher.config.Section("").Key
+
+	edited, err := utils.Parse([]byte("current_output = 3\nbackups = 2\nhistory_size = 4\nhistory = 2, 1\ndbus = true\nosc_port = 99999\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	switcher.reload(edited)
+	settle(switcher)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		// Live
+		{"history_size", "4"},
+		// Not live, but kept so the next save doesn't undo them
+		{"backups", "2"},
+		{"history", "2, 1"},
+		{"dbus", "true"},
+		// Follows the device
+		{"current_output", "1"},
+		// Invalid
+		{"osc_port", ""},
+	}
+
+	for _, test := range tests {
+		if got := Key(test.key).String(); got != test.want {
+			t.Errorf("%s = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+// Named cycles are [cycle.<name>] sections with their own order and hotkeys
+const CYCLE_PREFIX = "cycle."
+
+// What cycling past the last step does
+var cycleModes = []string{"wrap", "stop"}
+
+// Written in an order to make mute a step
+const MUTE_STEP = "mute"
+
+// Like profiles, cycle names are case-insensitive
+func cycleName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func cycleSection(name string) string {
+	return CYCLE_PREFIX + cycleName(name)
+}
+
+func cycleNames(cfg *ini.File) []string {
+	var names []string
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), CYCLE_PREFIX) {
+			names = append(names, strings.TrimPrefix(sec.Name(), CYCLE_PREFIX))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func validCycleName(name string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "[]=/") {
+		return fmt.Errorf("%q is not a valid cycle name", name)
+	}
+	return nil
+}
+
+// An order is a list of outputs, 1 being the first, and optionally mute
+func parseOrder(value string) ([]string, error) {
+	var steps []string
+
+	for _, step := range strings.Split(value, ",") {
+		step = strings.ToLower(strings.TrimSpace(step))
+		if step == "" {
+			continue
+		}
+
+		if step != MUTE_STEP {
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 1 || n > MAX_OUTPUTS {
+				return nil, fmt.Errorf("%q is not an output or mute", step)
+			}
+			step = strconv.Itoa(n)
+		}
+
+		if slices.Contains(steps, step) {
+			return nil, fmt.Errorf("%s is in the order twice", step)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func validOrder(value string) error {
+	_, err := parseOrder(value)
+	return err
+}
+
+func validCycleMode(value string) error {
+	if !slices.Contains(cycleModes, value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(cycleModes, ", "))
+	}
+	return nil
+}
+
+func validBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	return nil
+}
+
+// The keys of the default cycle, and the ones a named cycle may set instead
+var cycleKeys = map[string]string{
+	"cycle_order": "order",
+	"cycle_mode":  "mode",
+	"cycle_mute":  "mute",
+}
+
+var cycleSchema = map[string]configKey{
+	"order":          {"", validOrder},
+	"mode":           {"wrap", validCycleMode},
+	"mute":           {"false", validBool},
+	"hotkey":         {"", validHotkey},
+	"hotkey_reverse": {"", validHotkey},
+}
+
+// The outputs a cycle steps through, using the muted index for mute, and
+// whether it wraps around
+func (switcher *Switcher) cycleSteps(name string) ([]int, bool, error) {
+	sec := switcher.config.Section("")
+	rename := func(k string) string { return k }
+
+	if name != "" {
+		var err error
+		sec, err = switcher.config.GetSection(cycleSection(name))
+		if err != nil {
+			return nil, false, fmt.Errorf("no cycle named %q", name)
+		}
+		rename = func(k string) string { return cycleKeys[k] }
+	}
+
+	key := func(k string) string {
+		if !sec.HasKey(rename(k)) {
+			return ""
+		}
+		return sec.Key(rename(k)).String()
+	}
+
+	order, err := parseOrder(key("cycle_order"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Every output by default
+	if len(order) == 0 {
+		for i := 0; i < switcher.outputCount(); i++ {
+			order = append(order, strconv.Itoa(i+1))
+		}
+	}
+
+	if mute, _ := strconv.ParseBool(key("cycle_mute")); mute && !slices.Contains(order, MUTE_STEP) {
+		order = append(order, MUTE_STEP)
+	}
+
+	enabled := switcher.enabled()
+
+	var steps []int
+	for _, step := range order {
+		if step == MUTE_STEP {
+			steps = append(steps, switcher.muted())
+			continue
+		}
+
+		// Skip disabled outputs and ones the device doesn't have
+		x, _ := strconv.Atoi(step)
+		if switcher.isOutput(x-1) && enabled[x-1] == "ON" {
+			steps = append(steps, x-1)
+		}
+	}
+
+	return steps, key("cycle_mode") != "stop", nil
+}
+
+// Move step places along a cycle, "" being the default one
+func (switcher *Switcher) cycle(name string, step int, quiet bool) error {
+	steps, wrap, err := switcher.cycleSteps(name)
+	if err != nil {
+		return err
+	}
+
+	// Do nothing if all steps are disabled
+	if len(steps) == 0 {
+		return nil
+	}
+
+	x, _ := switcher.config.Section("").Key("current_output").Int()
+
+	muteIsStep := slices.Contains(steps, switcher.muted())
+	if x == switcher.muted() && !muteIsStep {
+		x = switcher.prevOutput
+	}
+
+	i := slices.Index(steps, x)
+
+	switch {
+	// Pick up from the next step in output order
+	case i < 0 && step > 0:
+		i = 0
+		for j, s := range steps {
+			if s > x && s != switcher.muted() {
+				i = j
+				break
+			}
+		}
+	case i < 0:
+		i = len(steps) - 1
+		for j := len(steps) - 1; j >= 0; j-- {
+			if steps[j] < x {
+				i = j
+				break
+			}
+		}
+	case i+step < 0 || i+step >= len(steps):
+		if !wrap {
+			return nil
+		}
+		i = (i + step + len(steps)) % len(steps)
+	default:
+		i += step
+	}
+
+	target := steps[i]
+
+	switch {
+	case target == x:
+		return nil
+	case target == switcher.muted():
+		return switcher.muteToggle(quiet)
+	case x == switcher.muted():
+		// Leaving the mute step unmutes first
+		return switcher.unmuteTo(target, quiet)
+	}
+
+	return switcher.selectOutput(target, quiet)
+}
+
+// Actions for named cycles are cycle.<name> and reverse.<name>
+func cycleAction(action string) (string, int, bool) {
+	for prefix, step := range map[string]int{"cycle.": 1, "reverse.": -1} {
+		if name := strings.TrimPrefix(action, prefix); name != action && name != "" {
+			return name, step, true
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseOrder(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"", "[]", false},
+		{"1, 3, 2", "[1 3 2]", false},
+		{" 02 ,MUTE, 1,", "[2 mute 1]", false},
+		{"1, 1", "", true},
+		{"mute, Mute", "", true},
+		{"0", "", true},
+		{fmt.Sprint(MAX_OUTPUTS + 1), "", true},
+		{"speakers", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseOrder(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != test.want {
+			t.Errorf("%q: got %v, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestCycleSteps(t *testing.T) {
+	switcher := testSwitcher(t, `outputs = 3
+enabled = ON, ON, OFF
+cycle_mute = true
+dbus = false
+
+[cycle.ab]
+order = 2, 1, mute
+mode = stop
+
+[cycle.all]
+
+[cycle.gone]
+order = 3
+`)
+	settle(switcher)
+
+	// Mute is the index after the last output
+	tests := []struct {
+		name  string
+		steps string
+		wrap  bool
+		err   bool
+	}{
+		{"", "[0 1 3]", true, false},
+		{"ab", "[1 0 3]", false, false},
+		{"AB", "[1 0 3]", false, false},
+		{"all", "[0 1]", true, false},
+		// Only a disabled output
+		{"gone", "[]", true, false},
+		{"missing", "", false, true},
+	}
+
+	for _, test := range tests {
+		steps, wrap, err := switcher.cycleSteps(test.name)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.name, err)
+			continue
+		}
+		if err == nil && (fmt.Sprint(steps) != test.steps || wrap != test.wrap) {
+			t.Errorf("%q: got %v, wrap %v, want %s, wrap %v", test.name, steps, wrap, test.steps, test.wrap)
+		}
+	}
+}
+
+func TestCycle(t *testing.T) {
+	switcher := testSwitcher(t, `outputs = 3
+current_output = 0
+cycle_order = 1, 3, mute
+dbus = false
+
+[cycle.stop]
+order = 1, 2
+mode = stop
+`)
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 3))
+
+	tests := []struct {
+		name string
+		step int
+		want int
+	}{
+		{"", 1, 2},
+		{"", 1, 3},
+		// Leaving mute unmutes first
+		{"", 1, 0},
+		{"", -1, 3},
+		{"", -1, 2},
+		// Off the cycle, so it starts over
+		{"stop", 1, 0},
+		{"stop", -1, 0},
+		{"stop", 1, 1},
+		{"stop", 1, 1},
+		// Picks up from the next output along
+		{"", 1, 2},
+	}
+
+	for i, test := range tests {
+		if err := switcher.cycle(test.name, test.step, true); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		settle(switcher)
+
+		if got, _ := switcher.config.Section("").Key("current_output").Int(); got != test.want {
+			t.Fatalf("%d: cycling %q by %d went to %d, want %d", i, test.name, test.step, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// The name, object and interface the app exports on the session bus
+const (
+	DBUS_NAME      = "org.soundbrick.Switcher"
+	DBUS_PATH      = "/org/soundbrick/Switcher"
+	DBUS_INTERFACE = "org.soundbrick.Switcher"
+)
+
+// Labels and enabled flags change through config rather than the device, so
+// they're compared this often
+const DBUS_POLL = time.Second
+
+// The methods callers see, each returning a D-Bus error on failure
+type dbusSwitcher struct {
+	switcher *Switcher
+}
+
+// Switch to an output counting from 1, 0 mutes
+func (d dbusSwitcher) Switch(output int32) *dbus.Error {
+	if output == 0 {
+		return dbusError(d.switcher.run("mute_on"))
+	}
+	return dbusError(d.switcher.selectOutput(int(output)-1, false))
+}
+
+// Mute, or unmute when muted
+func (d dbusSwitcher) Mute() *dbus.Error {
+	return dbusError(d.switcher.run("mute"))
+}
+
+func (d dbusSwitcher) Cycle() *dbus.Error {
+	return dbusError(d.switcher.run("cycle"))
+}
+
+// Every property at once, along with the profiles and the running macro
+func (d dbusSwitcher) GetState() (map[string]dbus.Variant, *dbus.Error) {
+	state := map[string]dbus.Variant{}
+	for name, value := range d.switcher.dbusProperties() {
+		state[name] = dbus.MakeVariant(value)
+	}
+
+	profiles := profileNames(d.switcher.config)
+	if profiles == nil {
+		profiles = []string{}
+	}
+	state["Profiles"] = dbus.MakeVariant(profiles)
+
+	macro, _ := d.switcher.macroStatus()
+	state["Macro"] = dbus.MakeVariant(macro)
+
+	return state, nil
+}
+
+func dbusError(err error) *dbus.Error {
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// The values of the exported properties. Outputs count from 1, 0 being
+// muted.
+func (switcher *Switcher) dbusProperties() map[string]interface{} {
+	Key := switcher.config.Section("").Key
+	cur, _ := Key("current_output").Int()
+
+	output := int32(cur + 1)
+	if cur == switcher.muted() {
+		output = 0
+	}
+
+	labels := []string{}
+	enabled := []bool{}
+	for i, state := range switcher.enabled() {
+		labels = append(labels, switcher.label(i))
+		enabled = append(enabled, state == "ON")
+	}
+
+	return map[string]interface{}{
+		"CurrentOutput": output,
+		"Muted":         cur == switcher.muted(),
+		"Online":        switcher.online.Load(),
+		"Outputs":       labels,
+		"Enabled":       enabled,
+		"Profile":       Key("profile").String(),
+	}
+}
+
+// SetMust panics when the change can't be sent, which happens when the bus
+// goes away
+func setDBusProperty(exported *prop.Properties, name string, value interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not send %s: %v", name, r)
+		}
+	}()
+
+	exported.SetMust(DBUS_INTERFACE, name, value)
+	return nil
+}
+
+// Slices are written in place when a caller sets a property, so the ones
+// kept for comparing need their own
+func dbusCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []string:
+		return append([]string{}, v...)
+	case []bool:
+		return append([]bool{}, v...)
+	}
+	return value
+}
+
+// Labels and enabled flags can be set by callers too, one for each output
+func (switcher *Switcher) setDBusLabels(c *prop.Change) *dbus.Error {
+	labels := c.Value.([]string)
+	if len(labels) != switcher.outputCount() {
+		return dbus.MakeFailedError(fmt.Errorf("expected %d labels, got %d", switcher.outputCount(), len(labels)))
+	}
+
+	for _, label := range labels {
+		if err := validLabel(label); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+
+	for i, label := range labels {
+		if label != switcher.label(i) {
+			switcher.setValue(outputKey(i), strings.TrimSpace(label))
+		}
+	}
+	return nil
+}
+
+func (switcher *Switcher) setDBusEnabled(c *prop.Change) *dbus.Error {
+	enabled := c.Value.([]bool)
+	if len(enabled) != switcher.outputCount() {
+		return dbus.MakeFailedError(fmt.Errorf("expected %d flags, got %d", switcher.outputCount(), len(enabled)))
+	}
+
+	states := make([]string, len(enabled))
+	for i, on := range enabled {
+		states[i] = map[bool]string{false: "OFF", true: "ON"}[on]
+	}
+
+	switcher.setValue("enabled", strings.Join(states, ", "))
+	return nil
+}
+
+func (switcher *Switcher) setupDBus() {
+	if !switcher.config.Section("").Key("dbus").MustBool(true) {
+		return
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		fmt.Printf("Error: D-Bus: %s\n", err.Error())
+		return
+	}
+
+	methods := dbusSwitcher{switcher}
+	if err := conn.Export(methods, DBUS_PATH, DBUS_INTERFACE); err != nil {
+		fmt.Printf("Error: D-Bus: %s\n", err.Error())
+		conn.Close()
+		return
+	}
+
+	values := switcher.dbusProperties()
+	props := prop.Map{DBUS_INTERFACE: {}}
+	for name, value := range values {
+		props[DBUS_INTERFACE][name] = &prop.Prop{Value: value, Emit: prop.EmitTrue}
+	}
+	props[DBUS_INTERFACE]["Outputs"].Writable = true
+	props[DBUS_INTERFACE]["Outputs"].Callback = switcher.setDBusLabels
+	props[DBUS_INTERFACE]["Enabled"].Writable = true
+	props[DBUS_INTERFACE]["Enabled"].Callback = switcher.setDBusEnabled
+
+	exported, err := prop.Export(conn, DBUS_PATH, props)
+	if err != nil {
+		fmt.Printf("Error: D-Bus: %s\n", err.Error())
+		conn.Close()
+		return
+	}
+
+	// Name the arguments, which busctl and d-feet show
+	argNames := map[string][]string{"Switch": {"output"}, "GetState": {"state"}}
+	node := introspect.Node{
+		Name: DBUS_PATH,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       DBUS_INTERFACE,
+				Methods:    introspect.Methods(methods),
+				Properties: exported.Introspection(DBUS_INTERFACE),
+			},
+		},
+	}
+	for _, m := range node.Interfaces[2].Methods {
+		for i, name := range argNames[m.Name] {
+			m.Args[i].Name = name
+		}
+	}
+	conn.Export(introspect.NewIntrospectable(&node), DBUS_PATH, "org.freedesktop.DBus.Introspectable")
+
+	reply, err := conn.RequestName(DBUS_NAME, dbus.NameFlagDoNotQueue)
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		err = fmt.Errorf("%s is already taken, is the app running twice?", DBUS_NAME)
+	}
+	if err != nil {
+		fmt.Printf("Error: D-Bus: %s\n", err.Error())
+		conn.Close()
+		return
+	}
+
+	// Send PropertiesChanged for whatever differs from what was last sent.
+	// That's kept here, as setting a property writes to the exported value
+	// from the bus's goroutines.
+	go func() {
+		changes := switcher.subscribe()
+		ticker := time.NewTicker(DBUS_POLL)
+		defer ticker.Stop()
+
+		sent := map[string]interface{}{}
+		for name, value := range values {
+			sent[name] = dbusCopy(value)
+		}
+
+		for {
+			select {
+			case <-changes:
+			case <-ticker.C:
+			case <-conn.Context().Done():
+				return
+			}
+
+			for name, value := range switcher.dbusProperties() {
+				if reflect.DeepEqual(sent[name], value) {
+					continue
+				}
+				if err := setDBusProperty(exported, name, value); err != nil {
+					fmt.Printf("Error: D-Bus: %s\n", err.Error())
+					return
+				}
+				sent[name] = dbusCopy(value)
+			}
+		}
+	}()
+}
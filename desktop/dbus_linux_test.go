@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// A bus of our own, so the test doesn't need a desktop session or clash with
+// a running app
+func privateBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	skipWithout(t, err)
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	err = os.WriteFile(config, []byte(fmt.Sprintf(`<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`, filepath.Join(dir, "bus"))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon didn't start: %s", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func TestDBus(t *testing.T) {
+	address := privateBus(t)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+
+	switcher := testSwitcher(t, "outputs = 2\noutput1 = Speakers\noutput2 = Headphones\ncurrent_output = 0\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 2))
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(DBUS_PATH),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+
+	// Waits for name to change to want, skipping other changes
+	changed := func(name string, want interface{}) {
+		t.Helper()
+
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case s := <-signals:
+				if len(s.Body) < 2 {
+					continue
+				}
+				values, _ := s.Body[1].(map[string]dbus.Variant)
+				if v, ok := values[name]; ok && reflect.DeepEqual(v.Value(), want) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no PropertiesChanged with %s = %v", name, want)
+			}
+		}
+	}
+
+	obj := conn.Object(DBUS_NAME, DBUS_PATH)
+
+	var state map[string]dbus.Variant
+	if err := obj.Call(DBUS_INTERFACE+".GetState", 0).Store(&state); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"CurrentOutput": int32(1),
+		"Muted":         false,
+		"Online":        false,
+		"Outputs":       []string{"Speakers", "Headphones"},
+		"Enabled":       []bool{true, true},
+		"Profiles":      []string{},
+		"Macro":         "",
+	}
+	for name, value := range want {
+		if got := state[name].Value(); !reflect.DeepEqual(got, value) {
+			t.Errorf("GetState %s = %#v, want %#v", name, got, value)
+		}
+	}
+
+	// Outputs count from 1
+	if err := obj.Call(DBUS_INTERFACE+".Switch", 0, int32(2)).Err; err != nil {
+		t.Fatal(err)
+	}
+	changed("CurrentOutput", int32(2))
+
+	if err := obj.Call(DBUS_INTERFACE+".Switch", 0, int32(3)).Err; err == nil {
+		t.Errorf("switching to an output that doesn't exist worked")
+	}
+
+	labels := []string{"Monitors", "Headphones"}
+	if err := obj.SetProperty(DBUS_INTERFACE+".Outputs", dbus.MakeVariant(labels)); err != nil {
+		t.Fatal(err)
+	}
+	changed("Outputs", labels)
+
+	// Wait for the label to reach config
+	for start := time.Now(); switcher.label(0) != "Monitors"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("label is %q, want Monitors", switcher.label(0))
+		}
+	}
+
+	if err := obj.SetProperty(DBUS_INTERFACE+".Outputs", dbus.MakeVariant([]string{"One"})); err == nil {
+		t.Errorf("setting one label for two outputs worked")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// The D-Bus service is only exported on Linux
+func (switcher *Switcher) setupDBus() {}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Kinds of change to the device
+const (
+	CHANGE_OUTPUT     = "output"
+	CHANGE_MUTE       = "mute"
+	CHANGE_UNMUTE     = "unmute"
+	CHANGE_CONNECT    = "connect"
+	CHANGE_DISCONNECT = "disconnect"
+)
+
+// Changes are buffered this much for each listener before being dropped
+const CHANGE_BUFFER = 64
+
+// A change to the device, with the output before and after it. Outputs are
+// indexes, the muted index being mute.
+type stateChange struct {
+	kind     string
+	output   int
+	previous int
+}
+
+// Listeners to changes, each with its own queue so a slow one doesn't hold
+// up the rest
+type listeners struct {
+	sync.Mutex
+	chans []chan stateChange
+}
+
+func (switcher *Switcher) subscribe() <-chan stateChange {
+	switcher.listeners.Lock()
+	defer switcher.listeners.Unlock()
+
+	ch := make(chan stateChange, CHANGE_BUFFER)
+	switcher.listeners.chans = append(switcher.listeners.chans, ch)
+	return ch
+}
+
+func (switcher *Switcher) publish(c stateChange) {
+	switcher.listeners.Lock()
+	defer switcher.listeners.Unlock()
+
+	for _, ch := range switcher.listeners.chans {
+		select {
+		case ch <- c:
+		default:
+			fmt.Printf("Error: dropped %s change, a listener is falling behind\n", c.kind)
+		}
+	}
+}
+
+// What sending a command will change, if anything
+func (switcher *Switcher) changeFor(command int) (stateChange, bool) {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	switch {
+	case command == switcher.muted() && cur == switcher.muted():
+		return stateChange{CHANGE_UNMUTE, switcher.prevOutput, cur}, true
+	case command == switcher.muted():
+		return stateChange{CHANGE_MUTE, command, cur}, true
+	case switcher.isOutput(command) && command != cur:
+		return stateChange{CHANGE_OUTPUT, command, cur}, true
+	}
+
+	return stateChange{}, false
+}
+
+// The change from one output to the next, as reported by the device
+func (switcher *Switcher) changed(prev, next int) (stateChange, bool) {
+	switch {
+	case next == prev:
+		return stateChange{}, false
+	case next == switcher.muted():
+		return stateChange{CHANGE_MUTE, next, prev}, true
+	case prev == switcher.muted():
+		return stateChange{CHANGE_UNMUTE, next, prev}, true
+	}
+	return stateChange{CHANGE_OUTPUT, next, prev}, true
+}
+
+// Outputs counting from 1, or mute
+func (switcher *Switcher) outputName(x int) string {
+	if x == switcher.muted() {
+		return MUTE_STEP
+	}
+	return strconv.Itoa(x + 1)
+}
+
+func (switcher *Switcher) outputLabel(x int) string {
+	if x == switcher.muted() {
+		return "Muted"
+	}
+	return switcher.label(x)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+var formats = []string{"json", "yaml", "ini"}
+
+// Root keys map to values, other sections to maps of their keys
+type configDoc map[string]interface{}
+
+// Insensitive configs lowercase the name of the root section too
+func isRoot(sec *ini.Section) bool {
+	return strings.EqualFold(sec.Name(), ini.DefaultSection)
+}
+
+func toDoc(cfg *ini.File) configDoc {
+	doc := configDoc{}
+
+	for _, sec := range cfg.Sections() {
+		values := map[string]string{}
+		for _, key := range sec.Keys() {
+			values[key.Name()] = key.String()
+		}
+
+		if isRoot(sec) {
+			for k, v := range values {
+				doc[k] = v
+			}
+		} else {
+			doc[sec.Name()] = values
+		}
+	}
+
+	return doc
+}
+
+func fromDoc(doc configDoc) (*ini.File, error) {
+	cfg := ini.Empty(utils.LoadOptions)
+
+	for name, value := range doc {
+		// YAML decodes sections with the type of the document
+		if values, ok := value.(configDoc); ok {
+			value = map[string]interface{}(values)
+		}
+		if values, ok := value.(map[string]interface{}); ok {
+			sec, err := cfg.NewSection(name)
+			if err != nil {
+				return nil, err
+			}
+
+			for k, v := range values {
+				s, err := scalar(v)
+				if err != nil {
+					return nil, fmt.Errorf("[%s] %s: %w", name, k, err)
+				}
+				sec.Key(k).SetValue(s)
+			}
+			continue
+		}
+
+		s, err := scalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		cfg.Section("").Key(name).SetValue(s)
+	}
+
+	return cfg, nil
+}
+
+// Lists such as enabled may be written as arrays
+func scalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ", "), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func encodeConfig(cfg *ini.File, format string) ([]byte, error) {
+	data, err := utils.Contents(cfg)
+	if err != nil || format == "ini" {
+		return data, err
+	}
+
+	// Encode what would be saved, without environment overrides
+	saved, err := utils.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(toDoc(saved), "", "  ")
+		return append(data, '\n'), err
+	case "yaml":
+		return yaml.Marshal(toDoc(saved))
+	}
+
+	return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(formats, ", "))
+}
+
+func decodeConfig(data []byte, format string) (*ini.File, error) {
+	doc := configDoc{}
+
+	switch format {
+	case "ini":
+		return utils.Parse(data)
+	case "json":
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case "yaml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(formats, ", "))
+	}
+
+	return fromDoc(doc)
+}
+
+type change struct {
+	name, old, new string
+}
+
+func (c change) String() string {
+	switch {
+	case c.old == "":
+		return fmt.Sprintf("+ %s = %s", c.name, c.new)
+	case c.new == "":
+		return fmt.Sprintf("- %s = %s", c.name, c.old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.name, c.old, c.new)
+}
+
+// Key by key differences between two configs
+func diffConfig(from, to *ini.File) []change {
+	flatten := func(cfg *ini.File) map[string]string {
+		keys := map[string]string{}
+		for _, sec := range cfg.Sections() {
+			prefix := ""
+			if !isRoot(sec) {
+				prefix = fmt.Sprintf("[%s] ", sec.Name())
+			}
+			for _, key := range sec.Keys() {
+				keys[prefix+key.Name()] = fmt.Sprintf("%q", key.String())
+			}
+		}
+		return keys
+	}
+
+	a, b := flatten(from), flatten(to)
+
+	var changes []change
+	for name, old := range a {
+		if b[name] != old {
+			changes = append(changes, change{name, old, b[name]})
+		}
+	}
+	for name, new := range b {
+		if _, ok := a[name]; !ok {
+			changes = append(changes, change{name, "", new})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].name < changes[j].name })
+
+	return changes
+}
+
+func formatOf(path string) string {
+	switch ext := strings.TrimPrefix(filepath.Ext(path), "."); ext {
+	case "yml":
+		return "yaml"
+	case "json", "yaml", "ini":
+		return ext
+	}
+	return ""
+}
+
+func configCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: soundbrick config export|import")
+	}
+
+	switch args[0] {
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	}
+
+	return fmt.Errorf("unknown config command %q", args[0])
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("config export", flag.ContinueOnError)
+	format := fs.String("format", "", "Output format: json, yaml or ini")
+	output := fs.String("o", "", "Write to a file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = formatOf(*output)
+	}
+	if *format == "" {
+		*format = "ini"
+	}
+
+	data, err := encodeConfig(loadConfig(), *format)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(*output, data, 0644)
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("config import", flag.ContinueOnError)
+	format := fs.String("format", "", "Input format: json, yaml or ini (default from extension)")
+	dryRun := fs.Bool("dry-run", false, "Show the changes without applying them")
+	merge := fs.Bool("merge", false, "Keep keys that the imported config doesn't set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: soundbrick config import [flags] <file|->")
+	}
+	path := fs.Arg(0)
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = formatOf(path)
+	}
+	if *format == "" {
+		return fmt.Errorf("can't tell the format of %s, use --format", path)
+	}
+
+	imported, err := decodeConfig(data, *format)
+	if err != nil {
+		return err
+	}
+
+	current := loadConfig()
+
+	if *merge {
+		imported = mergeConfig(current, imported)
+	}
+
+	if errs := validateConfig(imported); len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	changes := diffConfig(current, imported)
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return nil
+	}
+
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run, %d changes not applied\n", len(changes))
+		return nil
+	}
+
+	if err := utils.Save(imported); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d changes into %s\n", len(changes), utils.ConfigPath())
+	return nil
+}
+
+// Layer the keys of over on top of base
+func mergeConfig(base, over *ini.File) *ini.File {
+	var buf bytes.Buffer
+	base.WriteTo(&buf)
+	merged, _ := utils.Parse(buf.Bytes())
+
+	for _, sec := range over.Sections() {
+		for _, key := range sec.Keys() {
+			merged.Section(sec.Name()).Key(key.Name()).SetValue(key.String())
+		}
+	}
+
+	return merged
+}
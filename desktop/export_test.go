@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Exporting and importing in any format gives back the same config
+func TestExportRoundTrip(t *testing.T) {
+	cfg, err := utils.Parse([]byte("outputs = 3\nhotkey = ctrl+\\\noutput1 = Speakers = left\nenabled = 1, 3\n\n[cycle.ab]\norder = 1, 2\nhotkey = shift+f1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range formats {
+		data, err := encodeConfig(cfg, format)
+		if err != nil {
+			t.Errorf("%s: encoding: %s", format, err)
+			continue
+		}
+
+		decoded, err := decodeConfig(data, format)
+		if err != nil {
+			t.Errorf("%s: decoding: %s\n%s", format, err, data)
+			continue
+		}
+
+		if changes := diffConfig(cfg, decoded); len(changes) > 0 {
+			t.Errorf("%s: changed by the round trip: %v\n%s", format, changes, data)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		want   map[string]string
+		err    string
+	}{
+		{"json", `{"outputs": 4, "enabled": [1, 2], "dbus": true, "cycle.ab": {"order": [2, 1]}}`,
+			map[string]string{"outputs": "4", "enabled": "1, 2", "dbus": "true", "[cycle.ab] order": `2, 1`}, ""},
+		{"yaml", "outputs: 2\nhotkey: ctrl+m\ncycle.ab:\n  order: [1, 2]\n",
+			map[string]string{"outputs": "2", "hotkey": "ctrl+m", "[cycle.ab] order": "1, 2"}, ""},
+		{"json", `{"outputs": {"a": {"b": 1}}}`, nil, "[outputs] a: unsupported value"},
+		{"toml", "outputs = 2", nil, `unknown format "toml"`},
+	}
+
+	for _, test := range tests {
+		cfg, err := decodeConfig([]byte(test.data), test.format)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %s: got %v, want an error containing %q", test.format, test.data, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %s", test.format, test.data, err)
+			continue
+		}
+
+		for name, want := range test.want {
+			sec, key := "", name
+			if strings.HasPrefix(name, "[") {
+				sec, key, _ = strings.Cut(strings.TrimPrefix(name, "["), "] ")
+			}
+			if got := cfg.Section(sec).Key(key).String(); got != want {
+				t.Errorf("%s %s: %s = %q, want %q", test.format, test.data, name, got, want)
+			}
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	base, _ := utils.Parse([]byte("outputs = 2\nhotkey = ctrl+m\n\n[cycle.ab]\norder = 1, 2\n"))
+	over, _ := utils.Parse([]byte("outputs = 4\n\n[cycle.ab]\nhotkey = f1\n"))
+
+	changes := diffConfig(base, mergeConfig(base, over))
+
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{`+ [cycle.ab] hotkey = "f1"`, `~ outputs: "2" -> "4"`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got changes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The base is left alone
+	if got := base.Section("").Key("outputs").String(); got != "2" {
+		t.Errorf("base outputs = %s after merging", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// How long a window has to keep focus before rules see it
+	DEFAULT_FOCUS_DELAY = time.Second
+
+	// How long to wait before watching again once the watcher fails
+	FOCUS_RETRY = 10 * time.Second
+)
+
+// The focused window, with the classes from WM_CLASS
+type window struct {
+	classes []string
+	title   string
+}
+
+func (w window) String() string {
+	if len(w.classes) == 0 && w.title == "" {
+		return "no window"
+	}
+	return fmt.Sprintf("%s %q", strings.Join(w.classes, "/"), w.title)
+}
+
+func (w window) equal(o window) bool {
+	return w.title == o.title && slices.Equal(w.classes, o.classes)
+}
+
+// The window rules are matched against, which only changes once focus has
+// settled
+type focusState struct {
+	sync.Mutex
+	window   window
+	err      error
+	watching bool
+}
+
+func (switcher *Switcher) focusDelay() time.Duration {
+	d, err := time.ParseDuration(switcher.config.Section("").Key("focus_delay").String())
+	if err != nil {
+		return DEFAULT_FOCUS_DELAY
+	}
+	return d
+}
+
+// The focused window, starting to watch focus the first time it's asked for
+func (switcher *Switcher) focusedWindow() (window, error) {
+	switcher.focus.Lock()
+	defer switcher.focus.Unlock()
+
+	if !switcher.focus.watching {
+		switcher.focus.watching = true
+		go switcher.watchWindows()
+	}
+
+	return switcher.focus.window, switcher.focus.err
+}
+
+func (switcher *Switcher) setFocus(w window, err error) {
+	switcher.focus.Lock()
+	changed := !w.equal(switcher.focus.window) || fmt.Sprint(err) != fmt.Sprint(switcher.focus.err)
+	switcher.focus.window, switcher.focus.err = w, err
+	switcher.focus.Unlock()
+
+	// Check the rules now rather than at the next poll
+	if changed {
+		select {
+		case switcher.updated["rules"] <- "focus":
+		default:
+		}
+	}
+}
+
+// Pass on the focused window once it has kept focus for focus_delay, so
+// moving through windows doesn't switch back and forth
+func (switcher *Switcher) watchWindows() {
+	windows := make(chan window)
+	failed := make(chan error)
+
+	go func() {
+		for {
+			failed <- watchFocus(windows)
+			time.Sleep(FOCUS_RETRY)
+		}
+	}()
+
+	settleFocus(windows, failed, switcher.focusDelay, switcher.setFocus)
+}
+
+// Call set with each window that keeps focus for delay, and straight away
+// with each error
+func settleFocus(windows <-chan window, failed <-chan error, delay func() time.Duration, set func(window, error)) {
+	var pending window
+	var settled <-chan time.Time
+
+	for {
+		select {
+		case w, ok := <-windows:
+			if !ok {
+				return
+			}
+			pending = w
+			settled = time.After(delay())
+
+		case <-settled:
+			settled = nil
+			set(pending, nil)
+
+		case err := <-failed:
+			settled = nil
+			set(window{}, err)
+		}
+	}
+}
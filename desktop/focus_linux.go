@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// Report the focused window each time it or its title changes, using the
+// _NET_ACTIVE_WINDOW property EWMH window managers keep on the root window.
+// Returns once the X connection is lost.
+func watchFocus(windows chan<- window) error {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return fmt.Errorf("could not connect to X: %w", err)
+	}
+	defer conn.Close()
+
+	atom := func(name string) (xproto.Atom, error) {
+		reply, err := xproto.InternAtom(conn, false, uint16(len(name)), name).Reply()
+		if err != nil {
+			return 0, err
+		}
+		return reply.Atom, nil
+	}
+
+	var activeAtom, nameAtom xproto.Atom
+	if activeAtom, err = atom("_NET_ACTIVE_WINDOW"); err != nil {
+		return err
+	}
+	if nameAtom, err = atom("_NET_WM_NAME"); err != nil {
+		return err
+	}
+
+	property := func(win xproto.Window, prop xproto.Atom) []byte {
+		reply, err := xproto.GetProperty(conn, false, win, prop, xproto.GetPropertyTypeAny, 0, 1024).Reply()
+		if err != nil || reply.Format == 0 {
+			return nil
+		}
+		return reply.Value
+	}
+
+	root := xproto.Setup(conn).DefaultScreen(conn).Root
+
+	active := func() (xproto.Window, bool) {
+		value := property(root, activeAtom)
+		if len(value) < 4 {
+			return 0, false
+		}
+		return xproto.Window(xgb.Get32(value)), true
+	}
+
+	// WM_CLASS holds the instance and class, e.g. "Navigator\0firefox\0"
+	describe := func(win xproto.Window) window {
+		var w window
+		if win == 0 {
+			return w
+		}
+
+		for _, class := range strings.Split(string(property(win, xproto.AtomWmClass)), "\x00") {
+			if class != "" {
+				w.classes = append(w.classes, class)
+			}
+		}
+
+		title := property(win, nameAtom)
+		if title == nil {
+			title = property(win, xproto.AtomWmName)
+		}
+		w.title = string(title)
+
+		return w
+	}
+
+	listen := func(win xproto.Window, mask uint32) {
+		xproto.ChangeWindowAttributes(conn, win, xproto.CwEventMask, []uint32{mask})
+	}
+
+	focused, ok := active()
+	if !ok {
+		return fmt.Errorf("the window manager does not report the focused window (_NET_ACTIVE_WINDOW)")
+	}
+
+	listen(root, xproto.EventMaskPropertyChange)
+
+	// Titles change without focus changing, e.g. switching browser tabs
+	if focused != 0 {
+		listen(focused, xproto.EventMaskPropertyChange)
+	}
+	windows <- describe(focused)
+
+	for {
+		// X errors, e.g. from windows that closed before we read them, are
+		// ignored
+		ev, xerr := conn.WaitForEvent()
+		if ev == nil && xerr == nil {
+			return fmt.Errorf("lost the connection to X")
+		}
+
+		notify, ok := ev.(xproto.PropertyNotifyEvent)
+		if !ok {
+			continue
+		}
+
+		described := notify.Atom == nameAtom || notify.Atom == xproto.AtomWmName || notify.Atom == xproto.AtomWmClass
+
+		switch {
+		case notify.Window == root && notify.Atom == activeAtom:
+			win, _ := active()
+			if win == focused {
+				continue
+			}
+
+			if focused != 0 {
+				listen(focused, xproto.EventMaskNoEvent)
+			}
+			if win != 0 {
+				listen(win, xproto.EventMaskPropertyChange)
+			}
+			focused = win
+
+		case notify.Window != focused || !described:
+			continue
+		}
+
+		windows <- describe(focused)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// Runs against a real X server, e.g. xvfb-run go test -run Xvfb. Without a
+// window manager the test sets _NET_ACTIVE_WINDOW itself.
+func TestWatchFocusXvfb(t *testing.T) {
+	conn, err := xgb.NewConn()
+	skipWithout(t, err)
+	defer conn.Close()
+
+	atom := func(name string) xproto.Atom {
+		reply, err := xproto.InternAtom(conn, false, uint16(len(name)), name).Reply()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Atom
+	}
+	activeAtom := atom("_NET_ACTIVE_WINDOW")
+	nameAtom := atom("_NET_WM_NAME")
+	utf8Atom := atom("UTF8_STRING")
+
+	screen := xproto.Setup(conn).DefaultScreen(conn)
+
+	win, err := xproto.NewWindowId(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = xproto.CreateWindowChecked(conn, screen.RootDepth, win, screen.Root, 0, 0, 100, 100, 0,
+		xproto.WindowClassInputOutput, screen.RootVisual, 0, nil).Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setString := func(prop, typ xproto.Atom, value string) {
+		xproto.ChangePropertyChecked(conn, xproto.PropModeReplace, win, prop, typ, 8, uint32(len(value)), []byte(value)).Check()
+	}
+	setActive := func(w xproto.Window) {
+		value := make([]byte, 4)
+		xgb.Put32(value, uint32(w))
+		xproto.ChangePropertyChecked(conn, xproto.PropModeReplace, screen.Root, activeAtom, xproto.AtomWindow, 32, 1, value).Check()
+	}
+
+	setString(xproto.AtomWmClass, xproto.AtomString, "meeting\x00Zoom\x00")
+	setString(nameAtom, utf8Atom, "Zoom Meeting")
+	setActive(win)
+
+	windows := make(chan window, 10)
+	failed := make(chan error, 1)
+	go func() { failed <- watchFocus(windows) }()
+
+	next := func(want string) window {
+		t.Helper()
+		select {
+		case w := <-windows:
+			if w.title != want {
+				t.Fatalf("got %s, want title %q", w, want)
+			}
+			return w
+		case err := <-failed:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no window reported, want title %q", want)
+		}
+		return window{}
+	}
+
+	w := next("Zoom Meeting")
+	if len(w.classes) != 2 || w.classes[0] != "meeting" || w.classes[1] != "Zoom" {
+		t.Errorf("classes are %v, want [meeting Zoom]", w.classes)
+	}
+
+	// Titles are followed without focus changing
+	setString(nameAtom, utf8Atom, "Breakout room")
+	next("Breakout room")
+
+	setActive(0)
+	if w := next(""); len(w.classes) != 0 {
+		t.Errorf("got %s with nothing focused", w)
+	}
+}
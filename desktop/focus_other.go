@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func watchFocus(windows chan<- window) error {
+	return fmt.Errorf("window rules are only supported on X11")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWindowRuleMatches(t *testing.T) {
+	zoom := window{classes: []string{"zoom", "zoom"}, title: "Zoom Meeting"}
+	firefox := window{classes: []string{"Navigator", "firefox"}, title: "Weekly sync - Google Meet - Mozilla Firefox"}
+
+	tests := []struct {
+		name   string
+		rule   rule
+		window window
+		want   bool
+	}{
+		{"class", rule{windowClass: compilePattern("zoom")}, zoom, true},
+		{"class ignores case", rule{windowClass: compilePattern("FIREFOX")}, firefox, true},
+		{"either class", rule{windowClass: compilePattern("navigator")}, firefox, true},
+		{"class matches whole names", rule{windowClass: compilePattern("fire")}, firefox, false},
+		{"title anywhere", rule{windowTitle: compileTitlePattern("google meet")}, firefox, true},
+		{"class and title", rule{windowClass: compilePattern("firefox"), windowTitle: compileTitlePattern("meet")}, firefox, true},
+		{"class but not title", rule{windowClass: compilePattern("firefox"), windowTitle: compileTitlePattern("youtube")}, firefox, false},
+		{"no window", rule{windowClass: compilePattern("zoom")}, window{}, false},
+		{"no conditions", rule{}, zoom, false},
+	}
+
+	for _, test := range tests {
+		if got := test.rule.matches(snapshot{window: test.window}); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRuleHysteresis(t *testing.T) {
+	meeting := rule{name: "meeting", windowClass: compilePattern("zoom")}
+	rules := []rule{meeting}
+
+	zoom := snapshot{window: window{classes: []string{"zoom"}}}
+	other := snapshot{window: window{classes: []string{"firefox"}}}
+
+	hold := time.Second
+	start := time.Now()
+	m := newRuleMatches()
+
+	steps := []struct {
+		at      time.Duration
+		snap    snapshot
+		started bool
+		ended   bool
+	}{
+		{0, zoom, true, false},
+		{500 * time.Millisecond, other, false, false},
+		// Back before hold ran out, so the rule never ended
+		{900 * time.Millisecond, zoom, false, false},
+		{1200 * time.Millisecond, other, false, false},
+		{2100 * time.Millisecond, other, false, false},
+		{2200 * time.Millisecond, other, false, true},
+		{2300 * time.Millisecond, zoom, true, false},
+	}
+
+	for _, step := range steps {
+		started, ended := m.update(rules, step.snap, start.Add(step.at), hold)
+		if (len(started) > 0) != step.started || (len(ended) > 0) != step.ended {
+			t.Errorf("at %s: started %v, ended %v, want %v and %v", step.at, len(started) > 0, len(ended) > 0, step.started, step.ended)
+		}
+	}
+
+	// Other rules end as soon as they stop matching
+	process := rule{name: "obs", process: compilePattern("obs")}
+	m = newRuleMatches()
+	m.update([]rule{process}, snapshot{processes: []string{"obs"}}, start, hold)
+	if _, ended := m.update([]rule{process}, snapshot{}, start.Add(time.Millisecond), hold); len(ended) != 1 {
+		t.Errorf("process rule did not end straight away")
+	}
+
+	// Removed rules are forgotten
+	m.update(nil, snapshot{}, start, hold)
+	if len(m.since) != 0 || len(m.leaving) != 0 {
+		t.Errorf("removed rules were kept: %v %v", m.since, m.leaving)
+	}
+}
+
+func TestSettleFocus(t *testing.T) {
+	windows := make(chan window)
+	failed := make(chan error)
+	set := make(chan window, 10)
+	errs := make(chan error, 10)
+
+	delay := func() time.Duration { return 50 * time.Millisecond }
+	go settleFocus(windows, failed, delay, func(w window, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		set <- w
+	})
+	defer close(windows)
+
+	// Passing through windows only reports the last one
+	windows <- window{title: "one"}
+	windows <- window{title: "two"}
+	windows <- window{title: "three"}
+
+	select {
+	case w := <-set:
+		if w.title != "three" {
+			t.Errorf("got %s, want three", w)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("focus never settled")
+	}
+
+	select {
+	case w := <-set:
+		t.Errorf("unexpected %s", w)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Errors aren't delayed, and drop the pending window
+	windows <- window{title: "four"}
+	failed <- errors.New("lost X")
+
+	select {
+	case err := <-errs:
+		if err.Error() != "lost X" {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(40 * time.Millisecond):
+		t.Error("error was delayed")
+	}
+
+	select {
+	case w := <-set:
+		t.Errorf("window %s was reported after an error", w)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
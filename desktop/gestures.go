@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.design/x/hotkey"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+const (
+	DEFAULT_DOUBLE_TAP = 300
+	DEFAULT_HOLD       = 500
+
+	// A release followed this quickly by a press is key repeat, not a tap
+	REPEAT_GAP = 40 * time.Millisecond
+)
+
+func (switcher *Switcher) gestureTiming(key string, fallback int) time.Duration {
+	return time.Duration(switcher.config.Section("").Key(key).MustInt(fallback)) * time.Millisecond
+}
+
+// Run the actions of a binding as its key is pressed and released
+func (switcher *Switcher) listen(b *binding) {
+	var pushing bool
+
+	start := func(action string) {
+		if action == PUSH_TO_MUTE {
+			pushing = switcher.pushToMute(true)
+			return
+		}
+		if err := switcher.run(action); err != nil {
+			utils.Alert("Error!", err.Error(), 1)
+		}
+	}
+
+	end := func(action string) {
+		if action == PUSH_TO_MUTE && pushing {
+			switcher.pushToMute(false)
+			pushing = false
+		}
+	}
+
+	timing := gestureTiming{
+		double: switcher.gestureTiming("double_tap_ms", DEFAULT_DOUBLE_TAP),
+		hold:   switcher.gestureTiming("hold_ms", DEFAULT_HOLD),
+	}
+
+	recognize(b.actions, timing, b.hk.Keydown(), b.hk.Keyup(), b.stop, start, end)
+}
+
+type gestureTiming struct {
+	double, hold time.Duration
+}
+
+// Turn presses and releases into taps, double taps and holds, starting each
+// gesture's action and ending it once the key is released. Bindings with
+// only a tap start on press, without waiting.
+func recognize(actions map[string]string, timing gestureTiming, keydown, keyup <-chan hotkey.Event, stop <-chan bool, start, end func(action string)) {
+	tapAction, hasTap := actions["tap"]
+	_, hasDouble := actions["double"]
+	_, hasHold := actions["hold"]
+
+	simple := !hasDouble && !hasHold
+
+	var (
+		tapTimer, holdTimer, releaseTimer <-chan time.Time
+
+		down   bool
+		taps   int
+		held   bool
+		skipUp bool
+	)
+
+	tap := func() {
+		taps = 0
+		if hasTap {
+			start(tapAction)
+			end(tapAction)
+		}
+	}
+
+	release := func() {
+		holdTimer = nil
+
+		switch {
+		case simple:
+			end(tapAction)
+		case skipUp:
+			skipUp = false
+		case held:
+			end(actions["hold"])
+			held = false
+		case hasDouble && taps == 1:
+			tapTimer = time.After(timing.double)
+		default:
+			tap()
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-keydown:
+			// Key repeat sends extra presses, and on X11 a release before each
+			if down || releaseTimer != nil {
+				releaseTimer = nil
+				down = true
+				continue
+			}
+			down = true
+
+			if simple {
+				if hasTap {
+					start(tapAction)
+				}
+				continue
+			}
+
+			tapTimer = nil
+			taps++
+
+			if hasDouble && taps == 2 {
+				taps = 0
+				skipUp = true
+				start(actions["double"])
+				end(actions["double"])
+				continue
+			}
+
+			if hasHold {
+				holdTimer = time.After(timing.hold)
+			}
+
+		case <-keyup:
+			down = false
+			releaseTimer = time.After(REPEAT_GAP)
+
+		case <-releaseTimer:
+			releaseTimer = nil
+			release()
+
+		case <-holdTimer:
+			holdTimer = nil
+			taps = 0
+			held = true
+			start(actions["hold"])
+
+		case <-tapTimer:
+			tapTimer = nil
+			tap()
+		}
+	}
+}
+
+// Mute for as long as a key is held. Returns whether it muted, so releasing
+// doesn't unmute when the device was already muted.
+func (switcher *Switcher) pushToMute(mute bool) bool {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+	isMuted := cur == switcher.muted()
+
+	if mute == isMuted {
+		return false
+	}
+
+	fmt.Printf("Push to mute: %t\n", mute)
+	switcher.muteToggle(false)
+
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/hotkey"
+)
+
+func TestRecognize(t *testing.T) {
+	timing := gestureTiming{double: 150 * time.Millisecond, hold: 300 * time.Millisecond}
+
+	tapOnly := map[string]string{"tap": "cycle"}
+	all := map[string]string{"tap": "cycle", "double": "mute", "hold": PUSH_TO_MUTE}
+
+	// Presses, releases and pauses in milliseconds
+	tests := []struct {
+		name    string
+		actions map[string]string
+		keys    string
+		want    string
+	}{
+		{"tap only starts on press", tapOnly, "down", "start cycle"},
+		{"and ends on release", tapOnly, "down 10 up", "start cycle, end cycle"},
+		{"key repeat is one press", tapOnly, "down 10 up 5 down 10 up 5 down 10 up", "start cycle, end cycle"},
+		{"tap waits out a double tap", all, "down 10 up", "start cycle, end cycle"},
+		{"double tap", all, "down 10 up 70 down 10 up", "start mute, end mute"},
+		{"two slow taps", all, "down 10 up 300 down 10 up", "start cycle, end cycle, start cycle, end cycle"},
+		{"hold", all, "down 400", "start push_to_mute"},
+		{"released hold", all, "down 400 up", "start push_to_mute, end push_to_mute"},
+		{"hold after a tap", all, "down 10 up 70 down 400 up", "start mute, end mute"},
+		{"hold without a tap", map[string]string{"hold": "mute"}, "down 10 up 300 down 400 up", "start mute, end mute"},
+	}
+
+	for _, test := range tests {
+		keydown, keyup := make(chan hotkey.Event), make(chan hotkey.Event)
+		stop := make(chan bool)
+		events := make(chan string, 100)
+		done := make(chan bool)
+
+		go func() {
+			recognize(test.actions, timing, keydown, keyup, stop,
+				func(action string) { events <- "start " + action },
+				func(action string) { events <- "end " + action },
+			)
+			close(done)
+		}()
+
+		for _, key := range strings.Fields(test.keys) {
+			switch key {
+			case "down":
+				keydown <- hotkey.Event{}
+			case "up":
+				keyup <- hotkey.Event{}
+			default:
+				ms, _ := strconv.Atoi(key)
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+			}
+		}
+
+		// Long enough for any pending tap or release to run
+		time.Sleep(timing.double + REPEAT_GAP + 100*time.Millisecond)
+		close(stop)
+		<-done
+		close(events)
+
+		var got []string
+		for event := range events {
+			got = append(got, event)
+		}
+		if strings.Join(got, ", ") != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, strings.Join(got, ", "), test.want)
+		}
+	}
+}
+
+func TestParseTrigger(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"F15", "F15", false},
+		{"tap F15", "F15", false},
+		{"Hold ctrl+f15", "hold ctrl+F15", false},
+		{"double  shift+a", "double shift+a", false},
+		{"triple f1", "", true},
+		{"hold", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTrigger(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if err == nil && got.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
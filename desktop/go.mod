@@ -5,9 +5,16 @@ go 1.19
 require (
 	github.com/gen2brain/iup-go/iup v0.0.0-20220906102819-1bdd927a85b2
 	github.com/getlantern/systray v1.2.1
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/jezek/xgb v1.1.1
+	github.com/robfig/cron/v3 v3.0.0
+	github.com/teambition/rrule-go v1.8.2
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
 	golang.design/x/hotkey v0.3.0
 	golang.org/x/exp v0.0.0-20221006183845-316c7553db56
+	golang.org/x/sys v0.10.0
 	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -29,7 +36,6 @@ require (
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
 	go.uber.org/zap v1.23.0 // indirect
-	golang.org/x/sys v0.0.0-20220909162455-aba9fc2a8ff2 // indirect
 )
 
 require (
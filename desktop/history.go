@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const DEFAULT_HISTORY = 10
+
+// History is stored most recent first, counting outputs from 1 like orders
+func parseHistory(value string) ([]int, error) {
+	var history []int
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(item)
+		if err != nil || n < 1 || n > MAX_OUTPUTS {
+			return nil, fmt.Errorf("%q is not an output", item)
+		}
+		history = append(history, n-1)
+	}
+
+	return history, nil
+}
+
+func validHistory(value string) error {
+	_, err := parseHistory(value)
+	return err
+}
+
+func formatHistory(history []int) string {
+	items := make([]string, len(history))
+	for i, x := range history {
+		items[i] = strconv.Itoa(x + 1)
+	}
+	return strings.Join(items, ", ")
+}
+
+// Move x to the top, dropping the oldest outputs past size
+func pushHistory(history []int, x int, size int) []int {
+	if i := slices.Index(history, x); i >= 0 {
+		history = slices.Delete(history, i, i+1)
+	}
+
+	history = append([]int{x}, history...)
+	if len(history) > size {
+		history = history[:size]
+	}
+
+	return history
+}
+
+func (switcher *Switcher) history() []int {
+	history, _ := parseHistory(switcher.config.Section("").Key("history").String())
+	return history
+}
+
+// Record a change of output, returning the new history
+func (switcher *Switcher) recordHistory(from, to int) string {
+	size := switcher.config.Section("").Key("history_size").MustInt(DEFAULT_HISTORY)
+	history := switcher.history()
+
+	for _, x := range []int{from, to} {
+		if switcher.isOutput(x) {
+			history = pushHistory(history, x, size)
+		}
+	}
+
+	return formatHistory(history)
+}
+
+// The output used before the current one, which toggling goes back to
+func (switcher *Switcher) previousOutput() (int, bool) {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+	if cur == switcher.muted() {
+		cur = switcher.prevOutput
+	}
+
+	for _, x := range switcher.history() {
+		if x != cur && switcher.isOutput(x) {
+			return x, true
+		}
+	}
+
+	return 0, false
+}
+
+// Toggle back to the previous output, so repeating it flips between two
+func (switcher *Switcher) togglePrevious(quiet bool) error {
+	x, ok := switcher.previousOutput()
+	if !ok {
+		return fmt.Errorf("there is no previous output yet")
+	}
+	return switcher.selectOutput(x, quiet)
+}
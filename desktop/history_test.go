@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseHistory(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"", "[]", false},
+		{"3, 1, 2", "[2 0 1]", false},
+		{" 2,,1 ,", "[1 0]", false},
+		{"0", "", true},
+		{fmt.Sprint(MAX_OUTPUTS + 1), "", true},
+		{"mute", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseHistory(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != test.want {
+			t.Errorf("%q: got %v, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestFormatHistory(t *testing.T) {
+	if got := formatHistory([]int{2, 0, 1}); got != "3, 1, 2" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestPushHistory(t *testing.T) {
+	tests := []struct {
+		history []int
+		x       int
+		size    int
+		want    string
+	}{
+		{nil, 0, 3, "[0]"},
+		{[]int{1, 0}, 2, 3, "[2 1 0]"},
+		// Moved to the top rather than repeated
+		{[]int{1, 0, 2}, 2, 3, "[2 1 0]"},
+		{[]int{2, 1, 0}, 3, 3, "[3 2 1]"},
+		{[]int{2, 1, 0}, 3, 1, "[3]"},
+	}
+
+	for _, test := range tests {
+		if got := pushHistory(append([]int{}, test.history...), test.x, test.size); fmt.Sprint(got) != test.want {
+			t.Errorf("pushing %d onto %v: got %v, want %s", test.x, test.history, got, test.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 4\ncurrent_output = 0\nhistory_size = 3\nswitch_unmutes = true\ndbus = false\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 4))
+
+	steps := []struct {
+		do       func() error
+		cur      int
+		history  string
+		previous int
+	}{
+		{func() error { return switcher.selectOutput(1, true) }, 1, "2, 1", 0},
+		{func() error { return switcher.selectOutput(2, true) }, 2, "3, 2, 1", 1},
+		// Toggling flips between the last two
+		{func() error { return switcher.togglePrevious(true) }, 1, "2, 3, 1", 2},
+		{func() error { return switcher.togglePrevious(true) }, 2, "3, 2, 1", 1},
+		// Mute isn't an output, previous looks past it
+		{func() error { return switcher.muteToggle(true) }, 4, "3, 2, 1", 1},
+		{func() error { return switcher.togglePrevious(true) }, 1, "2, 3, 1", 2},
+		// Only history_size outputs are kept
+		{func() error { return switcher.selectOutput(3, true) }, 3, "4, 2, 3", 1},
+	}
+
+	for i, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		settle(switcher)
+
+		Key := switcher.config.Section("").Key
+		cur, _ := Key("current_output").Int()
+		previous, _ := switcher.previousOutput()
+		if cur != step.cur || Key("history").String() != step.history || previous != step.previous {
+			t.Errorf("%d: on %d, history %q, previous %d, want %d, %q, %d", i, cur, Key("history").String(), previous, step.cur, step.history, step.previous)
+		}
+	}
+}
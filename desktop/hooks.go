@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Hook commands are set in the [hooks] section, as pre_<change> and
+// post_<change>
+const HOOKS_SECTION = "hooks"
+
+// Connecting and disconnecting are only noticed once they happened, so
+// they have no pre-hooks
+var hooksSchema = map[string]configKey{
+	"pre_output":      {"", validCommand},
+	"post_output":     {"", validCommand},
+	"pre_mute":        {"", validCommand},
+	"post_mute":       {"", validCommand},
+	"pre_unmute":      {"", validCommand},
+	"post_unmute":     {"", validCommand},
+	"post_connect":    {"", validCommand},
+	"post_disconnect": {"", validCommand},
+	"timeout":         {"10s", validDuration},
+	"pre_timeout":     {"2s", validDuration},
+	"veto":            {"false", validBool},
+}
+
+// Commands are run by the shell, which reports what's wrong with them
+func validCommand(value string) error {
+	return nil
+}
+
+func (switcher *Switcher) hookValue(key string) string {
+	sec, err := switcher.config.GetSection(HOOKS_SECTION)
+	if err != nil || !sec.HasKey(key) {
+		return hooksSchema[key].fallback
+	}
+
+	value := sec.Key(key).String()
+	if err := hooksSchema[key].validate(value); err != nil {
+		return hooksSchema[key].fallback
+	}
+	return value
+}
+
+var errHookTimeout = errors.New("hook timed out")
+
+func hookLog(format string, a ...interface{}) {
+	writeLog("hooks.log", "Hooks", fmt.Sprintf(format, a...))
+}
+
+// Run the hook for a change and stage, logging what it prints. Hooks that
+// aren't set succeed.
+func (switcher *Switcher) runHook(stage string, c stateChange) error {
+	key := stage + "_" + c.kind
+
+	command := switcher.hookValue(key)
+	if command == "" {
+		return nil
+	}
+
+	// The change waits for pre-hooks, so they're stopped sooner
+	ctx := context.Background()
+	if stage == "pre" {
+		timeout, _ := time.ParseDuration(switcher.hookValue("pre_timeout"))
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return switcher.runShell(ctx, key, command,
+		"SOUNDBRICK_EVENT="+c.kind,
+		"SOUNDBRICK_STAGE="+stage,
+		"SOUNDBRICK_OUTPUT="+switcher.outputName(c.output),
+		"SOUNDBRICK_LABEL="+switcher.outputLabel(c.output),
+		"SOUNDBRICK_PREVIOUS="+switcher.outputName(c.previous),
+		"SOUNDBRICK_PREVIOUS_LABEL="+switcher.outputLabel(c.previous),
+	)
+}
+
+// Run a command the way hooks are, with the hook timeout, logging what it
+// prints to hooks.log under name
+func (switcher *Switcher) runShell(parent context.Context, name, command string, env ...string) error {
+	timeout, _ := time.ParseDuration(switcher.hookValue("timeout"))
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, "SOUNDBRICK_OUTPUTS="+strconv.Itoa(switcher.outputCount()))
+
+	// Output goes to a file rather than a pipe, so a timed out hook can't
+	// hold us up through children that keep the pipe open
+	out, err := os.CreateTemp("", "soundbrick-hook-")
+	if err != nil {
+		hookLog("%s could not run: %s", name, err.Error())
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	start := time.Now()
+	err = cmd.Run()
+
+	out.Seek(0, io.SeekStart)
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		hookLog("%s: %s", name, scanner.Text())
+	}
+
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		hookLog("%s timed out after %s and was stopped", name, took)
+		return errHookTimeout
+	case parent.Err() != nil:
+		hookLog("%s was cancelled after %s", name, took)
+		return parent.Err()
+	case err != nil:
+		hookLog("%s failed after %s: %s", name, took, err.Error())
+		return err
+	}
+
+	hookLog("%s finished in %s", name, took)
+	return nil
+}
+
+// Run the pre-hook for a change, returning whether the change can go ahead.
+// Failing hooks only stop it with veto set, and never by timing out.
+func (switcher *Switcher) runPreHooks(c stateChange) bool {
+	err := switcher.runHook("pre", c)
+	if err == nil || err == errHookTimeout || switcher.hookValue("veto") != "true" {
+		return true
+	}
+
+	hookLog("pre_%s stopped the %s", c.kind, c.kind)
+	utils.Alert("Stopped by hook", fmt.Sprintf("pre_%s stopped the change to %s", c.kind, switcher.outputLabel(c.output)), 1)
+	return false
+}
+
+// Run post-hooks in order as changes happen
+func (switcher *Switcher) runPostHooks() {
+	for c := range switcher.subscribe() {
+		switcher.runHook("post", c)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Failing pre-hooks only stop a change with veto set, and a hook that
+// takes too long never does
+func TestPreHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks here are sh commands")
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		veto    bool
+		allowed bool
+	}{
+		{"succeeds", "true", true, true},
+		{"fails", "exit 1", false, true},
+		{"vetoes", "exit 1", true, false},
+		{"times out", "sleep 5; exit 1", true, true},
+		{"sees the change", `[ "$SOUNDBRICK_EVENT $SOUNDBRICK_OUTPUT $SOUNDBRICK_LABEL $SOUNDBRICK_PREVIOUS $SOUNDBRICK_OUTPUTS" = "output 2 Headphones 1 2" ]`, true, true},
+	}
+
+	for _, test := range tests {
+		switcher := testSwitcher(t, fmt.Sprintf("outputs = 2\noutput2 = Headphones\ndbus = false\n\n[hooks]\npre_output = %s\npre_timeout = 200ms\nveto = %t\n", test.command, test.veto))
+		settle(switcher)
+
+		start := time.Now()
+		allowed := switcher.runPreHooks(stateChange{CHANGE_OUTPUT, 1, 0})
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.name, allowed, test.allowed)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%s: took %s", test.name, took)
+		}
+	}
+}
+
+func TestRunShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks here are sh commands")
+	}
+
+	switcher := testSwitcher(t, "outputs = 2\ndbus = false\n\n[hooks]\ntimeout = 300ms\n")
+	settle(switcher)
+
+	tests := []struct {
+		command string
+		err     error
+	}{
+		{"echo hello", nil},
+		{"sleep 5", errHookTimeout},
+		// Children holding on to the output don't hold up the hook
+		{"sleep 5 & exit 0", nil},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+		err := switcher.runShell(context.Background(), "test", test.command)
+		if err != test.err {
+			t.Errorf("%q: got %v, want %v", test.command, err, test.err)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%q: took %s", test.command, took)
+		}
+	}
+}
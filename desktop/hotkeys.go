@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.design/x/hotkey"
+	"golang.design/x/hotkey/mainthread"
+	"golang.org/x/exp/slices"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+const BINDING_PREFIX = "hotkey_"
+
+// Mutes while held and unmutes on release, only hotkeys can run it
+const PUSH_TO_MUTE = "push_to_mute"
+
+// A registered combo and the action each of its gestures runs
+type binding struct {
+	combo   combo
+	actions map[string]string
+	hk      *hotkey.Hotkey
+	stop    chan bool
+}
+
+// Bindings are hotkey (cycle) and hotkey_<action>, e.g. hotkey_mute
+func isBindingKey(key string) bool {
+	return key == "hotkey" || strings.HasPrefix(key, BINDING_PREFIX)
+}
+
+func bindingAction(key string) string {
+	if key == "hotkey" {
+		return "cycle"
+	}
+	return strings.TrimPrefix(key, BINDING_PREFIX)
+}
+
+func validBindingAction(action string) error {
+	if action == PUSH_TO_MUTE {
+		return nil
+	}
+	return validAction(action)
+}
+
+// A hotkey set in config. Root keys are named as they are, ones in a cycle
+// or macro section as <section>/<key>.
+type bindingEntry struct {
+	id, value, action string
+}
+
+func (switcher *Switcher) bindingEntries() []bindingEntry {
+	var entries []bindingEntry
+
+	for _, key := range switcher.config.Section("").Keys() {
+		if isBindingKey(key.Name()) {
+			entries = append(entries, bindingEntry{key.Name(), key.String(), bindingAction(key.Name())})
+		}
+	}
+
+	for _, name := range cycleNames(switcher.config) {
+		sec := switcher.config.Section(cycleSection(name))
+		for key, action := range map[string]string{"hotkey": "cycle." + name, "hotkey_reverse": "reverse." + name} {
+			if sec.HasKey(key) {
+				entries = append(entries, bindingEntry{sec.Name() + "/" + key, sec.Key(key).String(), action})
+			}
+		}
+	}
+
+	for _, name := range macroNames(switcher.config) {
+		sec := switcher.config.Section(macroSection(name))
+		if sec.HasKey("hotkey") {
+			entries = append(entries, bindingEntry{sec.Name() + "/hotkey", sec.Key("hotkey").String(), MACRO_PREFIX + name})
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b bindingEntry) bool { return a.id < b.id })
+
+	return entries
+}
+
+// Change a binding from the settings window and register it
+func (switcher *Switcher) setBinding(id, value string) {
+	switcher.setValue(id, value)
+	switcher.updated["new_hotkey"] <- id
+}
+
+// The other binding that already uses value, if any
+func (switcher *Switcher) hotkeyConflict(id, value string) (bindingEntry, bool) {
+	t, err := parseTrigger(value)
+	if err != nil {
+		return bindingEntry{}, false
+	}
+
+	for _, other := range switcher.bindingEntries() {
+		o, err := parseTrigger(other.value)
+		if other.id != id && err == nil && o.String() == t.String() {
+			return other, true
+		}
+	}
+
+	return bindingEntry{}, false
+}
+
+// Group the bindings by combo, since each combo can only be registered once
+func (switcher *Switcher) bindings() (map[string]*binding, []string) {
+	bindings := map[string]*binding{}
+	owners := map[string]string{}
+
+	var errs []string
+
+	for _, entry := range switcher.bindingEntries() {
+		if entry.value == "" {
+			continue
+		}
+
+		if err := validBindingAction(entry.action); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", entry.id, err.Error()))
+			continue
+		}
+
+		t, err := parseTrigger(entry.value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s (%s): %s", entry.action, entry.value, err.Error()))
+			continue
+		}
+
+		if owner, ok := owners[t.String()]; ok {
+			errs = append(errs, fmt.Sprintf("%s (%s): already used for %s", entry.action, entry.value, owner))
+			continue
+		}
+		owners[t.String()] = entry.action
+
+		b, ok := bindings[t.combo.String()]
+		if !ok {
+			b = &binding{combo: t.combo, actions: map[string]string{}}
+			bindings[t.combo.String()] = b
+		}
+		b.actions[t.gesture] = entry.action
+	}
+
+	return bindings, errs
+}
+
+// Identifies what a binding does, to tell whether it changed
+func (b *binding) String() string {
+	var parts []string
+	for _, gesture := range gestures {
+		if action, ok := b.actions[gesture]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", gesture, action))
+		}
+	}
+	return fmt.Sprintf("%s (%s)", b.combo, strings.Join(parts, ", "))
+}
+
+func (switcher *Switcher) register(b *binding) error {
+	mods, k, err := b.combo.hotkey()
+	if err != nil {
+		return err
+	}
+
+	b.hk = hotkey.New(mods, k)
+	if err := b.hk.Register(); err != nil {
+		return err
+	}
+
+	b.stop = make(chan bool)
+	go switcher.listen(b)
+
+	return nil
+}
+
+func (b *binding) unregister() {
+	close(b.stop)
+	b.hk.Unregister()
+	fmt.Printf("Hotkey %s is unregistered\n", b)
+}
+
+func (switcher *Switcher) setupHotkeys() {
+	mainthread.Init(func() {
+		registered := map[string]*binding{}
+
+		// Bindings that failed, so they aren't retried until they change
+		failed := map[string]string{}
+
+		// Errors already shown, so they aren't repeated until they change
+		reported := map[string]bool{}
+
+		// Register what changed, reporting failures together. Forcing
+		// re-registers everything.
+		update := func(force bool) {
+			bindings, errs := switcher.bindings()
+
+			for combo, b := range registered {
+				if want, ok := bindings[combo]; force || !ok || want.String() != b.String() {
+					b.unregister()
+					delete(registered, combo)
+				}
+			}
+
+			for combo, b := range bindings {
+				if _, ok := registered[combo]; ok {
+					continue
+				}
+				if !force && failed[combo] == b.String() {
+					continue
+				}
+
+				if err := switcher.register(b); err != nil {
+					fmt.Printf("Error: could not register %s: %s\n", b, err.Error())
+					errs = append(errs, fmt.Sprintf("%s: %s", b, err.Error()))
+					failed[combo] = b.String()
+					continue
+				}
+
+				delete(failed, combo)
+				registered[combo] = b
+				fmt.Printf("Hotkey %s is registered\n", b)
+			}
+
+			var fresh []string
+			for _, err := range errs {
+				if force || !reported[err] {
+					fresh = append(fresh, err)
+				}
+			}
+
+			reported = map[string]bool{}
+			for _, err := range errs {
+				reported[err] = true
+			}
+
+			if len(fresh) > 0 {
+				slices.Sort(fresh)
+				utils.Alert("Hotkey error!", "Could not register:\n"+strings.Join(fresh, "\n"), 2)
+			}
+		}
+
+		update(true)
+
+		paused := false
+
+		for {
+			select {
+			// Either a single binding changed, or "" to reload them all
+			case key := <-switcher.updated["new_hotkey"]:
+				// Everything is registered again on resume
+				if paused {
+					continue
+				}
+
+				update(key == "")
+
+			// Release every hotkey while the settings window records one
+			case v := <-switcher.updated["pause_hotkeys"]:
+				paused = v == "true"
+
+				if paused {
+					for combo, b := range registered {
+						b.unregister()
+						delete(registered, combo)
+					}
+				} else {
+					update(false)
+				}
+			}
+		}
+	})
+}
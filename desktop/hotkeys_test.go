@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBindings(t *testing.T) {
+	switcher := testSwitcher(t, `outputs = 2
+hotkey = ctrl+f9
+hotkey_mute = double ctrl+F9
+hotkey_push_to_mute = hold ctrl+f9
+hotkey_output2 = alt+2
+hotkey_reverse = Control+Alt+2
+hotkey_previous =
+hotkey_dance = f10
+hotkey_output1 = hyper+1
+hotkey_mute_off = ctrl+F9
+
+[cycle.ab]
+order = 1, 2
+hotkey = shift+f1
+
+[macro.night]
+steps = mute
+hotkey = shift+f1
+`)
+	settle(switcher)
+
+	bindings, errs := switcher.bindings()
+
+	want := map[string]string{
+		"ctrl+F9":    "ctrl+F9 (tap=cycle, double=mute, hold=push_to_mute)",
+		"alt+2":      "alt+2 (tap=output2)",
+		"ctrl+alt+2": "ctrl+alt+2 (tap=reverse)",
+		"shift+F1":   "shift+F1 (tap=cycle.ab)",
+	}
+	for combo, b := range bindings {
+		if want[combo] != b.String() {
+			t.Errorf("%s is bound as %s, want %q", combo, b, want[combo])
+		}
+	}
+	if len(bindings) != len(want) {
+		t.Errorf("got %d bindings, want %d", len(bindings), len(want))
+	}
+
+	// Each mistake is reported on its own, leaving the rest bound
+	wantErrs := []string{
+		`hotkey_dance: unknown action "dance"`,
+		`output1 (hyper+1): "hyper" is not a modifier`,
+		`mute_off (ctrl+F9): already used for cycle`,
+		`macro.night (shift+f1): already used for cycle.ab`,
+	}
+	for _, w := range wantErrs {
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err, w)
+		}
+		if !found {
+			t.Errorf("no error %q in %q", w, errs)
+		}
+	}
+	if len(errs) != len(wantErrs) {
+		t.Errorf("got errors %q, want %d", errs, len(wantErrs))
+	}
+}
+
+func TestHotkeyConflict(t *testing.T) {
+	switcher := testSwitcher(t, "hotkey = ctrl+f9\nhotkey_mute = hold ctrl+f9\n\n[cycle.ab]\norder = 1, 2\nhotkey = f10\n")
+	settle(switcher)
+
+	tests := []struct {
+		id, value string
+		owner     string
+	}{
+		{"hotkey_previous", "Control+F9", "hotkey"},
+		{"hotkey_previous", "hold ctrl+F9", "hotkey_mute"},
+		{"hotkey_previous", "double ctrl+f9", ""},
+		{"hotkey_previous", "F10", "cycle.ab/hotkey"},
+		// Not a conflict with itself
+		{"hotkey", "ctrl+f9", ""},
+		{"hotkey_previous", "hyper+f9", ""},
+	}
+
+	for _, test := range tests {
+		other, ok := switcher.hotkeyConflict(test.id, test.value)
+		if ok != (test.owner != "") || other.id != test.owner {
+			t.Errorf("%s = %s: conflicts with %q, want %q", test.id, test.value, other.id, test.owner)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teambition/rrule-go"
+
+	// Time zones for Windows, which has no zoneinfo of its own
+	_ "time/tzdata"
+)
+
+// A property such as DTSTART;TZID=Europe/Paris:20240105T090000
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// A BEGIN/END block such as VEVENT or VTIMEZONE
+type component struct {
+	name     string
+	props    []property
+	children []*component
+}
+
+func (c *component) prop(name string) (property, bool) {
+	for _, p := range c.props {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return property{}, false
+}
+
+func (c *component) all(name string) []property {
+	var props []property
+	for _, p := range c.props {
+		if p.name == name {
+			props = append(props, p)
+		}
+	}
+	return props
+}
+
+// Parse the components of an iCalendar file, unfolding long lines
+func parseICS(r io.Reader) ([]*component, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var top []*component
+	var stack []*component
+
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		switch p.name {
+		case "BEGIN":
+			c := &component{name: strings.ToUpper(p.value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, c)
+			} else {
+				top = append(top, c)
+			}
+			stack = append(stack, c)
+
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].name != strings.ToUpper(p.value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", i+1, p.value)
+			}
+			stack = stack[:len(stack)-1]
+
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.props = append(c.props, p)
+			}
+		}
+	}
+
+	return top, nil
+}
+
+func parseProperty(line string) (property, error) {
+	p := property{params: map[string]string{}}
+
+	// Parameter values can be quoted to hold ; and :
+	quoted := false
+	start := 0
+
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			continue
+		case quoted || (c != ';' && c != ':'):
+			continue
+		}
+
+		part := line[start:i]
+		if p.name == "" {
+			p.name = strings.ToUpper(part)
+		} else if key, value, ok := strings.Cut(part, "="); ok {
+			p.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+		start = i + 1
+
+		if c == ':' {
+			p.value = line[start:]
+			return p, nil
+		}
+	}
+
+	return p, fmt.Errorf("%q has no value", line)
+}
+
+var textEscapes = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeText(value string) string {
+	return textEscapes.Replace(value)
+}
+
+// Split a list such as CATEGORIES, where commas can be escaped
+func splitList(value string) []string {
+	var items []string
+
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			items = append(items, unescapeText(value[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(items, unescapeText(value[start:]))
+}
+
+// Durations such as PT1H30M, P1D or -PT15M
+func parseICSDuration(value string) (time.Duration, error) {
+	v := strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(v, "P") {
+		return 0, fmt.Errorf("%q is not a duration", value)
+	}
+
+	var d time.Duration
+	inTime := false
+	num := ""
+
+	for _, c := range v[1:] {
+		switch {
+		case c == 'T':
+			inTime = true
+			continue
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		}
+
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration", value)
+		}
+		num = ""
+
+		unit := map[rune]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'S': time.Second}[c]
+		if c == 'M' && inTime {
+			unit = time.Minute
+		}
+		if unit == 0 {
+			return 0, fmt.Errorf("%q is not a duration", value)
+		}
+
+		d += time.Duration(n) * unit
+	}
+
+	if strings.HasPrefix(value, "-") {
+		d = -d
+	}
+	return d, nil
+}
+
+// Times are expanded as wall clock times, held as UTC, and only then placed
+// in their zone. That way recurrences keep their time of day across DST.
+type zone interface {
+	// The instant a wall clock time happens at
+	instant(wall time.Time) time.Time
+	// The wall clock time at an instant
+	wall(t time.Time) time.Time
+}
+
+type locationZone struct {
+	loc *time.Location
+}
+
+func (z locationZone) instant(wall time.Time) time.Time {
+	y, m, d := wall.Date()
+	return time.Date(y, m, d, wall.Hour(), wall.Minute(), wall.Second(), 0, z.loc)
+}
+
+func (z locationZone) wall(t time.Time) time.Time {
+	t = t.In(z.loc)
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// A VTIMEZONE from the file, used for zones Go doesn't know, such as the
+// Windows names Outlook writes
+type vtimezone struct {
+	observances []observance
+}
+
+// A STANDARD or DAYLIGHT block, starting at start and repeating by rule
+type observance struct {
+	start      time.Time
+	rule       *rrule.RRule
+	offsetFrom time.Duration
+	offsetTo   time.Duration
+}
+
+func parseOffset(value string) (time.Duration, error) {
+	if len(value) != 5 && len(value) != 7 || (value[0] != '+' && value[0] != '-') {
+		return 0, fmt.Errorf("%q is not an offset", value)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if 1+2*i+2 > len(value) {
+			break
+		}
+		n, err := strconv.Atoi(value[1+2*i : 1+2*i+2])
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an offset", value)
+		}
+		d += time.Duration(n) * unit
+	}
+
+	if value[0] == '-' {
+		d = -d
+	}
+	return d, nil
+}
+
+func parseVTimezone(c *component) (*vtimezone, error) {
+	z := &vtimezone{}
+
+	for _, child := range c.children {
+		if child.name != "STANDARD" && child.name != "DAYLIGHT" {
+			continue
+		}
+
+		var o observance
+		var err error
+
+		start, _ := child.prop("DTSTART")
+		if o.start, err = parseWall(start.value); err != nil {
+			return nil, err
+		}
+
+		from, _ := child.prop("TZOFFSETFROM")
+		if o.offsetFrom, err = parseOffset(from.value); err != nil {
+			return nil, err
+		}
+
+		to, _ := child.prop("TZOFFSETTO")
+		if o.offsetTo, err = parseOffset(to.value); err != nil {
+			return nil, err
+		}
+
+		if p, ok := child.prop("RRULE"); ok {
+			// Outlook starts its rules in 1601, which is too long ago to
+			// expand from
+			start := o.start
+			if start.Year() < 1970 {
+				start = time.Date(1970, start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+			}
+
+			if o.rule, err = parseRule(p.value, start, locationZone{time.UTC}); err != nil {
+				return nil, err
+			}
+		}
+
+		z.observances = append(z.observances, o)
+	}
+
+	if len(z.observances) == 0 {
+		return nil, fmt.Errorf("no STANDARD or DAYLIGHT")
+	}
+	return z, nil
+}
+
+// The offset in effect at a wall clock time, from the observance that
+// started last
+func (z *vtimezone) offset(wall time.Time) time.Duration {
+	var latest time.Time
+	offset := z.observances[0].offsetFrom
+
+	for _, o := range z.observances {
+		onset := o.start
+		if o.rule != nil {
+			onset = o.rule.Before(wall, true)
+		}
+
+		if !onset.IsZero() && !onset.After(wall) && onset.After(latest) {
+			latest = onset
+			offset = o.offsetTo
+		}
+	}
+
+	return offset
+}
+
+func (z *vtimezone) instant(wall time.Time) time.Time {
+	return wall.Add(-z.offset(wall))
+}
+
+// The offset in effect at an instant. Onsets are wall clock times in the
+// offset they take over from, so each is moved to UTC with it first.
+func (z *vtimezone) offsetAt(t time.Time) time.Duration {
+	var latest time.Time
+	offset := z.observances[0].offsetFrom
+
+	for _, o := range z.observances {
+		onset := o.start
+		if o.rule != nil {
+			onset = o.rule.Before(t.Add(o.offsetFrom), true)
+		}
+		if onset.IsZero() {
+			continue
+		}
+
+		onset = onset.Add(-o.offsetFrom)
+		if !onset.After(t) && onset.After(latest) {
+			latest = onset
+			offset = o.offsetTo
+		}
+	}
+
+	return offset
+}
+
+func (z *vtimezone) wall(t time.Time) time.Time {
+	t = t.UTC()
+	return t.Add(z.offsetAt(t))
+}
+
+// Wall clock times as written, e.g. 20240105T090000, held as UTC
+func parseWall(value string) (time.Time, error) {
+	value = strings.TrimSuffix(value, "Z")
+
+	layout := "20060102T150405"
+	if len(value) == 8 {
+		layout = "20060102"
+	}
+
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date or time", value)
+	}
+	return t, nil
+}
+
+// An RRULE, with UNTIL moved to wall clock time like the times it limits
+func parseRule(value string, start time.Time, z zone) (*rrule.RRule, error) {
+	opt, err := rrule.StrToROptionInLocation(value, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("RRULE %q: %w", value, err)
+	}
+
+	for _, part := range strings.Split(value, ";") {
+		if key, until, _ := strings.Cut(part, "="); strings.EqualFold(key, "UNTIL") && strings.HasSuffix(until, "Z") {
+			opt.Until = z.wall(opt.Until)
+		}
+	}
+	opt.Dtstart = start
+
+	return rrule.NewRRule(*opt)
+}
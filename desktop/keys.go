@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.design/x/hotkey"
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+// Modifiers in the order they are written
+var modifierNames = []string{"ctrl", "alt", "shift", "super"}
+
+var keyAliases = map[string]string{
+	"control":   "ctrl",
+	"option":    "alt",
+	"opt":       "alt",
+	"cmd":       "super",
+	"command":   "super",
+	"win":       "super",
+	"meta":      "super",
+	"return":    "enter",
+	"esc":       "escape",
+	"del":       "delete",
+	"ins":       "insert",
+	"pgup":      "pageup",
+	"pgdn":      "pagedown",
+	"grave":     "`",
+	"backtick":  "`",
+	"minus":     "-",
+	"equal":     "=",
+	"backslash": "\\",
+	"semicolon": ";",
+	"quote":     "'",
+	"comma":     ",",
+	"period":    ".",
+	"slash":     "/",
+}
+
+// Windows virtual-key codes, which are also the JavaScript keycodes older
+// configs stored
+var vkCodes = func() map[string]int {
+	codes := map[string]int{
+		"backspace": 0x08, "tab": 0x09, "enter": 0x0D, "escape": 0x1B, "space": 0x20,
+		"pageup": 0x21, "pagedown": 0x22, "end": 0x23, "home": 0x24,
+		"left": 0x25, "up": 0x26, "right": 0x27, "down": 0x28,
+		"insert": 0x2D, "delete": 0x2E,
+		";": 0xBA, "=": 0xBB, ",": 0xBC, "-": 0xBD, ".": 0xBE, "/": 0xBF,
+		"`": 0xC0, "[": 0xDB, "\\": 0xDC, "]": 0xDD, "'": 0xDE,
+	}
+
+	for c := '0'; c <= '9'; c++ {
+		codes[string(c)] = int(c)
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		codes[string(c)] = int(c - 'a' + 'A')
+	}
+	for i := 1; i <= 24; i++ {
+		codes[fmt.Sprintf("f%d", i)] = 0x70 + i - 1
+	}
+
+	return codes
+}()
+
+// A key combination such as ctrl+shift+F9
+type combo struct {
+	mods []string
+	key  string
+}
+
+func parseCombo(value string) (combo, error) {
+	value = strings.TrimSpace(value)
+
+	// Numeric keycodes from older configs
+	if code, err := strconv.Atoi(value); err == nil {
+		for name, vk := range vkCodes {
+			if vk == code {
+				return combo{key: name}, nil
+			}
+		}
+		return combo{}, fmt.Errorf("unknown keycode %d", code)
+	}
+
+	var c combo
+
+	parts := strings.Split(value, "+")
+	for i, part := range parts {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if alias, ok := keyAliases[name]; ok {
+			name = alias
+		}
+
+		if i < len(parts)-1 {
+			if !slices.Contains(modifierNames, name) {
+				return combo{}, fmt.Errorf("%q is not a modifier", part)
+			}
+			if !slices.Contains(c.mods, name) {
+				c.mods = append(c.mods, name)
+			}
+			continue
+		}
+
+		if _, ok := vkCodes[name]; !ok {
+			return combo{}, fmt.Errorf("%q is not a key", part)
+		}
+		c.key = name
+	}
+
+	slices.SortFunc(c.mods, func(a, b string) bool {
+		return slices.Index(modifierNames, a) < slices.Index(modifierNames, b)
+	})
+
+	return c, nil
+}
+
+func (c combo) String() string {
+	key := c.key
+	if len(key) > 1 && key[0] == 'f' {
+		key = strings.ToUpper(key)
+	}
+
+	return strings.Join(append(append([]string{}, c.mods...), key), "+")
+}
+
+// How a key is pressed, tap is the default and isn't written
+var gestures = []string{"tap", "double", "hold"}
+
+// A combo and the gesture that triggers it, such as "hold F15"
+type trigger struct {
+	gesture string
+	combo
+}
+
+func parseTrigger(value string) (trigger, error) {
+	t := trigger{gesture: "tap"}
+
+	if word, rest, found := strings.Cut(strings.TrimSpace(value), " "); found && slices.Contains(gestures, strings.ToLower(word)) {
+		t.gesture = strings.ToLower(word)
+		value = rest
+	}
+
+	c, err := parseCombo(value)
+	t.combo = c
+
+	return t, err
+}
+
+func (t trigger) String() string {
+	if t.gesture == "tap" {
+		return t.combo.String()
+	}
+	return t.gesture + " " + t.combo.String()
+}
+
+// Translate to this platform's modifiers and keycode
+func (c combo) hotkey() ([]hotkey.Modifier, hotkey.Key, error) {
+	var mods []hotkey.Modifier
+	for _, name := range c.mods {
+		mod, ok := platformModifiers[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("%s is not supported on this platform", name)
+		}
+		mods = append(mods, mod)
+	}
+
+	key, ok := platformKeys()[c.key]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s can't be bound on this platform, %s", combo{key: c.key}, missingKeys)
+	}
+
+	return mods, key, nil
+}
+
+// Rewrite numeric hotkeys in every section as readable combos
+func migrateHotkeys(cfg *ini.File) bool {
+	migrated := false
+
+	for _, sec := range cfg.Sections() {
+		for _, key := range sec.Keys() {
+			if !isBindingKey(key.Name()) {
+				continue
+			}
+
+			if _, err := strconv.Atoi(key.String()); err != nil {
+				continue
+			}
+
+			c, err := parseCombo(key.String())
+			if err != nil {
+				continue
+			}
+
+			fmt.Printf("Migrated %s = %s to %s\n", key.Name(), key.String(), c)
+			key.SetValue(c.String())
+			migrated = true
+		}
+	}
+
+	return migrated
+}
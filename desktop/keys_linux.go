@@ -0,0 +1,26 @@
+package main
+
+import "golang.design/x/hotkey"
+
+var platformModifiers = map[string]hotkey.Modifier{
+	"ctrl":  hotkey.ModCtrl,
+	"alt":   hotkey.Mod1,
+	"shift": hotkey.ModShift,
+	"super": hotkey.Mod4,
+}
+
+// Function and navigation keysyms start at 0xff00, past what a Key holds
+const missingKeys = "the X11 hotkey library takes one byte keysyms, so only letters, digits, punctuation and space can be bound"
+
+// Hotkeys are registered with X11 keysyms, which only fit in a Key for the
+// Latin-1 range. That covers letters, digits and punctuation, where the
+// keysym is the character itself.
+func platformKeys() map[string]hotkey.Key {
+	keys := map[string]hotkey.Key{"space": hotkey.Key(' ')}
+	for name := range vkCodes {
+		if len(name) == 1 {
+			keys[name] = hotkey.Key(name[0])
+		}
+	}
+	return keys
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.design/x/hotkey"
+)
+
+func TestLinuxKeys(t *testing.T) {
+	tests := []struct {
+		value string
+		key   hotkey.Key
+		ok    bool
+	}{
+		{"ctrl+a", 'a', true},
+		{"\\", '\\', true},
+		{"alt+shift+9", '9', true},
+		{"super+space", ' ', true},
+		// Keysyms past one byte
+		{"ctrl+F9", 0, false},
+		{"left", 0, false},
+		{"pageup", 0, false},
+		{"enter", 0, false},
+	}
+
+	for _, test := range tests {
+		c, err := parseCombo(test.value)
+		if err != nil {
+			t.Fatalf("%q: %s", test.value, err)
+		}
+
+		_, key, err := c.hotkey()
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if test.ok && key != test.key {
+			t.Errorf("%q: got key %#x, want %#x", test.value, key, test.key)
+		}
+		// Says why rather than just failing
+		if !test.ok && !strings.Contains(err.Error(), "can't be bound on this platform") {
+			t.Errorf("%q: unclear error %q", test.value, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "golang.design/x/hotkey"
+
+var platformModifiers = map[string]hotkey.Modifier{
+	"ctrl":  hotkey.ModCtrl,
+	"alt":   hotkey.ModAlt,
+	"shift": hotkey.ModShift,
+	"super": hotkey.ModWin,
+}
+
+// Every key has a virtual-key code
+const missingKeys = ""
+
+// Hotkeys are registered with virtual-key codes
+func platformKeys() map[string]hotkey.Key {
+	keys := map[string]hotkey.Key{}
+	for name, vk := range vkCodes {
+		keys[name] = hotkey.Key(vk)
+	}
+	return keys
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Logs are rotated once they grow past this
+const LOG_SIZE = 1 << 20
+
+// Write a timestamped line to stdout and to a log next to the config
+func writeLog(name string, prefix string, message string) {
+	line := fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), message)
+	fmt.Printf("%s: %s\n", prefix, line)
+
+	path := filepath.Join(filepath.Dir(utils.ConfigPath()), name)
+	if info, err := os.Stat(path); err == nil && info.Size() > LOG_SIZE {
+		os.Rename(path, path+".1")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, line)
+}
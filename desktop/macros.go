@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Macros are [macro.<name>] sections with a list of steps to run in order
+const MACRO_PREFIX = "macro."
+
+// Stops the macro that is running, if any
+const CANCEL_MACRO = "cancel_macro"
+
+// What a failing step does to the rest of the macro
+var errorPolicies = []string{"abort", "continue"}
+
+var macroSchema = map[string]configKey{
+	"steps":    {"", validSteps},
+	"on_error": {"abort", validErrorPolicy},
+	"hotkey":   {"", validHotkey},
+	"tray":     {"true", validBool},
+}
+
+// Like cycles, macro names are case-insensitive
+func macroSection(name string) string {
+	return MACRO_PREFIX + cycleName(name)
+}
+
+func macroNames(cfg *ini.File) []string {
+	var names []string
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), MACRO_PREFIX) {
+			names = append(names, strings.TrimPrefix(sec.Name(), MACRO_PREFIX))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func validMacroName(name string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "[]=/") {
+		return fmt.Errorf("%q is not a valid macro name", name)
+	}
+	return nil
+}
+
+// Actions for macros are macro.<name>
+func macroAction(action string) (string, bool) {
+	name := strings.TrimPrefix(action, MACRO_PREFIX)
+	return name, name != action && name != ""
+}
+
+func validErrorPolicy(value string) error {
+	if !slices.Contains(errorPolicies, value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(errorPolicies, ", "))
+	}
+	return nil
+}
+
+// A step runs an action, waits or runs a command. Its policy overrides the
+// macro's on_error when set.
+type step struct {
+	text    string
+	action  string
+	wait    time.Duration
+	command string
+	policy  string
+}
+
+// Steps are separated by commas, except inside double quotes
+func splitSteps(value string) []string {
+	var parts []string
+
+	quoted := false
+	start := 0
+	for i, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, value[start:])
+
+	var steps []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			steps = append(steps, part)
+		}
+	}
+	return steps
+}
+
+// Parse a step such as "switch 2", "unmute", "wait 3s", "run "obs"" or any
+// action, optionally starting with try or must
+func parseStep(text string) (step, error) {
+	s := step{text: text}
+
+	word, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToLower(word) {
+	case "try":
+		s.policy = "continue"
+	case "must":
+		s.policy = "abort"
+	}
+	if s.policy != "" {
+		word, rest, _ = strings.Cut(rest, " ")
+		rest = strings.TrimSpace(rest)
+	}
+
+	switch word = strings.ToLower(word); word {
+	case "switch":
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 1 || n > MAX_OUTPUTS {
+			return s, fmt.Errorf("%q is not an output", rest)
+		}
+		s.action = fmt.Sprintf("output%d", n)
+
+	case "mute", "unmute":
+		if rest != "" {
+			return s, fmt.Errorf("%s takes nothing after it", word)
+		}
+		s.action = map[string]string{"mute": "mute_on", "unmute": "mute_off"}[word]
+
+	case "wait":
+		d, err := time.ParseDuration(rest)
+		if err != nil || d < 0 {
+			return s, fmt.Errorf("%q is not a duration", rest)
+		}
+		s.wait = d
+
+	case "run":
+		if len(rest) >= 2 && strings.HasPrefix(rest, `"`) && strings.HasSuffix(rest, `"`) {
+			rest = rest[1 : len(rest)-1]
+		}
+		if rest == "" {
+			return s, fmt.Errorf("run needs a command")
+		}
+		s.command = rest
+
+	default:
+		// Macros can't start or stop macros, so they can't run forever
+		if _, ok := macroAction(word); ok || word == CANCEL_MACRO {
+			return s, fmt.Errorf("macros can't run %s", word)
+		}
+		if rest != "" {
+			return s, fmt.Errorf("%q is not a step", text)
+		}
+		if err := validAction(word); err != nil {
+			return s, err
+		}
+		s.action = word
+	}
+
+	return s, nil
+}
+
+func parseSteps(value string) ([]step, error) {
+	var steps []step
+	for _, text := range splitSteps(value) {
+		s, err := parseStep(text)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+func validSteps(value string) error {
+	steps, err := parseSteps(value)
+	if err == nil && len(steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	return err
+}
+
+type macro struct {
+	name    string
+	steps   []step
+	onError string
+	tray    bool
+}
+
+func (switcher *Switcher) macro(name string) (macro, error) {
+	sec, err := switcher.config.GetSection(macroSection(name))
+	if err != nil {
+		return macro{}, fmt.Errorf("no macro named %q", name)
+	}
+
+	value := func(key string) string {
+		if sec.HasKey(key) {
+			return sec.Key(key).String()
+		}
+		return macroSchema[key].fallback
+	}
+
+	for _, key := range []string{"steps", "on_error", "tray"} {
+		if err := macroSchema[key].validate(value(key)); err != nil {
+			return macro{}, fmt.Errorf("macro %s: %s: %w", name, key, err)
+		}
+	}
+
+	m := macro{
+		name:    cycleName(name),
+		onError: value("on_error"),
+	}
+	m.steps, _ = parseSteps(value("steps"))
+	m.tray, _ = strconv.ParseBool(value("tray"))
+
+	return m, nil
+}
+
+// The macros shown in the tray
+func (switcher *Switcher) trayMacros() []string {
+	var names []string
+	for _, name := range macroNames(switcher.config) {
+		if m, err := switcher.macro(name); err == nil && m.tray {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// A macro while it runs, and how far it got
+type macroRun struct {
+	name   string
+	step   int
+	steps  []step
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Only one macro runs at a time, since their steps would fight
+type macroState struct {
+	sync.Mutex
+	run *macroRun
+
+	// Held while one macro replaces another
+	starting sync.Mutex
+}
+
+func macroLog(format string, a ...interface{}) {
+	writeLog("macros.log", "Macros", fmt.Sprintf(format, a...))
+}
+
+// What the running macro is doing, e.g. "Record: 2/4 wait 3s"
+func (switcher *Switcher) macroStatus() (string, bool) {
+	switcher.macros.Lock()
+	defer switcher.macros.Unlock()
+
+	r := switcher.macros.run
+	if r == nil || r.step == 0 {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s: %d/%d %s", r.name, r.step, len(r.steps), r.steps[r.step-1].text), true
+}
+
+// Start a macro in the background, stopping the one running first
+func (switcher *Switcher) startMacro(name string) error {
+	m, err := switcher.macro(name)
+	if err != nil {
+		return err
+	}
+
+	switcher.macros.starting.Lock()
+	defer switcher.macros.starting.Unlock()
+
+	switcher.cancelMacro()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &macroRun{name: m.name, steps: m.steps, cancel: cancel, done: make(chan struct{})}
+
+	switcher.macros.Lock()
+	switcher.macros.run = r
+	switcher.macros.Unlock()
+
+	go switcher.playMacro(ctx, r, m)
+
+	return nil
+}
+
+// Stop the running macro and wait for it, returning whether one was running
+func (switcher *Switcher) cancelMacro() bool {
+	switcher.macros.Lock()
+	r := switcher.macros.run
+	switcher.macros.Unlock()
+
+	if r == nil {
+		return false
+	}
+
+	r.cancel()
+	<-r.done
+	return true
+}
+
+func (switcher *Switcher) playMacro(ctx context.Context, r *macroRun, m macro) {
+	defer func() {
+		r.cancel()
+
+		switcher.macros.Lock()
+		switcher.macros.run = nil
+		switcher.macros.Unlock()
+
+		close(r.done)
+		switcher.refreshTray("macro")
+	}()
+
+	macroLog("%s started", m.name)
+	start := time.Now()
+
+	var failures []string
+	stopped := ""
+
+	for i, s := range m.steps {
+		if ctx.Err() != nil {
+			break
+		}
+
+		switcher.macros.Lock()
+		r.step = i + 1
+		switcher.macros.Unlock()
+		switcher.refreshTray("macro")
+
+		err := switcher.runStep(ctx, m, s)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		failure := fmt.Sprintf("step %d (%s): %s", i+1, s.text, err.Error())
+		macroLog("%s: %s", m.name, failure)
+		failures = append(failures, failure)
+
+		policy := s.policy
+		if policy == "" {
+			policy = m.onError
+		}
+		if policy == "abort" {
+			stopped = failure
+			break
+		}
+	}
+
+	took := time.Since(start).Round(time.Millisecond)
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	// One notification for the whole macro, rather than one per step
+	switch {
+	case ctx.Err() != nil:
+		macroLog("%s was cancelled at step %d after %s", m.name, r.step, took)
+		utils.Alert("Macro cancelled", fmt.Sprintf("%s stopped at step %d of %d.", m.name, r.step, len(m.steps)), 1)
+	case stopped != "":
+		macroLog("%s stopped after %s", m.name, took)
+		utils.Alert("Macro failed!", fmt.Sprintf("%s stopped at %s", m.name, stopped), 2)
+	case len(failures) > 0:
+		macroLog("%s finished with errors in %s", m.name, took)
+		utils.Alert("Macro finished with errors", fmt.Sprintf("%s: %s", m.name, strings.Join(failures, "\n")), 2)
+	default:
+		macroLog("%s finished in %s", m.name, took)
+		utils.Alert("Macro finished!", fmt.Sprintf("%s ran %d steps. Current output: %s", m.name, len(m.steps), switcher.outputLabel(cur)), 1)
+	}
+}
+
+func (switcher *Switcher) runStep(ctx context.Context, m macro, s step) error {
+	switch {
+	case s.action != "":
+		return switcher.runAction(s.action, true)
+
+	case s.command != "":
+		cur, _ := switcher.config.Section("").Key("current_output").Int()
+		return switcher.runShell(ctx, macroSection(m.name), s.command,
+			"SOUNDBRICK_MACRO="+m.name,
+			"SOUNDBRICK_OUTPUT="+switcher.outputName(cur),
+			"SOUNDBRICK_LABEL="+switcher.outputLabel(cur),
+		)
+	}
+
+	select {
+	case <-time.After(s.wait):
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSteps(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"switch 2, wait 3s, unmute", "output2 | 3s | mute_off", ""},
+		{"Mute, previous, cycle.ab", "mute_on | previous | cycle.ab", ""},
+		{`run "notify-send 'a, b'", try run obs`, "notify-send 'a, b' | obs continue", ""},
+		{"must switch 1, try mute", "output1 abort | mute_on continue", ""},
+		{" , switch 1 ,", "output1", ""},
+		{"switch 0", "", `"0" is not an output`},
+		{"mute now", "", "mute takes nothing after it"},
+		{"wait soon", "", `"soon" is not a duration`},
+		{`run ""`, "", "run needs a command"},
+		{"macro.other", "", "macros can't run macro.other"},
+		{"cancel_macro", "", "macros can't run cancel_macro"},
+		{"previous please", "", `"previous please" is not a step`},
+		{"dance", "", `unknown action "dance"`},
+	}
+
+	for _, test := range tests {
+		steps, err := parseSteps(test.value)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: got error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+			continue
+		}
+
+		var got []string
+		for _, s := range steps {
+			var parts []string
+			for _, part := range []string{s.action, s.command, s.policy} {
+				if part != "" {
+					parts = append(parts, part)
+				}
+			}
+			if s.wait > 0 {
+				parts = append(parts, s.wait.String())
+			}
+			got = append(got, strings.Join(parts, " "))
+		}
+		if strings.Join(got, " | ") != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, strings.Join(got, " | "), test.want)
+		}
+	}
+
+	if err := validSteps(" , "); err == nil {
+		t.Errorf("a macro without steps is valid")
+	}
+}
+
+// A failing step stops the macro unless on_error or the step says to carry on
+func TestMacroOnError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("steps here are sh commands")
+	}
+
+	tests := []struct {
+		onError string
+		failing string
+		ran     string
+	}{
+		{"abort", `run "exit 1"`, "1"},
+		{"continue", `run "exit 1"`, "1 3"},
+		{"abort", `try run "exit 1"`, "1 3"},
+		{"continue", `must run "exit 1"`, "1"},
+	}
+
+	for _, test := range tests {
+		log := filepath.Join(t.TempDir(), "ran")
+		steps := fmt.Sprintf(`run "echo 1 >> %s", %s, run "echo 3 >> %s"`, log, test.failing, log)
+
+		switcher := testSwitcher(t, fmt.Sprintf("outputs = 2\ndbus = false\n\n[macro.test]\nsteps = %s\non_error = %s\n", steps, test.onError))
+		settle(switcher)
+
+		m, err := switcher.macro("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := &macroRun{name: m.name, steps: m.steps, cancel: func() {}, done: make(chan struct{})}
+		switcher.playMacro(context.Background(), r, m)
+
+		data, _ := os.ReadFile(log)
+		if got := strings.Join(strings.Fields(string(data)), " "); got != test.ran {
+			t.Errorf("on_error = %s, %s: ran %q, want %q", test.onError, test.failing, got, test.ran)
+		}
+	}
+}
+
+func TestCancelMacro(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 2\ndbus = false\n\n[macro.slow]\nsteps = wait 10ms, wait 10s, wait 10s\n")
+	settle(switcher)
+
+	if err := switcher.startMacro("slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give it time to reach the long wait
+	time.Sleep(200 * time.Millisecond)
+	if status, ok := switcher.macroStatus(); !ok || status != "slow: 2/3 wait 10s" {
+		t.Errorf("status %q, %v", status, ok)
+	}
+
+	start := time.Now()
+	if !switcher.cancelMacro() {
+		t.Errorf("no macro was running")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelling took %s", took)
+	}
+
+	if _, ok := switcher.macroStatus(); ok || switcher.cancelMacro() {
+		t.Errorf("still running after cancelling")
+	}
+}
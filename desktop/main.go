@@ -1,17 +1,20 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"runtime/cgo"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/systray"
-	"golang.design/x/hotkey"
-	"golang.design/x/hotkey/mainthread"
 	"golang.org/x/exp/slices"
 	"gopkg.in/ini.v1"
 
@@ -32,51 +35,65 @@ type Switcher struct {
 	prevOutput int
 	config     *ini.File
 	updated    map[string]chan string
-	IP         *net.UDPAddr
 	settings   iup.Ihandle
-}
 
-const (
-	OUT1         = 0
-	OUT2         = 1
-	OUT3         = 2
-	OUT4         = 3
-	MUTED        = 4
-	ERROR        = -1
-	CLIENT_CHECK = -2
-)
+	// Written when config or the device changes, read from every goroutine
+	outputs       atomic.Int32
+	deviceOutputs atomic.Int32
 
-func (switcher *Switcher) cycleOutput() {
-	conf := switcher.config.Section("").Key
-	enabled := conf("enabled").Strings(",")
+	// Replies come back on a fixed port, so one command at a time. Also
+	// guards ip, which connecting and discovery change from other goroutines.
+	udp sync.Mutex
+	ip  *net.UDPAddr
 
-	// Do nothing if all inputs are disabled
-	if !slices.Contains(enabled, "ON") {
-		return
-	}
+	// Whether the device answered the last command
+	online atomic.Bool
 
-	x, _ := conf("current_output").Int()
+	listeners listeners
 
-	if x == MUTED {
-		x = switcher.prevOutput
-	}
+	// Output changes from the device, which carry whether to alert
+	switched chan switched
 
-	// Find next available input
-	for do := true; do; do = (enabled[x] != "ON") {
-		x = (x + 1) % 4
-	}
+	macros macroState
 
-	switcher.sendUDP(x)
+	midi midiState
+
+	oscClients oscClientCache
+
+	focus focusState
+
+	// Parsed calendar files by path, only used by the rules
+	calendars map[string]calendarFile
+}
+
+// An output the device switched to. Quiet ones leave the alert to the macro
+// that made them. Closing done says it's in config, so a command that
+// switches twice reads the first one back.
+type switched struct {
+	value string
+	quiet bool
+	done  chan bool
 }
 
-func (switcher *Switcher) muteToggle() {
+const (
+	ERROR        = -1
+	CLIENT_CHECK = -2
+)
+
+func (switcher *Switcher) muteToggle(quiet bool) error {
 	cur, _ := switcher.config.Section("").Key("current_output").Int()
 
-	if cur != MUTED {
+	if cur != switcher.muted() {
 		switcher.prevOutput = cur
 	}
 
-	switcher.sendUDP(MUTED)
+	if !switcher.sendUDP(switcher.muted(), quiet) {
+		if cur == switcher.muted() {
+			return fmt.Errorf("could not unmute")
+		}
+		return fmt.Errorf("could not mute")
+	}
+	return nil
 }
 
 func (switcher *Switcher) noConn() {
@@ -95,9 +112,10 @@ func (switcher *Switcher) discover() {
 
 	cidr := ipsubnet.SubnetCalculator(localAddr.IP.String(), size).GetBroadcastAddress() + SEND_PORT
 
-	switcher.IP, _ = net.ResolveUDPAddr("udp4", cidr)
+	broadcast, _ := net.ResolveUDPAddr("udp4", cidr)
+	switcher.setIP(broadcast)
 
-	switcher.sendUDP(CLIENT_CHECK)
+	switcher.sendUDP(CLIENT_CHECK, false)
 }
 
 func (switcher *Switcher) connect() {
@@ -108,100 +126,170 @@ func (switcher *Switcher) connect() {
 		return
 	}
 
-	switcher.IP, _ = net.ResolveUDPAddr("udp4", Key("ip").String()+SEND_PORT)
+	addr, _ := net.ResolveUDPAddr("udp4", Key("ip").String()+SEND_PORT)
+	switcher.setIP(addr)
 
 	x, err := Key("current_output").Int()
-	if err != nil || x == MUTED {
-		x = CLIENT_CHECK
+
+	// Client checks also tell us how many outputs the device has
+	if !switcher.sendUDP(CLIENT_CHECK, false) {
+		return
 	}
 
-	if switcher.sendUDP(x) {
-		utils.Alert("Connected!", "Successfully connected to device!", 2)
+	// Restore the last output
+	if err == nil && switcher.isOutput(x) && !switcher.sendUDP(x, false) {
+		return
 	}
+
+	utils.Alert("Connected!", "Successfully connected to device!", 2)
+}
+
+// How often the device is checked while idle, so it going away or coming
+// back is noticed without a command being sent
+const HEARTBEAT = 15 * time.Second
+
+var errNoReply = errors.New("the device did not answer")
+
+var errPortBusy = errors.New("another program on your computer is using port " + strings.TrimPrefix(REC_PORT, ":"))
+
+// A reply from the device, along with the output before the command
+type reply struct {
+	prev    int
+	result  int
+	outputs int
+
+	// Set when the device answered from another address
+	moved string
 }
 
-func (switcher *Switcher) sendUDP(command int) bool {
+// Send a command and read the reply. Replies come back on a fixed port, so
+// only one exchange runs at a time, and nothing here waits on a channel.
+func (switcher *Switcher) exchange(command int) (reply, error) {
+	switcher.udp.Lock()
+	defer switcher.udp.Unlock()
+
+	var r reply
+	r.prev, _ = switcher.config.Section("").Key("current_output").Int()
+
+	// Nowhere to send it until connecting or discovery picks an address
+	if switcher.ip == nil {
+		switcher.setOnline(false)
+		return r, errNoReply
+	}
+
 	pc, err := net.ListenPacket("udp4", REC_PORT)
 	if err != nil {
-		utils.Alert("Error!", "Another program on your computer is using port 4211!", 2)
-		panic(err)
+		return r, fmt.Errorf("%w: %s", errPortBusy, err)
 	}
 	pc.SetDeadline(time.Now().Add(time.Second))
 	defer pc.Close()
 
-	pc.WriteTo([]byte(strconv.Itoa(command)), switcher.IP)
+	pc.WriteTo([]byte(strconv.Itoa(command)), switcher.ip)
 
 	buffer := make([]byte, 512)
 	n, recAddr, err := pc.ReadFrom(buffer)
 
 	if err != nil {
-		fmt.Println(err)
+		switcher.setOnline(false)
+		return r, errNoReply
+	}
+
+	if switcher.ip.String() != recAddr.String() {
+		r.moved, _, _ = net.SplitHostPort(recAddr.String())
+		return r, nil
+	}
+
+	r.result, r.outputs, err = parseReply(string(buffer[0:n]))
+	if err != nil {
+		return r, fmt.Errorf("unexpected reply %q: %w", buffer[0:n], err)
+	}
+
+	switcher.setOnline(true)
+
+	return r, nil
+}
+
+// Where commands go, waiting for any exchange in progress
+func (switcher *Switcher) setIP(addr *net.UDPAddr) {
+	switcher.udp.Lock()
+	defer switcher.udp.Unlock()
+
+	switcher.ip = addr
+}
+
+// Check on the device in the background, which only updates whether it's
+// online. Nothing is shown when it doesn't answer or the reply port is busy,
+// that's left to commands.
+func (switcher *Switcher) runHeartbeat() {
+	for range time.Tick(HEARTBEAT) {
+		switcher.exchange(CLIENT_CHECK)
+	}
+}
+
+func (switcher *Switcher) sendUDP(command int, quiet bool) bool {
+	// Pre-hooks can stop the change
+	if c, ok := switcher.changeFor(command); ok && !switcher.runPreHooks(c) {
+		return false
+	}
+
+	r, err := switcher.exchange(command)
+	if err == errNoReply {
 		switcher.noConn()
 		return false
 	}
+	if errors.Is(err, errPortBusy) {
+		fmt.Printf("Error: %s\n", err.Error())
+		utils.Alert("Error!", "Another program on your computer is using port 4211!", 2)
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return false
+	}
 
-	if switcher.IP.String() != recAddr.String() {
-		ip, _, _ := net.SplitHostPort(recAddr.String())
-		switcher.updated["ip"] <- ip
+	if r.moved != "" {
+		switcher.updated["ip"] <- r.moved
 		switcher.save()
 		go switcher.connect()
 		return false
 	}
 
-	result, _ := strconv.Atoi(string(buffer[0:n]))
+	if r.outputs > 0 && r.outputs != int(switcher.deviceOutputs.Load()) {
+		switcher.updated["device_outputs"] <- strconv.Itoa(r.outputs)
+	}
 
-	if result == ERROR {
+	if r.result == ERROR {
 		utils.Alert("Oops!", "The system is currently muted. Please unmute to change outputs.", 1)
 		return false
 	}
 
-	switcher.updated["current_output"] <- strconv.Itoa(result)
+	done := make(chan bool)
+	switcher.switched <- switched{strconv.Itoa(r.result), quiet, done}
+	<-done
+
+	if c, ok := switcher.changed(r.prev, r.result); ok {
+		switcher.publish(c)
+	}
 
 	return true
 }
 
-func (switcher *Switcher) setupHotkeys() {
-	mainthread.Init(func() {
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			k, _ := switcher.config.Section("").Key("hotkey").Int()
-			hk := hotkey.New([]hotkey.Modifier{}, hotkey.Key(k))
-
-			defer hk.Unregister()
-			defer fmt.Printf("Hotkey %v is unregistered\n", hk)
-
-			err := hk.Register()
-			if err != nil {
-				fmt.Printf("Error: %s", err.Error())
-				return
-			}
+// Connecting and disconnecting are noticed from whether the device answers
+func (switcher *Switcher) setOnline(online bool) {
+	if switcher.online.Swap(online) == online {
+		return
+	}
 
-			for {
-				select {
-				case <-hk.Keydown():
-					switcher.cycleOutput()
-				case <-switcher.updated["new_hotkey"]:
-					hk.Unregister()
-					fmt.Printf("Hotkey %v is unregistered\n", hk)
-					defer switcher.setupHotkeys()
-					return
-				}
-			}
-		}()
-		wg.Wait()
-	})
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+	if online {
+		switcher.publish(stateChange{CHANGE_CONNECT, cur, cur})
+	} else {
+		switcher.publish(stateChange{CHANGE_DISCONNECT, cur, cur})
+	}
 }
 
 func (switcher *Switcher) save() error {
-	if utils.IsDev() {
-		return switcher.config.SaveTo("./config.ini")
-	}
-
-	dir, _ := os.UserConfigDir()
-	return switcher.config.SaveTo(fmt.Sprintf("%s/soundbrick/config.ini", dir))
+	return utils.Save(switcher.config)
 }
 
 func importConfig(switcher *Switcher) {
@@ -210,19 +298,26 @@ func importConfig(switcher *Switcher) {
 
 		update := func(key string, value string) {
 			Key(key).SetValue(value)
-			switcher.updated["refresh_tray"] <- key
+
+			// Edits apply to the active profile too
+			if name := Key("profile").String(); name != "" && isProfileKey(key) {
+				switcher.config.Section(profileSection(name)).Key(key).SetValue(value)
+			}
+
+			switcher.refreshTray(key)
 		}
 
 		notif := func(command string) {
 			value, _ := strconv.Atoi(command)
 
-			if value >= OUT1 && value <= OUT4 {
+			// Outputs past the ones shown are still real outputs on the device
+			if value >= 0 && value < switcher.muted() {
 				utils.Alert(
 					"Output Changed!",
-					fmt.Sprintf("Current output: %s", Key(fmt.Sprintf("output%d", value+1)).String()),
+					fmt.Sprintf("Current output: %s", switcher.label(value)),
 					1,
 				)
-			} else if value == MUTED {
+			} else if value == switcher.muted() {
 				utils.Alert("Muted!", "Output has been muted.", 1)
 			} else if value == CLIENT_CHECK {
 				// Client check
@@ -231,28 +326,87 @@ func importConfig(switcher *Switcher) {
 			}
 		}
 
+		// Resize everything when the output count changes
+		setOutputs := func() {
+			n := switcher.countOutputs()
+			if n == switcher.outputCount() {
+				return
+			}
+
+			switcher.outputs.Store(int32(n))
+
+			// Fill in labels for new outputs
+			for i := 0; i < n; i++ {
+				if Key(outputKey(i)).String() == "" {
+					Key(outputKey(i)).SetValue(defaultLabel(i))
+				}
+			}
+
+			switcher.refreshTray("outputs")
+		}
+
+		setCurrent := func(value string, quiet bool) {
+			cur, _ := Key("current_output").Int()
+			next, _ := strconv.Atoi(value)
+
+			history := switcher.recordHistory(cur, next)
+			changed := history != Key("history").String()
+			if changed {
+				update("history", history)
+			}
+
+			update("current_output", value)
+
+			// Write history straight away so it survives a crash or logout
+			if changed {
+				if err := switcher.save(); err != nil {
+					fmt.Printf("Error: could not save history: %s\n", err.Error())
+				}
+			}
+
+			if !quiet {
+				notif(value)
+			}
+		}
+
+		// There is a channel per config key, so wait on all of them, and on
+		// the device's output changes last
+		keys := []string{"device_outputs"}
+		for key := range configKeys {
+			keys = append(keys, key)
+		}
+
+		cases := make([]reflect.SelectCase, len(keys)+1)
+		for i, key := range keys {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(switcher.updated[key])}
+		}
+		cases[len(keys)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(switcher.switched)}
+
 		for {
-			select {
-			case v := <-switcher.updated["output1"]:
-				update("output1", v)
-			case v := <-switcher.updated["output2"]:
-				update("output2", v)
-			case v := <-switcher.updated["output3"]:
-				update("output3", v)
-			case v := <-switcher.updated["output4"]:
-				update("output4", v)
-			case v := <-switcher.updated["enabled"]:
-				update("enabled", v)
-
-			case v := <-switcher.updated["ip"]:
-				update("ip", v)
-
-			case v := <-switcher.updated["hotkey"]:
-				update("hotkey", v)
-
-			case v := <-switcher.updated["current_output"]:
-				update("current_output", v)
-				notif(v)
+			i, v, _ := reflect.Select(cases)
+
+			if i == len(keys) {
+				s := v.Interface().(switched)
+				setCurrent(s.value, s.quiet)
+				close(s.done)
+				continue
+			}
+
+			switch key, value := keys[i], v.String(); key {
+			case "device_outputs":
+				n, _ := strconv.Atoi(value)
+				switcher.deviceOutputs.Store(int32(n))
+				setOutputs()
+
+			case "outputs":
+				update(key, value)
+				setOutputs()
+
+			case "current_output":
+				setCurrent(value, false)
+
+			default:
+				update(key, value)
 			}
 		}
 	}()
@@ -261,49 +415,44 @@ func importConfig(switcher *Switcher) {
 func (switcher *Switcher) setupConfig() {
 	switcher.updated = make(map[string]chan string)
 
-	switcher.updated["output1"] = make(chan string)
-	switcher.updated["output2"] = make(chan string)
-	switcher.updated["output3"] = make(chan string)
-	switcher.updated["output4"] = make(chan string)
-	switcher.updated["enabled"] = make(chan string)
+	// One channel per config key
+	for key := range configKeys {
+		switcher.updated[key] = make(chan string)
+	}
 
-	switcher.updated["ip"] = make(chan string)
+	switcher.updated["device_outputs"] = make(chan string)
 
-	switcher.updated["hotkey"] = make(chan string)
+	switcher.switched = make(chan switched)
 
 	switcher.updated["new_hotkey"] = make(chan string)
 
-	switcher.updated["current_output"] = make(chan string)
+	switcher.updated["pause_hotkeys"] = make(chan string)
 
-	switcher.updated["refresh_tray"] = make(chan string)
+	switcher.updated["timer"] = make(chan string)
 
-	switcher.updated["mute"] = make(chan string)
+	switcher.updated["schedule"] = make(chan string)
 
-	cfg := utils.Load()
+	switcher.updated["scripts"] = make(chan string)
 
-	sec, _ := cfg.GetSection("")
+	// Redraws wait here until the tray is up, and nothing waits for them
+	switcher.updated["refresh_tray"] = make(chan string, TRAY_QUEUE)
 
-	// Keys and their default values
-	keys := map[string]string{
-		"output1":        "Output 1",
-		"output2":        "Output 2",
-		"output3":        "Output 3",
-		"output4":        "Output 4",
-		"enabled":        "ON, ON, ON, ON",
-		"current_output": "0",
-		"ip":             "",
-		"hotkey":         "220",
-	}
+	switcher.updated["mute"] = make(chan string)
 
-	for k, v := range keys {
-		if !sec.HasKey(k) {
-			sec.NewKey(k, v)
-		}
-	}
+	// Wakes the rules, which don't wait for a reader
+	switcher.updated["rules"] = make(chan string, 1)
 
-	switcher.config = cfg
+	switcher.config = loadConfig()
+
+	switcher.outputs.Store(int32(switcher.countOutputs()))
 
 	importConfig(switcher)
+
+	switcher.setupAPI()
+
+	switcher.setupOSC()
+
+	switcher.setupDBus()
 }
 
 func (switcher *Switcher) openSettings() {
@@ -314,23 +463,29 @@ func (switcher *Switcher) openSettings() {
 		LABEL = iota
 		CONNECTION
 		CONTROL
+		CYCLE
+		MIDI
 	)
 
-	conf := switcher.config.Section("").Key
-
 	darkTheme := iup.User().SetAttributes(`BGCOLOR="#282a36", FGCOLOR="#f8f8f2"`)
 	iup.SetHandle("darkTheme", darkTheme)
 	iup.SetGlobal("DEFAULTTHEME", "darkTheme")
 
 	inputAction := func(ih iup.Ihandle) int {
 		Type, _ := strconv.Atoi(ih.GetAttribute("TYPE"))
-		value := ih.GetAttribute("VALUE")
-		switcher.updated[ih.GetAttribute("TITLE")] <- strings.TrimSpace(value)
+		key := ih.GetAttribute("TITLE")
+		value := strings.TrimSpace(ih.GetAttribute("VALUE"))
+
+		changed := value != switcher.configValue(key)
 
-		if Type == CONNECTION && value != conf("ip").String() {
+		if Type == CONTROL && changed {
+			switcher.setBinding(key, value)
+		} else {
+			switcher.setValue(key, value)
+		}
+
+		if Type == CONNECTION && changed {
 			go switcher.connect()
-		} else if Type == CONTROL && value != conf("hotkey").String() {
-			switcher.updated["new_hotkey"] <- ""
 		}
 
 		return iup.DEFAULT
@@ -339,7 +494,7 @@ func (switcher *Switcher) openSettings() {
 	enabledAction := func(ih iup.Ihandle, state int) int {
 		// Update state
 		index, _ := strconv.Atoi(ih.GetAttribute("INDEX"))
-		arr := conf("enabled").Strings(",")
+		arr := switcher.enabled()
 		arr[index] = []string{"OFF", "ON"}[state]
 		switcher.updated["enabled"] <- strings.Join(arr, ", ")
 
@@ -351,21 +506,96 @@ func (switcher *Switcher) openSettings() {
 		return iup.DEFAULT
 	}
 
+	// The Record button waiting for keys, if any
+	var recorder iup.Ihandle
+
+	stopRecording := func(ih iup.Ihandle) {
+		if ih.GetAttribute("RECORDING") != "YES" {
+			return
+		}
+
+		recorder = 0
+		ih.SetAttribute("RECORDING", "NO")
+		ih.SetAttribute("TITLE", "Record")
+		switcher.updated["pause_hotkeys"] <- "false"
+	}
+
+	recordAction := func(ih iup.Ihandle) int {
+		if ih.GetAttribute("RECORDING") == "YES" {
+			stopRecording(ih)
+			return iup.DEFAULT
+		}
+
+		switcher.updated["pause_hotkeys"] <- "true"
+		recorder = ih
+		ih.SetAttribute("RECORDING", "YES")
+		ih.SetAttribute("TITLE", "Press keys...")
+		iup.SetFocus(ih)
+
+		return iup.DEFAULT
+	}
+
+	// Bind the next combination pressed, Escape cancels
+	recordKey := func(ih iup.Ihandle, code int) int {
+		if ih.GetAttribute("RECORDING") != "YES" {
+			return iup.DEFAULT
+		}
+
+		if code == iup.K_ESC {
+			stopRecording(ih)
+			return iup.IGNORE
+		}
+
+		c, ok := iupCombo(code)
+		if !ok {
+			return iup.IGNORE
+		}
+
+		// Keep the gesture the binding had
+		key := ih.GetAttribute("KEY")
+		t, _ := parseTrigger(switcher.configValue(key))
+		t.combo = c
+		value := t.String()
+
+		other, conflict := switcher.hotkeyConflict(key, value)
+		if conflict {
+			msg := fmt.Sprintf("%s is already used for %s.", value, other.action)
+			if iup.Alarm("Hotkey conflict", msg, "Replace", "Cancel", "") != 1 {
+				stopRecording(ih)
+				return iup.IGNORE
+			}
+
+			if input := iup.GetHandle("input_" + other.id); input != 0 {
+				input.SetAttribute("VALUE", "")
+			}
+		}
+
+		iup.GetHandle("input_"+key).SetAttribute("VALUE", value)
+
+		stopRecording(ih)
+
+		if conflict {
+			switcher.setBinding(other.id, "")
+		}
+		switcher.setBinding(key, value)
+
+		return iup.IGNORE
+	}
+
 	inputGen := func(label string, Type int, confKey string) iup.Ihandle {
 		input := iup.Text()
 		input.SetAttributes(`CANFOCUS=NO, EXPAND="HORIZONTAL", PADDING=3, FGCOLOR="#D8D8D8"`)
 		input.SetAttribute("TITLE", confKey)
 		input.SetAttribute("TYPE", Type)
-		input.SetAttribute("VALUE", conf(confKey).String())
+		input.SetAttribute("VALUE", switcher.configValue(confKey))
 		input.SetCallback("KILLFOCUS_CB", iup.KillFocusFunc(inputAction))
 
 		var custom iup.Ihandle
 
 		switch Type {
 		case LABEL:
-			index, _ := strconv.Atoi(label[len(label)-1:])
-			index--
-			isEnabled := conf("enabled").Strings(",")[index]
+			index, _ := labelIndex(confKey)
+			isEnabled := switcher.enabled()[index]
 
 			toggle := iup.Toggle("").SetAttribute("VALUE", isEnabled)
 			toggle.SetAttribute("INDEX", index)
@@ -393,10 +623,72 @@ func (switcher *Switcher) openSettings() {
 				return iup.DEFAULT
 			}))
 		case CONTROL:
-			custom = iup.FlatButton("Find keycodes")
+			input.SetHandle("input_" + confKey)
+
+			custom = iup.FlatButton("Record")
+			custom.SetAttributes(`PADDING=5, BGCOLOR="#50fa7b", FGCOLOR="#000000", HLCOLOR="#48d06d", PSCOLOR, BORDERWIDTH=0, FOCUSFEEDBACK="NO", EXPAND="VERTICAL", CANFOCUS=YES`)
+			custom.SetAttribute("KEY", confKey)
+			custom.SetCallback("FLAT_ACTION", iup.FlatActionFunc(recordAction))
+			custom.SetCallback("K_ANY", iup.KAnyFunc(recordKey))
+			custom.SetCallback("KILLFOCUS_CB", iup.KillFocusFunc(func(ih iup.Ihandle) int {
+				stopRecording(ih)
+				return iup.DEFAULT
+			}))
+		case CYCLE:
+			// The default cycle's options are root keys, a named one's are in its section
+			option := func(name string) string {
+				if sec, _, found := strings.Cut(confKey, "/"); found {
+					return sec + "/" + name
+				}
+				return "cycle_" + name
+			}
+
+			mute, _ := strconv.ParseBool(switcher.configValue(option("mute")))
+			muteToggle := iup.Toggle("Mute step").SetAttribute("VALUE", map[bool]string{false: "OFF", true: "ON"}[mute])
+			muteToggle.SetAttribute("KEY", option("mute"))
+			muteToggle.SetCallback("ACTION", iup.ToggleActionFunc(func(ih iup.Ihandle, state int) int {
+				switcher.setValue(ih.GetAttribute("KEY"), strconv.FormatBool(state == 1))
+				return iup.DEFAULT
+			}))
+
+			stop := switcher.configValue(option("mode")) == "stop"
+			stopToggle := iup.Toggle("Stop at ends").SetAttribute("VALUE", map[bool]string{false: "OFF", true: "ON"}[stop])
+			stopToggle.SetAttribute("KEY", option("mode"))
+			stopToggle.SetCallback("ACTION", iup.ToggleActionFunc(func(ih iup.Ihandle, state int) int {
+				switcher.setValue(ih.GetAttribute("KEY"), cycleModes[state])
+				return iup.DEFAULT
+			}))
+
+			custom = iup.Hbox(muteToggle, stopToggle)
+		case MIDI:
+			input.SetHandle("input_" + confKey)
+
+			// The next pad pressed arrives from the MIDI goroutine as a message
+			custom = iup.FlatButton("Learn")
 			custom.SetAttributes(`PADDING=5, BGCOLOR="#50fa7b", FGCOLOR="#000000", HLCOLOR="#48d06d", PSCOLOR, BORDERWIDTH=0, FOCUSFEEDBACK="NO", EXPAND="VERTICAL"`)
+			custom.SetAttribute("KEY", confKey)
 			custom.SetCallback("FLAT_ACTION", iup.FlatActionFunc(func(ih iup.Ihandle) int {
-				utils.OpenLink("https://www.toptal.com/developers/keycode")
+				if ih.GetAttribute("LEARNING") == "YES" {
+					switcher.learnMIDI(nil)
+					ih.SetAttribute("LEARNING", "NO")
+					ih.SetAttribute("TITLE", "Learn")
+					return iup.DEFAULT
+				}
+
+				ih.SetAttribute("LEARNING", "YES")
+				ih.SetAttribute("TITLE", "Play a pad...")
+				switcher.learnMIDI(func(trigger string) {
+					iup.PostMessage(ih, trigger, 0, 0, 0)
+				})
+				return iup.DEFAULT
+			}))
+			custom.SetCallback("POSTMESSAGE_CB", iup.PostMessageFunc(func(ih iup.Ihandle, trigger string, i int, d float64, p *cgo.Handle) int {
+				key := ih.GetAttribute("KEY")
+				iup.GetHandle("input_"+key).SetAttribute("VALUE", trigger)
+				switcher.setValue(key, trigger)
+
+				ih.SetAttribute("LEARNING", "NO")
+				ih.SetAttribute("TITLE", "Learn")
 				return iup.DEFAULT
 			}))
 		}
@@ -418,21 +710,97 @@ func (switcher *Switcher) openSettings() {
 		).SetAttribute("TITLE", title)
 	}
 
-	labelsFrame := frameGen("Labels",
-		inputGen("Output 1", LABEL, "output1"),
-		inputGen("Output 2", LABEL, "output2"),
-		inputGen("Output 3", LABEL, "output3"),
-		inputGen("Output 4", LABEL, "output4"),
-	)
+	labels := make([]iup.Ihandle, switcher.outputCount())
+	for i := range labels {
+		labels[i] = inputGen(fmt.Sprintf("Output %d", i+1), LABEL, outputKey(i))
+	}
+
+	labelsFrame := frameGen("Labels", labels...)
 
 	connectionFrame := frameGen("Connection",
 		inputGen("IP Address", CONNECTION, "ip"),
 	)
 
 	controlsFrame := frameGen("Controls",
-		inputGen("Hotkey", CONTROL, "hotkey"),
+		inputGen("Cycle", CONTROL, "hotkey"),
+		inputGen("Reverse", CONTROL, "hotkey_reverse"),
+		inputGen("Mute", CONTROL, "hotkey_mute"),
+		inputGen("Previous", CONTROL, "hotkey_previous"),
+		inputGen("Push to mute", CONTROL, "hotkey_push_to_mute"),
 	)
 
+	cycles := []iup.Ihandle{
+		inputGen("Order", CYCLE, "cycle_order"),
+	}
+	for _, name := range cycleNames(switcher.config) {
+		cycles = append(cycles,
+			inputGen(name, CYCLE, cycleSection(name)+"/order"),
+			inputGen(name+" hotkey", CONTROL, cycleSection(name)+"/hotkey"),
+		)
+	}
+
+	newCycle := iup.FlatButton("New Cycle")
+	newCycle.SetAttributes(`PADDING=5, BGCOLOR="#50fa7b", FGCOLOR="#000000", HLCOLOR="#48d06d", PSCOLOR, BORDERWIDTH=0, FOCUSFEEDBACK="NO"`)
+	newCycle.SetCallback("FLAT_ACTION", iup.FlatActionFunc(func(ih iup.Ihandle) int {
+		name := iup.GetText("Cycle name", "")
+		if name == "" {
+			return iup.DEFAULT
+		}
+		if err := validCycleName(name); err != nil {
+			iup.Message("Error!", err.Error())
+			return iup.DEFAULT
+		}
+
+		switcher.setValue(cycleSection(name)+"/order", "1, 2")
+		switcher.openSettings()
+		return iup.DEFAULT
+	}))
+
+	cyclesFrame := frameGen("Cycling", append(cycles, newCycle)...)
+
+	selects := make([]iup.Ihandle, switcher.outputCount())
+	for i := range selects {
+		selects[i] = inputGen(fmt.Sprintf("Output %d", i+1), CONTROL, BINDING_PREFIX+outputKey(i))
+	}
+
+	selectFrame := frameGen("Select Hotkeys", selects...)
+
+	var mappings []iup.Ihandle
+	for _, name := range midiNames(switcher.config) {
+		action := switcher.configValue(midiSection(name) + "/action")
+		mappings = append(mappings, inputGen(fmt.Sprintf("%s (%s)", name, action), MIDI, midiSection(name)+"/trigger"))
+	}
+
+	newMapping := iup.FlatButton("New MIDI Mapping")
+	newMapping.SetAttributes(`PADDING=5, BGCOLOR="#50fa7b", FGCOLOR="#000000", HLCOLOR="#48d06d", PSCOLOR, BORDERWIDTH=0, FOCUSFEEDBACK="NO"`)
+	newMapping.SetCallback("FLAT_ACTION", iup.FlatActionFunc(func(ih iup.Ihandle) int {
+		name := iup.GetText("Mapping name", "")
+		if name == "" {
+			return iup.DEFAULT
+		}
+		if err := validCycleName(name); err != nil {
+			iup.Message("Error!", err.Error())
+			return iup.DEFAULT
+		}
+
+		action := strings.TrimSpace(iup.GetText("Action, e.g. output1 or mute", ""))
+		if err := validMIDIAction(action); err != nil {
+			iup.Message("Error!", err.Error())
+			return iup.DEFAULT
+		}
+
+		switcher.setValue(midiSection(name)+"/action", action)
+		switcher.openSettings()
+		return iup.DEFAULT
+	}))
+
+	midiFrame := frameGen("MIDI", append(mappings, newMapping)...)
+
+	var macroHotkeys []iup.Ihandle
+	for _, name := range macroNames(switcher.config) {
+		macroHotkeys = append(macroHotkeys, inputGen(name, CONTROL, macroSection(name)+"/hotkey"))
+	}
+
 	title := iup.Label("Sound Brick").SetAttributes(`FONTSIZE=24, FGCOLOR="#bd93f9"`)
 
 	mainContainer := iup.Vbox(
@@ -440,15 +808,44 @@ func (switcher *Switcher) openSettings() {
 		labelsFrame,
 		connectionFrame,
 		controlsFrame,
+		cyclesFrame,
+		selectFrame,
+		midiFrame,
 	).SetAttributes(`ALIGNMENT=ALEFT, NMARGIN=15x10, NGAP=10`)
 
+	if len(macroHotkeys) > 0 {
+		iup.Append(mainContainer, frameGen("Macro Hotkeys", macroHotkeys...))
+	}
+
 	content := iup.Dialog(mainContainer).SetAttribute("TITLE", title.GetAttribute("TITLE"))
+
+	// Closing the window mid-recording would leave the hotkeys paused
+	resumeHotkeys := func(ih iup.Ihandle) int {
+		if recorder != 0 {
+			stopRecording(recorder)
+		}
+		return iup.DEFAULT
+	}
+	content.SetCallback("CLOSE_CB", iup.CloseFunc(resumeHotkeys))
+	content.SetCallback("DESTROY_CB", iup.DestroyFunc(resumeHotkeys))
 	iup.Show(content)
 	iup.Hide(switcher.settings)
 	switcher.settings = content
 	iup.MainLoop()
 }
 
+// How many tray redraws can be waiting, past which they're dropped
+const TRAY_QUEUE = 64
+
+// Ask the tray to redraw what depends on key. This never blocks, as the tray
+// isn't running yet while connecting, and its own clicks send changes too.
+func (switcher *Switcher) refreshTray(key string) {
+	select {
+	case switcher.updated["refresh_tray"] <- key:
+	default:
+	}
+}
+
 func (switcher *Switcher) setupTray() {
 	go systray.Run(func() {
 		systray.SetIcon(icon.Data)
@@ -460,23 +857,31 @@ func (switcher *Switcher) setupTray() {
 		systray.AddMenuItem(title, title)
 		systray.AddSeparator()
 		mSelect := systray.AddMenuItem("Select Output", "Select output")
+		mProfiles := systray.AddMenuItem("Profiles", "Switch profile")
+		mPrevious := systray.AddMenuItem("Previous Output", "Go back to the previous output")
+		mTimer := systray.AddMenuItem("Timer", "Timed switch")
+		mTimerStatus := mTimer.AddSubMenuItem("", "Time left")
+		mTimerStatus.Disable()
+		mTimerExtend := mTimer.AddSubMenuItem("Extend", "Extend the timed switch")
+		mTimerCancel := mTimer.AddSubMenuItem("Cancel", "Cancel the timed switch")
+		mSchedule := systray.AddMenuItem("", "Next scheduled action")
+		mSchedule.Disable()
+		mMacros := systray.AddMenuItem("Macros", "Run a macro")
+		mMacroCancel := mMacros.AddSubMenuItem("Cancel", "Stop the running macro")
 		mMute := systray.AddMenuItem("Mute", "Mute devices")
 		mSettings := systray.AddMenuItem("Settings", "Open settings")
 		mReload := systray.AddMenuItem("Reload Connection", "Reload connection")
+		mScripts := systray.AddMenuItem("Reload Scripts", "Load the scripts again")
 		mQuit := systray.AddMenuItem("Quit", "Quit")
 
-		outs := [4]*systray.MenuItem{}
-		for i := range outs {
-			str := switcher.config.Section("").Key(fmt.Sprintf("output%d", i+1)).String()
-			outs[i] = mSelect.AddSubMenuItem(str, str)
-		}
+		outs := []*systray.MenuItem{}
 
 		// Add check icon to selected input
 		setChecks := func(item int) {
 			for _, v := range outs {
 				v.SetIcon(blank.Data)
 			}
-			if item >= OUT1 && item <= OUT4 {
+			if switcher.isOutput(item) && item < len(outs) {
 				outs[item].SetIcon(check.Data)
 			}
 		}
@@ -495,49 +900,227 @@ func (switcher *Switcher) setupTray() {
 			return x
 		}
 
-		setChecks(cur())
+		// The output count can change once the device reports it
+		setOutputs := func() {
+			for i := len(outs); i < switcher.outputCount(); i++ {
+				str := switcher.label(i)
+				item := mSelect.AddSubMenuItem(str, str)
+				outs = append(outs, item)
+
+				go func(i int) {
+					for range item.ClickedCh {
+						switcher.selectOutput(i, false)
+					}
+				}(i)
+			}
+
+			for i, item := range outs {
+				if i < switcher.outputCount() {
+					item.SetTitle(switcher.label(i))
+					item.Show()
+				} else {
+					item.Hide()
+				}
+			}
+
+			setChecks(cur())
+		}
+
+		setOutputs()
+
+		// Profiles can be added while running, so each item gets its own listener
+		profiles := map[string]*systray.MenuItem{}
+		setProfiles := func() {
+			names := profileNames(switcher.config)
+			active := key("profile").String()
+
+			for _, name := range names {
+				item, ok := profiles[name]
+				if !ok {
+					item = mProfiles.AddSubMenuItem(name, fmt.Sprintf("Switch to %s", name))
+					profiles[name] = item
+
+					go func(name string) {
+						for range item.ClickedCh {
+							if err := switcher.useProfile(name); err != nil {
+								utils.Alert("Error!", err.Error(), 2)
+							}
+						}
+					}(name)
+				}
+
+				item.Show()
+				item.SetIcon(blank.Data)
+				if name == active {
+					item.SetIcon(check.Data)
+				}
+			}
+
+			for name, item := range profiles {
+				if !slices.Contains(names, name) {
+					item.Hide()
+				}
+			}
+
+			if len(names) == 0 {
+				mProfiles.Hide()
+			} else {
+				mProfiles.Show()
+			}
+		}
+
+		setProfiles()
+
+		setTimer := func() {
+			status, ok := switcher.timerStatus()
+			if !ok {
+				mTimer.Hide()
+				return
+			}
+
+			mTimer.SetTitle(status)
+			mTimerStatus.SetTitle(status)
+			mTimerExtend.SetTitle(fmt.Sprintf("Extend by %s", shortDuration(switcher.extendBy())))
+			mTimer.Show()
+		}
+
+		setTimer()
+
+		setPrevious := func() {
+			x, ok := switcher.previousOutput()
+			if !ok {
+				mPrevious.Hide()
+				return
+			}
+
+			mPrevious.SetTitle(fmt.Sprintf("Back to %s", switcher.label(x)))
+			mPrevious.Show()
+		}
+
+		setPrevious()
+
+		setSchedule := func() {
+			status, ok := switcher.scheduleStatus()
+			if !ok {
+				mSchedule.Hide()
+				return
+			}
+
+			mSchedule.SetTitle(status)
+			mSchedule.Show()
+		}
+
+		setSchedule()
+
+		// Macros can be added while running, so each item gets its own listener
+		macros := map[string]*systray.MenuItem{}
+		setMacros := func() {
+			names := switcher.trayMacros()
+
+			for _, name := range names {
+				item, ok := macros[name]
+				if !ok {
+					item = mMacros.AddSubMenuItem(name, fmt.Sprintf("Run %s", name))
+					macros[name] = item
+
+					go func(name string) {
+						for range item.ClickedCh {
+							if err := switcher.startMacro(name); err != nil {
+								utils.Alert("Error!", err.Error(), 2)
+							}
+						}
+					}(name)
+				}
+				item.Show()
+			}
+
+			for name, item := range macros {
+				if !slices.Contains(names, name) {
+					item.Hide()
+				}
+			}
+
+			// While a macro runs, the menu shows its progress and can stop it
+			status, running := switcher.macroStatus()
+			if running {
+				mMacros.SetTitle(status)
+				mMacroCancel.Show()
+			} else {
+				mMacros.SetTitle("Macros")
+				mMacroCancel.Hide()
+			}
+
+			if len(names) == 0 && !running {
+				mMacros.Hide()
+			} else {
+				mMacros.Show()
+			}
+		}
+
+		setMacros()
 
 		for {
 
 			select {
 			case <-mMute.ClickedCh:
-				switcher.muteToggle()
-
-			case <-outs[OUT1].ClickedCh:
-				switcher.sendUDP(OUT1)
-				setChecks(OUT1)
-			case <-outs[OUT2].ClickedCh:
-				switcher.sendUDP(OUT2)
-				setChecks(OUT2)
-			case <-outs[OUT3].ClickedCh:
-				switcher.sendUDP(OUT3)
-				setChecks(OUT3)
-			case <-outs[OUT4].ClickedCh:
-				switcher.sendUDP(OUT4)
-				setChecks(OUT4)
+				go switcher.muteToggle(false)
+
+			case <-mPrevious.ClickedCh:
+				go switcher.togglePrevious(false)
+
+			case <-mTimerExtend.ClickedCh:
+				go func() {
+					if err := switcher.extendTimer(switcher.extendBy()); err != nil {
+						utils.Alert("Error!", err.Error(), 1)
+					}
+				}()
+
+			case <-mTimerCancel.ClickedCh:
+				go switcher.cancelTimer()
+
+			case <-mMacroCancel.ClickedCh:
+				go switcher.cancelMacro()
 
 			case <-mSettings.ClickedCh:
 				go switcher.openSettings()
 
 			case <-mReload.ClickedCh:
-				switcher.connect()
+				go switcher.connect()
+
+			case <-mScripts.ClickedCh:
+				go func() { switcher.updated["scripts"] <- "" }()
 
 			case <-mQuit.ClickedCh:
 				systray.Quit()
 				return
 
 			case v := <-switcher.updated["refresh_tray"]:
+				if i, ok := labelIndex(v); ok && i < len(outs) {
+					outs[i].SetTitle(key(v).String())
+					setPrevious()
+					setTimer()
+					setSchedule()
+					continue
+				}
+
 				switch v {
-				case "output1":
-					outs[OUT1].SetTitle(key(v).String())
-				case "output2":
-					outs[OUT2].SetTitle(key(v).String())
-				case "output3":
-					outs[OUT3].SetTitle(key(v).String())
-				case "output4":
-					outs[OUT4].SetTitle(key(v).String())
+				case "outputs":
+					setOutputs()
+				case "profile", "profiles":
+					setProfiles()
+				case "timer", "revert_at", "timer_extend":
+					setTimer()
+					setSchedule()
+				case "schedule":
+					setSchedule()
+				case "macro", "macros":
+					setMacros()
+				case "history":
+					setPrevious()
 				case "current_output":
-					if cur() != MUTED {
+					setPrevious()
+
+					if cur() != switcher.muted() {
 						setChecks(cur())
 						mMute.SetTitle("Mute")
 					} else {
@@ -562,11 +1145,33 @@ func (switcher *Switcher) exit() {
 func main() {
 	utils.SetupFlags()
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	client := &Switcher{}
 
 	client.setupConfig()
 
-	client.connect()
+	go client.connect()
+
+	go client.runHeartbeat()
+
+	go client.runTimer()
+
+	go client.runRules()
+
+	go client.runSchedules()
+
+	go client.runPostHooks()
+
+	go client.runWebhooks()
+
+	go client.runScripts()
+
+	go client.runMIDI()
+
+	client.watchConfig()
 
 	client.setupTray()
 	client.setupHotkeys()
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Alerts go here instead of popping up on the desktop running the tests
+var alerts struct {
+	sync.Mutex
+	title string
+	to    chan string
+}
+
+func TestMain(m *testing.M) {
+	utils.Notify = func(title string, content string) error {
+		alerts.Lock()
+		defer alerts.Unlock()
+
+		if alerts.to != nil && title == alerts.title {
+			select {
+			case alerts.to <- content:
+			default:
+			}
+		}
+		return nil
+	}
+
+	os.Exit(m.Run())
+}
+
+// Collect the alerts titled title shown during the test. Earlier tests can
+// still have others on the way.
+func watchAlerts(t *testing.T, title string) <-chan string {
+	alerts.Lock()
+	defer alerts.Unlock()
+
+	alerts.title, alerts.to = title, make(chan string, 10)
+	t.Cleanup(func() {
+		alerts.Lock()
+		defer alerts.Unlock()
+		alerts.to = nil
+	})
+	return alerts.to
+}
+
+// Tests that need X, the ALSA sequencer or a D-Bus daemon skip without them,
+// unless SOUNDBRICK_TEST_ALL is set as it is in CI, where skipping would hide
+// that they never ran
+func skipWithout(t *testing.T, err error) {
+	t.Helper()
+
+	if err == nil {
+		return
+	}
+	if os.Getenv("SOUNDBRICK_TEST_ALL") != "" {
+		t.Fatal(err)
+	}
+	t.Skip(err)
+}
+
+// A device with outputs outputs on addr, answering the way the firmware does
+func fakeDevice(t *testing.T, addr string, outputs int) *net.UDPAddr {
+	t.Helper()
+
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		t.Skipf("can't pretend to be the device: %s", err)
+	}
+	t.Cleanup(func() { device.Close() })
+
+	go func() {
+		cur, prev := 0, 0
+		buffer := make([]byte, 16)
+		for {
+			n, from, err := device.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			// The index after the last output toggles mute, and outputs
+			// can't be picked while muted
+			refused := false
+			switch command, _ := strconv.Atoi(string(buffer[:n])); {
+			case command == outputs && cur == outputs:
+				cur = prev
+			case command == outputs:
+				prev, cur = cur, outputs
+			case command == CLIENT_CHECK:
+			case command >= 0 && command < outputs && cur != outputs:
+				cur = command
+			default:
+				refused = true
+			}
+
+			status := cur
+			if refused {
+				status = ERROR
+			}
+			device.WriteTo([]byte(fmt.Sprintf("%d/%d", status, outputs)), from)
+		}
+	}()
+
+	return device.LocalAddr().(*net.UDPAddr)
+}
+
+// Set up a switcher the way main does, with config written to a temporary
+// file
+func testSwitcher(t *testing.T, config string) *Switcher {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.ini")
+	t.Setenv("SOUNDBRICK_CONFIG", path)
+	// Tests don't serve the API, later keys win
+	if err := os.WriteFile(path, []byte("api_port = 0\n"+config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	switcher := &Switcher{}
+	switcher.setupConfig()
+	return switcher
+}
+
+// importConfig handles one update at a time, so once it takes another the
+// ones before it, and the saves they make, are done
+func settle(switcher *Switcher) {
+	switcher.updated["device_outputs"] <- strconv.Itoa(int(switcher.deviceOutputs.Load()))
+}
+
+// The tray isn't up while connecting, which used to leave connect waiting for
+// it for ever when restoring the last output
+func TestConnectBeforeTray(t *testing.T) {
+	fakeDevice(t, "127.0.0.1"+SEND_PORT, 4)
+	switcher := testSwitcher(t, "ip = 127.0.0.1\ncurrent_output = 2\ndbus = false\n")
+
+	done := make(chan bool)
+	go func() {
+		switcher.connect()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect never finished")
+	}
+
+	if !switcher.online.Load() {
+		t.Error("not online after connecting")
+	}
+
+	settle(switcher)
+	if got := switcher.config.Section("").Key("current_output").String(); got != "2" {
+		t.Errorf("current_output is %s, want 2", got)
+	}
+}
+
+// Each switch says whether it alerts, so quiet ones made by macros can't
+// swallow the alert of another switch
+func TestQuietSwitch(t *testing.T) {
+	alerts := watchAlerts(t, "Output Changed!")
+
+	switcher := testSwitcher(t, "outputs = 2\noutput1 = Speakers\noutput2 = Headphones\ncurrent_output = 0\ndbus = false\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 2))
+
+	tests := []struct {
+		output int
+		quiet  bool
+		alert  string
+	}{
+		{1, true, ""},
+		{0, false, "Current output: Speakers"},
+		{1, true, ""},
+		{1, false, "Current output: Headphones"},
+	}
+
+	for _, test := range tests {
+		if !switcher.sendUDP(test.output, test.quiet) {
+			t.Fatalf("switching to %d failed", test.output)
+		}
+		settle(switcher)
+
+		// Alerts wait a moment for more important ones
+		select {
+		case got := <-alerts:
+			if got != test.alert {
+				t.Errorf("switching to %d, quiet %v: alerted %q, want %q", test.output, test.quiet, got, test.alert)
+			}
+		case <-time.After(time.Second):
+			if test.alert != "" {
+				t.Errorf("switching to %d: no alert, want %q", test.output, test.alert)
+			}
+		}
+	}
+}
+
+// Another program holding the reply port is reported, not a crash
+func TestExchangePortBusy(t *testing.T) {
+	busy, err := net.ListenPacket("udp4", REC_PORT)
+	if err != nil {
+		t.Skipf("port %s is already taken: %s", REC_PORT, err)
+	}
+	defer busy.Close()
+
+	switcher := testSwitcher(t, "outputs = 2\ndbus = false\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 2))
+
+	if _, err := switcher.exchange(CLIENT_CHECK); !errors.Is(err, errPortBusy) {
+		t.Errorf("got %v, want %v", err, errPortBusy)
+	}
+	if switcher.sendUDP(1, true) {
+		t.Errorf("switching worked without the reply port")
+	}
+}
+
+// Connecting and discovery change the address while commands and the
+// heartbeat use it, run with -race
+func TestSetIPWhileExchanging(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 2\ndbus = false\n")
+	devices := []*net.UDPAddr{fakeDevice(t, "127.0.0.1:0", 2), fakeDevice(t, "127.0.0.1:0", 2)}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			switcher.setIP(devices[i%2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := switcher.exchange(CLIENT_CHECK); errors.Is(err, errPortBusy) {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
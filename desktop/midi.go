@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+// MIDI mappings are [midi.<name>] sections tying a note or CC to an action
+const MIDI_PREFIX = "midi."
+
+// Our port, as other programs and aconnect list it
+const MIDI_PORT_NAME = "SoundBrick"
+
+// How often to try again to open the sequencer and connect to midi_port
+const MIDI_RETRY = 10 * time.Second
+
+// Kinds of MIDI message
+const (
+	MIDI_NOTE = "note"
+	MIDI_CC   = "cc"
+)
+
+// A note or controller message. Channels count from 1, and a note off is a
+// note with a value of 0.
+type midiEvent struct {
+	kind    string
+	channel int
+	number  int
+	value   int
+}
+
+// A port on the sequencer, implemented for each platform
+type midiPort interface {
+	read() (midiEvent, error)
+	write(m midiEvent) error
+	connect(pattern string) ([]string, error)
+	close()
+	String() string
+}
+
+// What a mapping listens for, e.g. "note 36" or "cc 64 ch 10". Without a
+// channel it matches every channel.
+type midiTrigger struct {
+	kind    string
+	number  int
+	channel int
+}
+
+func (t midiTrigger) String() string {
+	s := fmt.Sprintf("%s %d", t.kind, t.number)
+	if t.channel > 0 {
+		s += fmt.Sprintf(" ch %d", t.channel)
+	}
+	return s
+}
+
+func parseMIDITrigger(value string) (midiTrigger, error) {
+	var t midiTrigger
+
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) != 2 && len(fields) != 4 || (fields[0] != MIDI_NOTE && fields[0] != MIDI_CC) {
+		return t, fmt.Errorf("%q is not a trigger such as note 36 or cc 64 ch 10", value)
+	}
+	t.kind = fields[0]
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 || n > 127 {
+		return t, fmt.Errorf("%q is not a number from 0 to 127", fields[1])
+	}
+	t.number = n
+
+	if len(fields) == 4 {
+		ch, err := strconv.Atoi(fields[3])
+		if fields[2] != "ch" || err != nil || ch < 1 || ch > 16 {
+			return t, fmt.Errorf("%q is not a channel such as ch 10", strings.Join(fields[2:], " "))
+		}
+		t.channel = ch
+	}
+
+	return t, nil
+}
+
+func (t midiTrigger) matches(e midiEvent) bool {
+	return t.kind == e.kind && t.number == e.number && (t.channel == 0 || t.channel == e.channel)
+}
+
+// Mappings start without a trigger until one is learned
+func validMIDITrigger(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := parseMIDITrigger(value)
+	return err
+}
+
+func validMIDIValue(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 127 {
+		return fmt.Errorf("%q is not a number from 0 to 127", value)
+	}
+	return nil
+}
+
+// Anything can be part of a port name
+func validMIDIPort(value string) error {
+	return nil
+}
+
+func validMIDIAction(value string) error {
+	if value == "" {
+		return fmt.Errorf("no action")
+	}
+	return validAction(value)
+}
+
+var midiSchema = map[string]configKey{
+	"trigger": {"", validMIDITrigger},
+	"action":  {"", validMIDIAction},
+	"lit":     {"127", validMIDIValue},
+	"unlit":   {"0", validMIDIValue},
+}
+
+func midiSection(name string) string {
+	return MIDI_PREFIX + cycleName(name)
+}
+
+type midiMapping struct {
+	name    string
+	trigger midiTrigger
+	learned bool
+	action  string
+	lit     int
+	unlit   int
+}
+
+// The valid mappings in config, skipping ones that don't validate
+func (switcher *Switcher) midiMappings() ([]midiMapping, []string) {
+	var mappings []midiMapping
+	var errs []string
+
+	for _, sec := range switcher.config.Sections() {
+		if !strings.HasPrefix(sec.Name(), MIDI_PREFIX) {
+			continue
+		}
+
+		name := strings.TrimPrefix(sec.Name(), MIDI_PREFIX)
+		value := func(key string) string {
+			if sec.HasKey(key) {
+				return sec.Key(key).String()
+			}
+			return midiSchema[key].fallback
+		}
+
+		invalid := false
+		for key, k := range midiSchema {
+			if err := k.validate(value(key)); err != nil {
+				errs = append(errs, fmt.Sprintf("midi %s: %s: %s", name, key, err.Error()))
+				invalid = true
+			}
+		}
+		if invalid {
+			continue
+		}
+
+		m := midiMapping{name: name, action: value("action")}
+		m.trigger, _ = parseMIDITrigger(value("trigger"))
+		m.learned = value("trigger") != ""
+		m.lit, _ = strconv.Atoi(value("lit"))
+		m.unlit, _ = strconv.Atoi(value("unlit"))
+
+		mappings = append(mappings, m)
+	}
+
+	slices.SortFunc(mappings, func(a, b midiMapping) bool { return a.name < b.name })
+
+	return mappings, errs
+}
+
+func midiNames(cfg *ini.File) []string {
+	var names []string
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), MIDI_PREFIX) {
+			names = append(names, strings.TrimPrefix(sec.Name(), MIDI_PREFIX))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Whether the pad for a mapping should be lit, for actions that have a state
+// to show
+func (switcher *Switcher) midiLit(m midiMapping) (bool, bool) {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	if x, ok := outputAction(m.action); ok {
+		return cur == x, true
+	}
+
+	switch m.action {
+	case "mute", "mute_on":
+		return cur == switcher.muted(), true
+	case "mute_off":
+		return cur != switcher.muted(), true
+	}
+
+	return false, false
+}
+
+// While learning, the next pad pressed is passed to learn instead of running
+// its action
+type midiState struct {
+	sync.Mutex
+	learn func(trigger string)
+}
+
+// Learn the next trigger, or stop learning with nil
+func (switcher *Switcher) learnMIDI(learn func(trigger string)) {
+	switcher.midi.Lock()
+	defer switcher.midi.Unlock()
+	switcher.midi.learn = learn
+}
+
+func (switcher *Switcher) midiWanted() bool {
+	return switcher.config.Section("").Key("midi_port").String() != "" || len(midiNames(switcher.config)) > 0
+}
+
+// Run mappings as MIDI arrives and light up pads as the output changes,
+// opening the sequencer again if it fails
+func (switcher *Switcher) runMIDI() {
+	changes := switcher.subscribe()
+	reported := ""
+
+	for {
+		if !switcher.midiWanted() {
+			time.Sleep(MIDI_RETRY)
+			continue
+		}
+
+		port, err := openMIDI(MIDI_PORT_NAME)
+		if err == nil {
+			fmt.Printf("MIDI port %s is open\n", port)
+			err = switcher.midiSession(port, changes)
+			port.close()
+		}
+
+		// Only report errors once until they change
+		if err != nil && err.Error() != reported {
+			fmt.Printf("Error: MIDI: %s\n", err.Error())
+		}
+		if err != nil {
+			reported = err.Error()
+		}
+
+		time.Sleep(MIDI_RETRY)
+	}
+}
+
+func (switcher *Switcher) midiSession(port midiPort, changes <-chan stateChange) error {
+	events := make(chan midiEvent)
+	failed := make(chan error, 1)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		for {
+			e, err := port.read()
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case events <- e:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// What each pad was last set to, so only changes are sent
+	sent := map[string]int{}
+
+	feedback := func(force bool) {
+		mappings, _ := switcher.midiMappings()
+		for _, m := range mappings {
+			lit, ok := switcher.midiLit(m)
+			if !ok || !m.learned {
+				continue
+			}
+
+			value := m.unlit
+			if lit {
+				value = m.lit
+			}
+
+			key := m.trigger.String()
+			if v, ok := sent[key]; ok && v == value && !force {
+				continue
+			}
+
+			channel := m.trigger.channel
+			if channel == 0 {
+				channel = 1
+			}
+
+			if err := port.write(midiEvent{m.trigger.kind, channel, m.trigger.number, value}); err != nil {
+				fmt.Printf("Error: MIDI feedback: %s\n", err.Error())
+				return
+			}
+			sent[key] = value
+		}
+	}
+
+	connect := func() {
+		pattern := switcher.config.Section("").Key("midi_port").String()
+		if pattern == "" {
+			return
+		}
+
+		connected, err := port.connect(pattern)
+		for _, name := range connected {
+			fmt.Printf("MIDI connected to %s\n", name)
+		}
+		if err != nil {
+			fmt.Printf("Error: MIDI: %s\n", err.Error())
+		}
+
+		// A surface that just turned up doesn't know what to show
+		if len(connected) > 0 {
+			feedback(true)
+		}
+	}
+
+	connect()
+	feedback(true)
+
+	ticker := time.NewTicker(MIDI_RETRY)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			switcher.midiEvent(e)
+			feedback(false)
+
+		case <-changes:
+			feedback(false)
+
+		case <-ticker.C:
+			if !switcher.midiWanted() {
+				return nil
+			}
+			connect()
+
+		case err := <-failed:
+			return err
+		}
+	}
+}
+
+// Run the mappings for a message, or learn it. Releases, notes off and
+// controllers going to 0, are ignored.
+func (switcher *Switcher) midiEvent(e midiEvent) {
+	if e.value == 0 {
+		return
+	}
+
+	switcher.midi.Lock()
+	learn := switcher.midi.learn
+	switcher.midi.learn = nil
+	switcher.midi.Unlock()
+
+	if learn != nil {
+		learn(midiTrigger{e.kind, e.number, e.channel}.String())
+		return
+	}
+
+	mappings, _ := switcher.midiMappings()
+	for _, m := range mappings {
+		if !m.learned || !m.trigger.matches(e) {
+			continue
+		}
+
+		if err := switcher.run(m.action); err != nil {
+			fmt.Printf("Error: MIDI %s: %s\n", m.name, err.Error())
+		}
+	}
+}
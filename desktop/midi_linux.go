@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The ALSA sequencer, used straight through /dev/snd/seq so there's nothing
+// to install. Structures and numbers are from <sound/asequencer.h>.
+const SEQ_DEVICE = "/dev/snd/seq"
+
+const (
+	SEQ_EVENT_NOTEON     = 6
+	SEQ_EVENT_NOTEOFF    = 7
+	SEQ_EVENT_CONTROLLER = 10
+
+	SEQ_EVENT_LENGTH_MASK     = 3 << 2
+	SEQ_EVENT_LENGTH_VARIABLE = 1 << 2
+	SEQ_EXT_MASK              = 0xc0000000
+
+	SEQ_QUEUE_DIRECT        = 253
+	SEQ_ADDRESS_UNKNOWN     = 253
+	SEQ_ADDRESS_SUBSCRIBERS = 254
+
+	SEQ_CLIENT_SYSTEM = 0
+
+	SEQ_PORT_CAP_READ       = 1 << 0
+	SEQ_PORT_CAP_WRITE      = 1 << 1
+	SEQ_PORT_CAP_DUPLEX     = 1 << 4
+	SEQ_PORT_CAP_SUBS_READ  = 1 << 5
+	SEQ_PORT_CAP_SUBS_WRITE = 1 << 6
+
+	SEQ_PORT_TYPE_MIDI_GENERIC = 1 << 1
+	SEQ_PORT_TYPE_APPLICATION  = 1 << 20
+)
+
+type seqAddr struct {
+	client uint8
+	port   uint8
+}
+
+func (a seqAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.client, a.port)
+}
+
+type seqClientInfo struct {
+	client          int32
+	typ             int32
+	name            [64]byte
+	filter          uint32
+	multicastFilter [8]byte
+	eventFilter     [32]byte
+	numPorts        int32
+	eventLost       int32
+	card            int32
+	pid             int32
+	reserved        [56]byte
+}
+
+type seqPortInfo struct {
+	addr         seqAddr
+	name         [64]byte
+	_            [2]byte
+	capability   uint32
+	typ          uint32
+	midiChannels int32
+	midiVoices   int32
+	synthVoices  int32
+	readUse      int32
+	writeUse     int32
+	kernel       uintptr
+	flags        uint32
+	timeQueue    uint8
+	reserved     [59]byte
+}
+
+type seqPortSubscribe struct {
+	sender   seqAddr
+	dest     seqAddr
+	voices   uint32
+	flags    uint32
+	queue    uint8
+	_        [3]byte
+	reserved [64]byte
+}
+
+type seqEvent struct {
+	typ    uint8
+	flags  uint8
+	tag    int8
+	queue  uint8
+	time   [8]byte
+	source seqAddr
+	dest   seqAddr
+	data   [12]byte
+}
+
+type seqNote struct {
+	channel     uint8
+	note        uint8
+	velocity    uint8
+	offVelocity uint8
+	duration    uint32
+}
+
+type seqCtrl struct {
+	channel uint8
+	_       [3]byte
+	param   uint32
+	value   int32
+}
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'S'<<8 | nr
+}
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+var (
+	SEQ_IOCTL_CLIENT_ID         = ioc(iocRead, 0x01, 4)
+	SEQ_IOCTL_GET_CLIENT_INFO   = ioc(iocRead|iocWrite, 0x10, unsafe.Sizeof(seqClientInfo{}))
+	SEQ_IOCTL_SET_CLIENT_INFO   = ioc(iocWrite, 0x11, unsafe.Sizeof(seqClientInfo{}))
+	SEQ_IOCTL_CREATE_PORT       = ioc(iocRead|iocWrite, 0x20, unsafe.Sizeof(seqPortInfo{}))
+	SEQ_IOCTL_SUBSCRIBE_PORT    = ioc(iocWrite, 0x30, unsafe.Sizeof(seqPortSubscribe{}))
+	SEQ_IOCTL_QUERY_NEXT_CLIENT = ioc(iocRead|iocWrite, 0x51, unsafe.Sizeof(seqClientInfo{}))
+	SEQ_IOCTL_QUERY_NEXT_PORT   = ioc(iocRead|iocWrite, 0x52, unsafe.Sizeof(seqPortInfo{}))
+)
+
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// A sequencer client with one port, which other programs and devices can
+// connect to both ways
+type seqPort struct {
+	file *os.File
+	addr seqAddr
+	buf  []byte
+}
+
+func (p *seqPort) ioctl(req uintptr, arg unsafe.Pointer) error {
+	conn, err := p.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	conn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func openMIDI(name string) (midiPort, error) {
+	fd, err := unix.Open(SEQ_DEVICE, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the ALSA sequencer: %w", err)
+	}
+
+	// Non-blocking, so reads go through the poller and stop on close
+	p := &seqPort{file: os.NewFile(uintptr(fd), SEQ_DEVICE)}
+
+	var id int32
+	if err := p.ioctl(SEQ_IOCTL_CLIENT_ID, unsafe.Pointer(&id)); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	info := seqClientInfo{client: id}
+	if err := p.ioctl(SEQ_IOCTL_GET_CLIENT_INFO, unsafe.Pointer(&info)); err != nil {
+		p.close()
+		return nil, err
+	}
+	info.name = [64]byte{}
+	copy(info.name[:63], name)
+	if err := p.ioctl(SEQ_IOCTL_SET_CLIENT_INFO, unsafe.Pointer(&info)); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	port := seqPortInfo{
+		addr:         seqAddr{client: uint8(id)},
+		capability:   SEQ_PORT_CAP_READ | SEQ_PORT_CAP_WRITE | SEQ_PORT_CAP_DUPLEX | SEQ_PORT_CAP_SUBS_READ | SEQ_PORT_CAP_SUBS_WRITE,
+		typ:          SEQ_PORT_TYPE_MIDI_GENERIC | SEQ_PORT_TYPE_APPLICATION,
+		midiChannels: 16,
+	}
+	copy(port.name[:63], name)
+	if err := p.ioctl(SEQ_IOCTL_CREATE_PORT, unsafe.Pointer(&port)); err != nil {
+		p.close()
+		return nil, fmt.Errorf("could not create a MIDI port: %w", err)
+	}
+	p.addr = port.addr
+
+	return p, nil
+}
+
+func (p *seqPort) String() string {
+	return p.addr.String()
+}
+
+// Connect both ways to the ports matching pattern, which is client:port or
+// part of a client or port name. Returns the ports newly connected.
+func (p *seqPort) connect(pattern string) ([]string, error) {
+	var connected []string
+
+	client := seqClientInfo{client: -1}
+	for p.ioctl(SEQ_IOCTL_QUERY_NEXT_CLIENT, unsafe.Pointer(&client)) == nil {
+		if client.client == SEQ_CLIENT_SYSTEM || client.client == int32(p.addr.client) {
+			continue
+		}
+
+		port := seqPortInfo{addr: seqAddr{client: uint8(client.client), port: 255}}
+		for p.ioctl(SEQ_IOCTL_QUERY_NEXT_PORT, unsafe.Pointer(&port)) == nil {
+			clientName, portName := cString(client.name[:]), cString(port.name[:])
+			if !matchesPort(pattern, port.addr, clientName, portName) {
+				continue
+			}
+
+			label := fmt.Sprintf("%s (%s)", portName, port.addr)
+
+			// From the port to us, and back to light it up
+			if port.capability&(SEQ_PORT_CAP_READ|SEQ_PORT_CAP_SUBS_READ) == SEQ_PORT_CAP_READ|SEQ_PORT_CAP_SUBS_READ {
+				if ok, err := p.subscribe(port.addr, p.addr); err != nil {
+					return connected, fmt.Errorf("could not connect from %s: %w", label, err)
+				} else if ok {
+					connected = append(connected, label)
+				}
+			}
+			if port.capability&(SEQ_PORT_CAP_WRITE|SEQ_PORT_CAP_SUBS_WRITE) == SEQ_PORT_CAP_WRITE|SEQ_PORT_CAP_SUBS_WRITE {
+				if _, err := p.subscribe(p.addr, port.addr); err != nil {
+					return connected, fmt.Errorf("could not connect to %s: %w", label, err)
+				}
+			}
+		}
+	}
+
+	return connected, nil
+}
+
+func matchesPort(pattern string, addr seqAddr, clientName, portName string) bool {
+	if c, port, ok := strings.Cut(pattern, ":"); ok {
+		cn, err1 := strconv.Atoi(strings.TrimSpace(c))
+		pn, err2 := strconv.Atoi(strings.TrimSpace(port))
+		if err1 == nil && err2 == nil {
+			return cn == int(addr.client) && pn == int(addr.port)
+		}
+	}
+
+	pattern = strings.ToLower(pattern)
+	return strings.Contains(strings.ToLower(clientName), pattern) || strings.Contains(strings.ToLower(portName), pattern)
+}
+
+// Subscribe dest to sender, returning false if it already was
+func (p *seqPort) subscribe(sender, dest seqAddr) (bool, error) {
+	sub := seqPortSubscribe{sender: sender, dest: dest}
+	err := p.ioctl(SEQ_IOCTL_SUBSCRIBE_PORT, unsafe.Pointer(&sub))
+	if errors.Is(err, unix.EBUSY) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// The next note or controller event, skipping the rest
+func (p *seqPort) read() (midiEvent, error) {
+	size := int(unsafe.Sizeof(seqEvent{}))
+
+	for {
+		if len(p.buf) < size {
+			buf := make([]byte, 4096)
+			n, err := p.file.Read(buf)
+			if err != nil {
+				return midiEvent{}, err
+			}
+			p.buf = append(p.buf, buf[:n]...)
+			continue
+		}
+
+		var e seqEvent
+		copy((*[unsafe.Sizeof(seqEvent{})]byte)(unsafe.Pointer(&e))[:], p.buf)
+		p.buf = p.buf[size:]
+
+		// Variable length events such as SysEx are followed by their data
+		if e.flags&SEQ_EVENT_LENGTH_MASK == SEQ_EVENT_LENGTH_VARIABLE {
+			var length uint32
+			copy((*[4]byte)(unsafe.Pointer(&length))[:], e.data[:4])
+			skip := int(length &^ SEQ_EXT_MASK)
+			for len(p.buf) < skip {
+				buf := make([]byte, 4096)
+				n, err := p.file.Read(buf)
+				if err != nil {
+					return midiEvent{}, err
+				}
+				p.buf = append(p.buf, buf[:n]...)
+			}
+			p.buf = p.buf[skip:]
+			continue
+		}
+
+		switch e.typ {
+		case SEQ_EVENT_NOTEON, SEQ_EVENT_NOTEOFF:
+			var note seqNote
+			copy((*[unsafe.Sizeof(seqNote{})]byte)(unsafe.Pointer(&note))[:], e.data[:])
+
+			value := int(note.velocity)
+			if e.typ == SEQ_EVENT_NOTEOFF {
+				value = 0
+			}
+			return midiEvent{MIDI_NOTE, int(note.channel) + 1, int(note.note), value}, nil
+
+		case SEQ_EVENT_CONTROLLER:
+			var ctrl seqCtrl
+			copy((*[unsafe.Sizeof(seqCtrl{})]byte)(unsafe.Pointer(&ctrl))[:], e.data[:])
+			return midiEvent{MIDI_CC, int(ctrl.channel) + 1, int(ctrl.param), int(ctrl.value)}, nil
+		}
+	}
+}
+
+// Send an event to everything connected to our port
+func (p *seqPort) write(m midiEvent) error {
+	e := seqEvent{
+		queue:  SEQ_QUEUE_DIRECT,
+		source: p.addr,
+		dest:   seqAddr{SEQ_ADDRESS_SUBSCRIBERS, SEQ_ADDRESS_UNKNOWN},
+	}
+
+	switch m.kind {
+	case MIDI_NOTE:
+		e.typ = SEQ_EVENT_NOTEON
+		note := seqNote{channel: uint8(m.channel - 1), note: uint8(m.number), velocity: uint8(m.value)}
+		copy(e.data[:], (*[unsafe.Sizeof(seqNote{})]byte)(unsafe.Pointer(&note))[:])
+	case MIDI_CC:
+		e.typ = SEQ_EVENT_CONTROLLER
+		ctrl := seqCtrl{channel: uint8(m.channel - 1), param: uint32(m.number), value: int32(m.value)}
+		copy(e.data[:], (*[unsafe.Sizeof(seqCtrl{})]byte)(unsafe.Pointer(&ctrl))[:])
+	}
+
+	_, err := p.file.Write((*[unsafe.Sizeof(seqEvent{})]byte)(unsafe.Pointer(&e))[:])
+	return err
+}
+
+func (p *seqPort) close() {
+	p.file.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// The kernel copies these byte for byte, so they have to match
+// <sound/asequencer.h> exactly
+func TestSeqStructSizes(t *testing.T) {
+	// The port info holds a kernel pointer
+	portInfo := uintptr(168)
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		portInfo = 164
+	}
+
+	sizes := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"snd_seq_client_info", unsafe.Sizeof(seqClientInfo{}), 188},
+		{"snd_seq_port_info", unsafe.Sizeof(seqPortInfo{}), portInfo},
+		{"snd_seq_port_subscribe", unsafe.Sizeof(seqPortSubscribe{}), 80},
+		{"snd_seq_event", unsafe.Sizeof(seqEvent{}), 28},
+		{"snd_seq_ev_note", unsafe.Sizeof(seqNote{}), 8},
+		{"snd_seq_ev_ctrl", unsafe.Sizeof(seqCtrl{}), 12},
+	}
+
+	for _, s := range sizes {
+		if s.got != s.want {
+			t.Errorf("%s is %d bytes, want %d", s.name, s.got, s.want)
+		}
+	}
+
+	if offset := unsafe.Offsetof(seqPortInfo{}.capability); offset != 68 {
+		t.Errorf("port capability is at %d, want 68", offset)
+	}
+}
+
+func TestMatchesPort(t *testing.T) {
+	addr := seqAddr{client: 24, port: 0}
+
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"24:0", true},
+		{" 24 : 0 ", true},
+		{"24:1", false},
+		{"20:0", false},
+		{"launchpad", true},
+		{"LAUNCHPAD MINI", true},
+		{"MIDI 1", true},
+		{"nanoKONTROL", false},
+		// Not a number, so it's part of a name
+		{"Mini:MIDI", false},
+	}
+
+	for _, test := range tests {
+		if got := matchesPort(test.pattern, addr, "Launchpad Mini", "Launchpad Mini MIDI 1"); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+// Read with a timeout, as a missing event would otherwise block for ever
+func readMIDI(t *testing.T, p midiPort) midiEvent {
+	t.Helper()
+
+	events := make(chan midiEvent, 1)
+	errs := make(chan error, 1)
+	go func() {
+		e, err := p.read()
+		if err != nil {
+			errs <- err
+			return
+		}
+		events <- e
+	}()
+
+	select {
+	case e := <-events:
+		return e
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("nothing arrived at %s", p)
+	}
+	return midiEvent{}
+}
+
+// Runs against the real sequencer, which needs the snd-seq module, and sends
+// events through the Midi Through port of snd-seq-dummy
+func TestSequencer(t *testing.T) {
+	_, err := os.Stat(SEQ_DEVICE)
+	skipWithout(t, err)
+
+	a, err := openMIDI("SoundBrick test A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	b, err := openMIDI("SoundBrick test B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	connected, err := a.connect("SoundBrick test B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) != 1 || !strings.HasPrefix(connected[0], "SoundBrick test B (") {
+		t.Fatalf("connected to %v", connected)
+	}
+
+	// Already connected
+	if connected, err := a.connect(b.String()); err != nil || len(connected) != 0 {
+		t.Errorf("connecting again gave %v, %v", connected, err)
+	}
+
+	note := midiEvent{MIDI_NOTE, 10, 36, 100}
+	if err := b.write(note); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMIDI(t, a); got != note {
+		t.Errorf("got %+v, want %+v", got, note)
+	}
+
+	// And back, to light up pads
+	cc := midiEvent{MIDI_CC, 1, 64, 127}
+	if err := a.write(cc); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMIDI(t, b); got != cc {
+		t.Errorf("got %+v, want %+v", got, cc)
+	}
+
+	// Midi Through sends everything straight back
+	through, err := openMIDI("SoundBrick test C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer through.close()
+
+	connected, err = through.connect("Midi Through")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) == 0 {
+		skipWithout(t, errors.New("snd-seq-dummy isn't loaded, no Midi Through"))
+	}
+
+	off := midiEvent{MIDI_NOTE, 2, 60, 0}
+	if err := through.write(off); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMIDI(t, through); got != off {
+		t.Errorf("got %+v back, want %+v", got, off)
+	}
+}
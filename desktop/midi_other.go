@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func openMIDI(name string) (midiPort, error) {
+	return nil, fmt.Errorf("MIDI is only supported through the ALSA sequencer on Linux")
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestParseMIDITrigger(t *testing.T) {
+	tests := []struct {
+		value string
+		want  midiTrigger
+		ok    bool
+	}{
+		{"note 36", midiTrigger{MIDI_NOTE, 36, 0}, true},
+		{"cc 64 ch 10", midiTrigger{MIDI_CC, 64, 10}, true},
+		{"  NOTE  0  CH 1 ", midiTrigger{MIDI_NOTE, 0, 1}, true},
+		{"note 127 ch 16", midiTrigger{MIDI_NOTE, 127, 16}, true},
+		{"", midiTrigger{}, false},
+		{"note", midiTrigger{}, false},
+		{"note 128", midiTrigger{}, false},
+		{"note -1", midiTrigger{}, false},
+		{"note C4", midiTrigger{}, false},
+		{"pitch 36", midiTrigger{}, false},
+		{"cc 64 ch", midiTrigger{}, false},
+		{"cc 64 ch 0", midiTrigger{}, false},
+		{"cc 64 ch 17", midiTrigger{}, false},
+		{"cc 64 channel 1", midiTrigger{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseMIDITrigger(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.value, got, test.want)
+		}
+	}
+
+	// Written back the way it's read
+	for _, value := range []string{"note 36", "cc 64 ch 10"} {
+		if got, _ := parseMIDITrigger(value); got.String() != value {
+			t.Errorf("%q comes back as %q", value, got)
+		}
+	}
+}
+
+func TestMIDITriggerMatches(t *testing.T) {
+	pad := midiTrigger{MIDI_NOTE, 36, 0}
+	pedal := midiTrigger{MIDI_CC, 64, 10}
+
+	tests := []struct {
+		trigger midiTrigger
+		event   midiEvent
+		want    bool
+	}{
+		{pad, midiEvent{MIDI_NOTE, 1, 36, 100}, true},
+		{pad, midiEvent{MIDI_NOTE, 16, 36, 0}, true},
+		{pad, midiEvent{MIDI_NOTE, 1, 37, 100}, false},
+		{pad, midiEvent{MIDI_CC, 1, 36, 100}, false},
+		{pedal, midiEvent{MIDI_CC, 10, 64, 127}, true},
+		{pedal, midiEvent{MIDI_CC, 1, 64, 127}, false},
+		{pedal, midiEvent{MIDI_NOTE, 10, 64, 127}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.trigger.matches(test.event); got != test.want {
+			t.Errorf("%s with %+v: got %v, want %v", test.trigger, test.event, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Every address starts with this, e.g. /soundbrick/output
+const OSC_PREFIX = "/soundbrick"
+
+// Clients that register are forgotten past this many, oldest first
+const OSC_MAX_CLIENTS = 32
+
+// A message with its arguments, which are int32, float32, string or bool
+type oscMessage struct {
+	address string
+	args    []interface{}
+}
+
+// Strings are NUL terminated and padded to four bytes
+func oscString(b *bytes.Buffer, s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+func (m oscMessage) encode() []byte {
+	var b bytes.Buffer
+	oscString(&b, m.address)
+
+	tags := ","
+	var args bytes.Buffer
+	for _, arg := range m.args {
+		switch v := arg.(type) {
+		case int32:
+			tags += "i"
+			binary.Write(&args, binary.BigEndian, v)
+		case float32:
+			tags += "f"
+			binary.Write(&args, binary.BigEndian, v)
+		case string:
+			tags += "s"
+			oscString(&args, v)
+		case bool:
+			tags += map[bool]string{true: "T", false: "F"}[v]
+		}
+	}
+
+	oscString(&b, tags)
+	b.Write(args.Bytes())
+	return b.Bytes()
+}
+
+func readOSCString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+
+	size := (end + 4) &^ 3
+	if size > len(data) {
+		return "", nil, fmt.Errorf("string runs past the end")
+	}
+	return string(data[:end]), data[size:], nil
+}
+
+// Parse a packet, which is a message or a bundle of them. Bundles run as
+// soon as they arrive, whatever their time tag.
+func parseOSC(data []byte) ([]oscMessage, error) {
+	if bytes.HasPrefix(data, []byte("#bundle\x00")) {
+		if len(data) < 16 {
+			return nil, fmt.Errorf("bundle is too short")
+		}
+
+		var messages []oscMessage
+		for rest := data[16:]; len(rest) > 0; {
+			if len(rest) < 4 {
+				return nil, fmt.Errorf("bundle element is too short")
+			}
+			size := int(binary.BigEndian.Uint32(rest))
+			if size > len(rest)-4 {
+				return nil, fmt.Errorf("bundle element runs past the end")
+			}
+
+			inner, err := parseOSC(rest[4 : 4+size])
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, inner...)
+			rest = rest[4+size:]
+		}
+		return messages, nil
+	}
+
+	address, rest, err := readOSCString(data)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(address, "/") {
+		return nil, fmt.Errorf("%q is not an address", address)
+	}
+
+	m := oscMessage{address: address}
+
+	// Old clients leave out the type tags when there are no arguments
+	if len(rest) == 0 {
+		return []oscMessage{m}, nil
+	}
+
+	tags, rest, err := readOSCString(rest)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(tags, ",") {
+		return nil, fmt.Errorf("%q are not type tags", tags)
+	}
+
+	for _, tag := range tags[1:] {
+		switch tag {
+		case 'i', 'f':
+			if len(rest) < 4 {
+				return nil, fmt.Errorf("argument runs past the end")
+			}
+			bits := binary.BigEndian.Uint32(rest)
+			if tag == 'i' {
+				m.args = append(m.args, int32(bits))
+			} else {
+				m.args = append(m.args, math.Float32frombits(bits))
+			}
+			rest = rest[4:]
+		case 's', 'S':
+			var s string
+			if s, rest, err = readOSCString(rest); err != nil {
+				return nil, err
+			}
+			m.args = append(m.args, s)
+		case 'T', 'F':
+			m.args = append(m.args, tag == 'T')
+		case 'N', 'I':
+		default:
+			return nil, fmt.Errorf("unsupported type %q", tag)
+		}
+	}
+
+	return []oscMessage{m}, nil
+}
+
+// The first argument as a number, which consoles send as either ints or
+// floats
+func (m oscMessage) number() (int, bool) {
+	if len(m.args) == 0 {
+		return 0, false
+	}
+
+	switch v := m.args[0].(type) {
+	case int32:
+		return int(v), true
+	case float32:
+		return int(math.Round(float64(v))), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Buttons send 1 when pressed and 0 when released, only presses count
+func (m oscMessage) pressed() bool {
+	n, ok := m.number()
+	return !ok || n != 0
+}
+
+func validOSCClients(value string) error {
+	for _, client := range strings.Split(value, ",") {
+		if client = strings.TrimSpace(client); client == "" {
+			continue
+		}
+		if _, err := net.ResolveUDPAddr("udp", client); err != nil {
+			return fmt.Errorf("%q is not a host:port", client)
+		}
+	}
+	return nil
+}
+
+// The address OSC listens on, 0.0.0.0 for every interface
+func validOSCBind(value string) error {
+	if net.ParseIP(value) == nil {
+		return fmt.Errorf("%q is not an IP address", value)
+	}
+	return nil
+}
+
+// Listening beyond this computer lets anyone on the network in unless
+// clients are listed
+func oscBindError(bind, clients string) error {
+	if ip := net.ParseIP(bind); ip != nil && !ip.IsLoopback() && len(splitClients(clients)) == 0 {
+		return fmt.Errorf("listening on %s needs osc_clients", bind)
+	}
+	return nil
+}
+
+func splitClients(value string) []string {
+	var clients []string
+	for _, client := range strings.Split(value, ",") {
+		if client = strings.TrimSpace(client); client != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// osc_clients resolved once per value, rather than for every packet
+type oscClientCache struct {
+	sync.Mutex
+	value    string
+	resolved bool
+	listed   bool
+	addrs    []*net.UDPAddr
+}
+
+func (switcher *Switcher) configuredOSCClients() (addrs []*net.UDPAddr, listed bool) {
+	value := switcher.config.Section("").Key("osc_clients").String()
+
+	c := &switcher.oscClients
+	c.Lock()
+	defer c.Unlock()
+
+	if c.resolved && c.value == value {
+		return c.addrs, c.listed
+	}
+
+	clients := splitClients(value)
+	c.value, c.resolved, c.listed, c.addrs = value, true, len(clients) > 0, nil
+	for _, client := range clients {
+		if addr, err := net.ResolveUDPAddr("udp", client); err == nil {
+			c.addrs = append(c.addrs, addr)
+		} else {
+			fmt.Printf("Error: OSC: %s\n", err.Error())
+		}
+	}
+
+	return c.addrs, c.listed
+}
+
+// Whether to take messages from addr. Once clients are listed only their
+// hosts are answered, so strangers can't control the device or have state
+// sent elsewhere.
+func (switcher *Switcher) oscAllowed(addr *net.UDPAddr) bool {
+	clients, listed := switcher.configuredOSCClients()
+	for _, c := range clients {
+		if c.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return !listed
+}
+
+// Where feedback goes, both the clients in config and the ones that
+// registered
+type oscServer struct {
+	sync.Mutex
+	conn    *net.UDPConn
+	clients []*net.UDPAddr
+}
+
+func (s *oscServer) register(addr *net.UDPAddr) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.clients {
+		if c.String() == addr.String() {
+			return
+		}
+	}
+
+	s.clients = append(s.clients, addr)
+	if len(s.clients) > OSC_MAX_CLIENTS {
+		s.clients = s.clients[1:]
+	}
+}
+
+func (s *oscServer) unregister(addr *net.UDPAddr) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, c := range s.clients {
+		if c.String() == addr.String() {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// Registered clients, then the ones in config
+func (switcher *Switcher) feedbackClients(s *oscServer) []*net.UDPAddr {
+	s.Lock()
+	clients := append([]*net.UDPAddr{}, s.clients...)
+	s.Unlock()
+
+	configured, _ := switcher.configuredOSCClients()
+	return append(clients, configured...)
+}
+
+// Everything a client needs to show the current state. Outputs count from
+// 1, 0 being muted.
+func (switcher *Switcher) oscState() []oscMessage {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	output := int32(cur + 1)
+	if cur == switcher.muted() {
+		output = 0
+	}
+
+	messages := []oscMessage{
+		{OSC_PREFIX + "/output", []interface{}{output}},
+		{OSC_PREFIX + "/mute", []interface{}{boolInt(cur == switcher.muted())}},
+		{OSC_PREFIX + "/online", []interface{}{boolInt(switcher.online.Load())}},
+	}
+
+	// One address per output, so buttons can light up for the current one
+	for i := 0; i < switcher.outputCount(); i++ {
+		n := strconv.Itoa(i + 1)
+		messages = append(messages,
+			oscMessage{OSC_PREFIX + "/output/" + n, []interface{}{boolInt(i == cur)}},
+			oscMessage{OSC_PREFIX + "/label/" + n, []interface{}{switcher.label(i)}},
+		)
+	}
+
+	return messages
+}
+
+func boolInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *oscServer) send(to []*net.UDPAddr, messages []oscMessage) {
+	for _, m := range messages {
+		packet := m.encode()
+		for _, addr := range to {
+			if _, err := s.conn.WriteToUDP(packet, addr); err != nil {
+				fmt.Printf("Error: OSC feedback to %s: %s\n", addr, err.Error())
+			}
+		}
+	}
+}
+
+// Run a message sent from addr
+func (switcher *Switcher) handleOSC(s *oscServer, m oscMessage, addr *net.UDPAddr) error {
+	path := strings.TrimPrefix(m.address, OSC_PREFIX)
+	if path == m.address {
+		return fmt.Errorf("unknown address %s", m.address)
+	}
+
+	// /output/<n> suits buttons, /output <n> suits faders and encoders
+	if rest := strings.TrimPrefix(path, "/output/"); rest != path {
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return fmt.Errorf("unknown address %s", m.address)
+		}
+		if !m.pressed() {
+			return nil
+		}
+		return switcher.selectOutput(n-1, false)
+	}
+
+	switch path {
+	case "/output":
+		n, ok := m.number()
+		if !ok {
+			return fmt.Errorf("%s needs an output", m.address)
+		}
+		if n == 0 {
+			return switcher.run("mute_on")
+		}
+		return switcher.selectOutput(n-1, false)
+
+	// 1 mutes and 0 unmutes, no argument toggles
+	case "/mute":
+		n, ok := m.number()
+		switch {
+		case !ok:
+			return switcher.run("mute")
+		case n != 0:
+			return switcher.run("mute_on")
+		}
+		return switcher.run("mute_off")
+
+	case "/cycle", "/reverse", "/previous":
+		if !m.pressed() {
+			return nil
+		}
+		return switcher.run(strings.TrimPrefix(path, "/"))
+
+	case "/action":
+		name, ok := "", len(m.args) > 0
+		if ok {
+			name, ok = m.args[0].(string)
+		}
+		if !ok {
+			return fmt.Errorf("%s needs an action name", m.address)
+		}
+		if err := validAction(name); err != nil {
+			return err
+		}
+		return switcher.run(name)
+
+	// Register to get feedback, on the port given or the one sent from
+	case "/register", "/unregister":
+		to := *addr
+		if n, ok := m.number(); ok && n > 0 && n <= 65535 {
+			to.Port = n
+		}
+
+		if path == "/register" {
+			s.register(&to)
+			s.send([]*net.UDPAddr{&to}, switcher.oscState())
+		} else {
+			s.unregister(&to)
+		}
+		return nil
+
+	case "/state":
+		s.send([]*net.UDPAddr{addr}, switcher.oscState())
+		return nil
+	}
+
+	return fmt.Errorf("unknown address %s", m.address)
+}
+
+func (switcher *Switcher) setupOSC() {
+	port := switcher.config.Section("").Key("osc_port").String()
+	if port == "" || port == "0" {
+		return
+	}
+
+	// Only this computer by default
+	bind := switcher.config.Section("").Key("osc_bind").MustString("127.0.0.1")
+
+	if err := oscBindError(bind, switcher.config.Section("").Key("osc_clients").String()); err != nil {
+		fmt.Printf("Error: OSC: %s\n", err.Error())
+		utils.Alert("Error!", fmt.Sprintf("OSC is off: %s.", err.Error()), 1)
+		return
+	}
+
+	addr, _ := net.ResolveUDPAddr("udp", net.JoinHostPort(bind, port))
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		utils.Alert("Error!", fmt.Sprintf("Could not start the OSC server on %s port %s!", bind, port), 1)
+		return
+	}
+
+	s := &oscServer{conn: conn}
+
+	// Feedback for every change, so faders and buttons follow the device
+	go func() {
+		for range switcher.subscribe() {
+			s.send(switcher.feedbackClients(s), switcher.oscState())
+		}
+	}()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				fmt.Printf("Error: OSC: %s\n", err.Error())
+				return
+			}
+
+			if !switcher.oscAllowed(from) {
+				fmt.Printf("Error: OSC from %s, which isn't in osc_clients\n", from)
+				continue
+			}
+
+			messages, err := parseOSC(buffer[:n])
+			if err != nil {
+				fmt.Printf("Error: OSC from %s: %s\n", from, err.Error())
+				continue
+			}
+
+			for _, m := range messages {
+				if err := switcher.handleOSC(s, m, from); err != nil {
+					fmt.Printf("Error: OSC %s from %s: %s\n", m.address, from, err.Error())
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// Elements of a bundle, each after its size
+func oscBundle(elements ...[]byte) []byte {
+	b := bytes.NewBufferString("#bundle\x00")
+	b.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1}) // immediately
+	for _, e := range elements {
+		binary.Write(b, binary.BigEndian, uint32(len(e)))
+		b.Write(e)
+	}
+	return b.Bytes()
+}
+
+func TestOSCRoundTrip(t *testing.T) {
+	messages := []oscMessage{
+		{"/soundbrick/cycle", nil},
+		{"/soundbrick/output", []interface{}{int32(3)}},
+		{"/soundbrick/output", []interface{}{int32(-1)}},
+		{"/soundbrick/fader", []interface{}{float32(0.75)}},
+		{"/soundbrick/label/1", []interface{}{"Speakers"}},
+		// Lengths either side of the four byte padding
+		{"/abc", []interface{}{"abc", "abcd", ""}},
+		{"/soundbrick/mixed", []interface{}{int32(1), true, "x", false, float32(-2.5)}},
+	}
+
+	for _, m := range messages {
+		packet := m.encode()
+		if len(packet)%4 != 0 {
+			t.Errorf("%s: packet is %d bytes, not padded", m.address, len(packet))
+		}
+
+		got, err := parseOSC(packet)
+		if err != nil {
+			t.Errorf("%s: %s", m.address, err)
+			continue
+		}
+		if len(got) != 1 || got[0].address != m.address || (len(m.args) > 0 && !reflect.DeepEqual(got[0].args, m.args)) {
+			t.Errorf("%s: got %v, want %v", m.address, got, m)
+		}
+	}
+
+	// A known packet, from the OSC 1.0 spec
+	spec := []byte("/oscillator/4/frequency\x00,f\x00\x00\x43\xdc\x00\x00")
+	if got := (oscMessage{"/oscillator/4/frequency", []interface{}{float32(440)}}).encode(); !bytes.Equal(got, spec) {
+		t.Errorf("encoded % x, want % x", got, spec)
+	}
+}
+
+func TestOSCBundle(t *testing.T) {
+	output := oscMessage{"/soundbrick/output", []interface{}{int32(2)}}.encode()
+	mute := oscMessage{"/soundbrick/mute", []interface{}{int32(1)}}.encode()
+	cycle := oscMessage{"/soundbrick/cycle", nil}.encode()
+
+	// Nested bundles run in order
+	got, err := parseOSC(oscBundle(output, oscBundle(mute, cycle)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addresses []string
+	for _, m := range got {
+		addresses = append(addresses, m.address)
+	}
+	want := []string{"/soundbrick/output", "/soundbrick/mute", "/soundbrick/cycle"}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %v, want %v", addresses, want)
+	}
+
+	if got, err := parseOSC(oscBundle()); err != nil || len(got) != 0 {
+		t.Errorf("empty bundle gave %v, %v", got, err)
+	}
+}
+
+func TestOSCMalformed(t *testing.T) {
+	output := oscMessage{"/soundbrick/output", []interface{}{int32(2)}}.encode()
+	label := oscMessage{"/soundbrick/label/1", []interface{}{"Speakers"}}.encode()
+	bundle := oscBundle(output)
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"unterminated address", []byte("/soundbrick")},
+		{"address padding cut", []byte("/soundbrick/output\x00")},
+		{"not an address", []byte("soundbrick\x00\x00")},
+		{"int cut", output[:len(output)-2]},
+		{"int missing", output[:len(output)-4]},
+		{"string cut", label[:len(label)-4]},
+		{"bad tags", []byte("/a\x00\x00i\x00\x00\x00")},
+		{"unsupported type", []byte("/a\x00\x00,b\x00\x00\x00\x00\x00\x01\xff\x00\x00\x00")},
+		{"bundle header cut", bundle[:12]},
+		{"bundle size cut", bundle[:18]},
+		{"bundle element cut", bundle[:len(bundle)-4]},
+		{"bad message in bundle", oscBundle([]byte("oops"))},
+	}
+
+	for _, test := range tests {
+		if got, err := parseOSC(test.packet); err == nil {
+			t.Errorf("%s: got %v, want an error", test.name, got)
+		}
+	}
+
+	// Old clients leave out the type tags
+	got, err := parseOSC([]byte("/soundbrick/cycle\x00\x00\x00"))
+	if err != nil || len(got) != 1 || len(got[0].args) != 0 {
+		t.Errorf("message without type tags gave %v, %v", got, err)
+	}
+}
+
+func TestOSCNumber(t *testing.T) {
+	tests := []struct {
+		args    []interface{}
+		n       int
+		ok      bool
+		pressed bool
+	}{
+		{nil, 0, false, true},
+		{[]interface{}{int32(3)}, 3, true, true},
+		{[]interface{}{float32(2.6)}, 3, true, true},
+		{[]interface{}{float32(0)}, 0, true, false},
+		{[]interface{}{true}, 1, true, true},
+		{[]interface{}{false}, 0, true, false},
+		{[]interface{}{"4"}, 4, true, true},
+		{[]interface{}{"four"}, 0, false, true},
+	}
+
+	for _, test := range tests {
+		m := oscMessage{"/soundbrick/output", test.args}
+		if n, ok := m.number(); n != test.n || ok != test.ok {
+			t.Errorf("%v: got %d, %v, want %d, %v", test.args, n, ok, test.n, test.ok)
+		}
+		if pressed := m.pressed(); pressed != test.pressed {
+			t.Errorf("%v: pressed is %v", test.args, pressed)
+		}
+	}
+}
+
+func TestOSCAllowed(t *testing.T) {
+	switcher := &Switcher{config: ini.Empty()}
+	Key := switcher.config.Section("").Key
+
+	console := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 53000}
+	stranger := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 99), Port: 8000}
+
+	if !switcher.oscAllowed(console) || !switcher.oscAllowed(stranger) {
+		t.Errorf("clients were turned away with no osc_clients")
+	}
+
+	// Only the host has to match, consoles send from any port
+	Key("osc_clients").SetValue("192.168.1.50:8000, 192.168.1.51:8000")
+	if !switcher.oscAllowed(console) {
+		t.Errorf("listed client was turned away")
+	}
+	if switcher.oscAllowed(stranger) {
+		t.Errorf("unlisted client was let in")
+	}
+
+	Key("osc_clients").SetValue(" , ")
+	if !switcher.oscAllowed(stranger) {
+		t.Errorf("clients were turned away with an empty osc_clients")
+	}
+}
+
+func TestOSCBindError(t *testing.T) {
+	tests := []struct {
+		bind    string
+		clients string
+		ok      bool
+	}{
+		{"127.0.0.1", "", true},
+		{"::1", "", true},
+		{"0.0.0.0", "", false},
+		{"192.168.1.10", " , ", false},
+		{"0.0.0.0", "192.168.1.50:8000", true},
+		{"192.168.1.10", "192.168.1.50:8000, 192.168.1.51:8000", true},
+	}
+
+	for _, test := range tests {
+		if err := oscBindError(test.bind, test.clients); (err == nil) != test.ok {
+			t.Errorf("%s with %q: got %v", test.bind, test.clients, err)
+		}
+	}
+
+	cfg := ini.Empty()
+	cfg.Section("").Key("osc_bind").SetValue("0.0.0.0")
+	if errs := validateConfig(cfg); len(errs) != 1 {
+		t.Errorf("listening everywhere with no clients gave %v", errs)
+	}
+}
+
+// Packets arrive far more often than config changes
+func TestOSCClientsResolvedOnce(t *testing.T) {
+	switcher := &Switcher{config: ini.Empty()}
+	Key := switcher.config.Section("").Key
+
+	Key("osc_clients").SetValue("192.168.1.50:8000")
+	first, _ := switcher.configuredOSCClients()
+	again, _ := switcher.configuredOSCClients()
+	if len(first) != 1 || len(again) != 1 || first[0] != again[0] {
+		t.Errorf("resolved again with no change: %v, then %v", first, again)
+	}
+
+	Key("osc_clients").SetValue("192.168.1.51:8000")
+	if changed, _ := switcher.configuredOSCClients(); len(changed) != 1 || changed[0].String() != "192.168.1.51:8000" {
+		t.Errorf("got %v after osc_clients changed", changed)
+	}
+}
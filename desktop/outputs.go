@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_OUTPUTS = 4
+	MAX_OUTPUTS     = 16
+)
+
+func outputKey(index int) string {
+	return fmt.Sprintf("output%d", index+1)
+}
+
+// labelIndex returns the output index of a label key such as output3
+func labelIndex(key string) (int, bool) {
+	if !strings.HasPrefix(key, "output") {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(key, "output"))
+	if err != nil || n < 1 || n > MAX_OUTPUTS {
+		return 0, false
+	}
+
+	return n - 1, true
+}
+
+// configuredOutputs returns the outputs key, or 0 if it is left to the device
+func configuredOutputs(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MAX_OUTPUTS {
+		return 0
+	}
+	return n
+}
+
+// The outputs shown, which can be fewer than the device has
+func (switcher *Switcher) outputCount() int {
+	return int(switcher.outputs.Load())
+}
+
+// The device uses the index after its last output for mute, so it depends on
+// what the device has rather than how many outputs are shown
+func (switcher *Switcher) muted() int {
+	if n := switcher.deviceOutputs.Load(); n > 0 {
+		return int(n)
+	}
+	return switcher.outputCount()
+}
+
+func (switcher *Switcher) isOutput(x int) bool {
+	return x >= 0 && x < switcher.outputCount()
+}
+
+// Labels are read from every goroutine, so this never writes to config.
+// importConfig fills in the missing ones.
+func (switcher *Switcher) label(index int) string {
+	if key, err := switcher.config.Section("").GetKey(outputKey(index)); err == nil && key.String() != "" {
+		return key.String()
+	}
+	return defaultLabel(index)
+}
+
+func defaultLabel(index int) string {
+	return fmt.Sprintf("Output %d", index+1)
+}
+
+// enabled returns an ON/OFF state for every output, missing ones are ON
+func (switcher *Switcher) enabled() []string {
+	return padEnabled(switcher.config.Section("").Key("enabled").Strings(","), switcher.outputCount())
+}
+
+func padEnabled(states []string, count int) []string {
+	padded := make([]string, count)
+	for i := range padded {
+		padded[i] = "ON"
+		if i < len(states) {
+			padded[i] = states[i]
+		}
+	}
+	return padded
+}
+
+// Work out the output count from config, falling back to what the device
+// reported and then to the original four
+func (switcher *Switcher) countOutputs() int {
+	if n := configuredOutputs(switcher.config.Section("").Key("outputs").String()); n > 0 {
+		return n
+	}
+	if n := switcher.deviceOutputs.Load(); n > 0 {
+		return int(n)
+	}
+	return DEFAULT_OUTPUTS
+}
+
+// Parse a reply from the device, either "<status>" or "<status>/<outputs>"
+func parseReply(reply string) (status int, outputs int, err error) {
+	s, count, found := strings.Cut(strings.TrimSpace(reply), "/")
+
+	if status, err = strconv.Atoi(s); err != nil {
+		return ERROR, 0, err
+	}
+
+	if found {
+		outputs, err = strconv.Atoi(count)
+		if err != nil || outputs < 1 || outputs > MAX_OUTPUTS {
+			return status, 0, fmt.Errorf("invalid output count %q", count)
+		}
+	}
+
+	return status, outputs, nil
+}
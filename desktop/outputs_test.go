@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// Labels are read from many goroutines at once, run with -race
+func TestLabel(t *testing.T) {
+	switcher := &Switcher{config: ini.Empty()}
+	sec := switcher.config.Section("")
+	sec.Key("output1").SetValue("Speakers")
+	sec.Key("output2").SetValue("")
+
+	tests := []struct {
+		index int
+		want  string
+	}{
+		{0, "Speakers"},
+		{1, "Output 2"},
+		{2, "Output 3"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, test := range tests {
+				if got := switcher.label(test.index); got != test.want {
+					t.Errorf("label(%d) = %q, want %q", test.index, got, test.want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Reading left config as it was
+	if sec.Key("output2").String() != "" || sec.HasKey("output3") {
+		t.Errorf("reading labels wrote defaults to config")
+	}
+}
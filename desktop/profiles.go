@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+const PROFILE_PREFIX = "profile."
+
+// Keys that belong to the active profile rather than the machine
+func isProfileKey(key string) bool {
+	if _, known := configKeys[key]; !known {
+		return false
+	}
+
+	_, isLabel := labelIndex(key)
+	_, isCycle := cycleKeys[key]
+	return isLabel || key == "enabled" || isCycle || isBindingKey(key)
+}
+
+// Profile keys set in the root section or the profile
+func profileKeys(sections ...*ini.Section) []string {
+	var keys []string
+	for _, sec := range sections {
+		for _, key := range sec.KeyStrings() {
+			if isProfileKey(key) && !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Like keys, profile names are case-insensitive
+func profileName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func profileSection(name string) string {
+	return PROFILE_PREFIX + profileName(name)
+}
+
+func profileNames(cfg *ini.File) []string {
+	var names []string
+	for _, sec := range cfg.Sections() {
+		if strings.HasPrefix(sec.Name(), PROFILE_PREFIX) {
+			names = append(names, strings.TrimPrefix(sec.Name(), PROFILE_PREFIX))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func validProfileName(name string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "[]=") {
+		return fmt.Errorf("%q is not a valid profile name", name)
+	}
+	return nil
+}
+
+// profileValues returns the values profile name sets, falling back to the
+// current ones for keys it doesn't define.
+func profileValues(cfg *ini.File, name string) (map[string]string, error) {
+	sec, err := cfg.GetSection(profileSection(name))
+	if err != nil {
+		return nil, fmt.Errorf("no profile named %q", name)
+	}
+
+	values := map[string]string{}
+	for _, key := range profileKeys(cfg.Section(""), sec) {
+		value := cfg.Section("").Key(key).String()
+		if sec.HasKey(key) {
+			value = sec.Key(key).String()
+		}
+
+		if err := configKeys[key].validate(value); err != nil {
+			return nil, fmt.Errorf("profile %s: %s: %w", name, key, err)
+		}
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// Make name the active profile of cfg
+func useProfile(cfg *ini.File, name string) error {
+	values, err := profileValues(cfg, name)
+	if err != nil {
+		return err
+	}
+
+	root := cfg.Section("")
+	for k, v := range values {
+		root.Key(k).SetValue(v)
+	}
+	root.Key("profile").SetValue(profileName(name))
+
+	return nil
+}
+
+// Save the current labels, enabled outputs and hotkeys as profile name
+func saveProfile(cfg *ini.File, name string) error {
+	if err := validProfileName(name); err != nil {
+		return err
+	}
+
+	sec := cfg.Section(profileSection(name))
+	for _, key := range profileKeys(cfg.Section("")) {
+		sec.Key(key).SetValue(cfg.Section("").Key(key).String())
+	}
+
+	return nil
+}
+
+func deleteProfile(cfg *ini.File, name string) error {
+	if _, err := cfg.GetSection(profileSection(name)); err != nil {
+		return fmt.Errorf("no profile named %q", name)
+	}
+
+	cfg.DeleteSection(profileSection(name))
+
+	if cfg.Section("").Key("profile").String() == profileName(name) {
+		cfg.Section("").Key("profile").SetValue("")
+	}
+
+	return nil
+}
+
+// Switch the running app to profile name
+func (switcher *Switcher) useProfile(name string) error {
+	if name == "" {
+		switcher.updated["profile"] <- ""
+		return nil
+	}
+
+	values, err := profileValues(switcher.config, name)
+	if err != nil {
+		return err
+	}
+
+	Key := switcher.config.Section("").Key
+
+	var hotkeys []string
+
+	switcher.updated["profile"] <- profileName(name)
+	for key := range values {
+		if values[key] != Key(key).String() {
+			switcher.updated[key] <- values[key]
+
+			if isBindingKey(key) {
+				hotkeys = append(hotkeys, key)
+			}
+		}
+	}
+
+	for _, key := range hotkeys {
+		switcher.updated["new_hotkey"] <- key
+	}
+
+	return switcher.save()
+}
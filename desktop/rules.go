@@ -0,0 +1,458 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Rules are [rule.<name>] sections that switch output while they match
+const RULE_PREFIX = "rule."
+
+var ruleSchema = map[string]configKey{
+	"process":        {"", validPattern},
+	"window_class":   {"", validPattern},
+	"window_title":   {"", validPattern},
+	"calendar":       {"", validCalendar},
+	"event_title":    {"", validPattern},
+	"event_attendee": {"", validPattern},
+	"event_category": {"", validPattern},
+	"output":         {"", validRuleOutput},
+	"priority":       {"0", validPriority},
+	"restore":        {"true", validBool},
+}
+
+func validPattern(value string) error {
+	if _, err := regexp.Compile(value); err != nil {
+		return fmt.Errorf("%q is not a valid pattern: %w", value, err)
+	}
+	return nil
+}
+
+// Calendars are checked when the rules run, as a synced folder may not
+// exist yet
+func validCalendar(value string) error {
+	return nil
+}
+
+func validRuleOutput(value string) error {
+	if _, err := parseOrder(value); err != nil || strings.Contains(value, ",") || value == "" {
+		return fmt.Errorf("%q is not an output or mute", value)
+	}
+	return nil
+}
+
+func validPriority(value string) error {
+	if _, err := strconv.Atoi(value); err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	return nil
+}
+
+type rule struct {
+	name        string
+	output      string
+	priority    int
+	restore     bool
+	process     *regexp.Regexp
+	windowClass *regexp.Regexp
+	windowTitle *regexp.Regexp
+
+	calendar      string
+	eventTitle    *regexp.Regexp
+	eventAttendee *regexp.Regexp
+	eventCategory *regexp.Regexp
+}
+
+func (r rule) watchesWindow() bool {
+	return r.windowClass != nil || r.windowTitle != nil
+}
+
+// What the rules are matched against
+type snapshot struct {
+	processes []string
+	window    window
+
+	// Events on now, by calendar
+	events map[string][]event
+}
+
+// Only reads what the rules need
+func (switcher *Switcher) takeSnapshot(rules []rule) (snapshot, error) {
+	var snap snapshot
+	var errs []string
+
+	if slices.IndexFunc(rules, func(r rule) bool { return r.process != nil }) >= 0 {
+		var err error
+		if snap.processes, err = processes(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if slices.IndexFunc(rules, rule.watchesWindow) >= 0 {
+		var err error
+		if snap.window, err = switcher.focusedWindow(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	now := time.Now()
+	for _, r := range rules {
+		if _, ok := snap.events[r.calendar]; r.calendar == "" || ok {
+			continue
+		}
+		if snap.events == nil {
+			snap.events = map[string][]event{}
+		}
+
+		// Events that could be read still count
+		events, err := switcher.calendarEvents(r.calendar)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		snap.events[r.calendar] = eventsAt(events, now)
+	}
+
+	if len(errs) > 0 {
+		return snap, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return snap, nil
+}
+
+// Every condition a rule sets has to match
+func (r rule) matches(snap snapshot) bool {
+	if r.process == nil && !r.watchesWindow() && r.calendar == "" {
+		return false
+	}
+
+	if r.process != nil && slices.IndexFunc(snap.processes, r.process.MatchString) < 0 {
+		return false
+	}
+	if r.windowClass != nil && slices.IndexFunc(snap.window.classes, r.windowClass.MatchString) < 0 {
+		return false
+	}
+	if r.windowTitle != nil && !r.windowTitle.MatchString(snap.window.title) {
+		return false
+	}
+	if _, ok := r.event(snap); r.calendar != "" && !ok {
+		return false
+	}
+
+	return true
+}
+
+// The first event on now that matches the rule's event patterns
+func (r rule) event(snap snapshot) (event, bool) {
+	for _, e := range snap.events[r.calendar] {
+		if r.eventTitle != nil && !r.eventTitle.MatchString(e.title) {
+			continue
+		}
+		if r.eventAttendee != nil && slices.IndexFunc(e.attendees, r.eventAttendee.MatchString) < 0 {
+			continue
+		}
+		if r.eventCategory != nil && slices.IndexFunc(e.categories, r.eventCategory.MatchString) < 0 {
+			continue
+		}
+		return e, true
+	}
+	return event{}, false
+}
+
+// What a rule matched, for the log
+func (r rule) reason(snap snapshot) string {
+	var reasons []string
+	if r.watchesWindow() {
+		reasons = append(reasons, snap.window.String())
+	}
+	if e, ok := r.event(snap); ok {
+		reasons = append(reasons, fmt.Sprintf("event %q", e.title))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Patterns match whole names, ignoring case
+func compilePattern(value string) *regexp.Regexp {
+	if value == "" {
+		return nil
+	}
+	return regexp.MustCompile("^(?i:" + value + ")$")
+}
+
+// Titles and attendees are long, so their patterns match anywhere in them
+func compileTitlePattern(value string) *regexp.Regexp {
+	if value == "" {
+		return nil
+	}
+	return regexp.MustCompile("(?i:" + value + ")")
+}
+
+// The valid rules in config, skipping ones that don't validate
+func (switcher *Switcher) rules() ([]rule, []string) {
+	var rules []rule
+	var errs []string
+
+	for _, sec := range switcher.config.Sections() {
+		if !strings.HasPrefix(sec.Name(), RULE_PREFIX) {
+			continue
+		}
+
+		name := strings.TrimPrefix(sec.Name(), RULE_PREFIX)
+		value := func(key string) string {
+			if sec.HasKey(key) {
+				return sec.Key(key).String()
+			}
+			return ruleSchema[key].fallback
+		}
+
+		invalid := false
+		for key, k := range ruleSchema {
+			if err := k.validate(value(key)); err != nil {
+				errs = append(errs, fmt.Sprintf("rule %s: %s: %s", name, key, err.Error()))
+				invalid = true
+			}
+		}
+		if invalid {
+			continue
+		}
+
+		r := rule{
+			name:        name,
+			output:      strings.ToLower(value("output")),
+			process:     compilePattern(value("process")),
+			windowClass: compilePattern(value("window_class")),
+			windowTitle: compileTitlePattern(value("window_title")),
+
+			calendar:      calendarPath(value("calendar")),
+			eventTitle:    compileTitlePattern(value("event_title")),
+			eventAttendee: compileTitlePattern(value("event_attendee")),
+			eventCategory: compilePattern(value("event_category")),
+		}
+		r.priority, _ = strconv.Atoi(value("priority"))
+		r.restore, _ = strconv.ParseBool(value("restore"))
+
+		rules = append(rules, r)
+	}
+
+	return rules, errs
+}
+
+// Log a rule decision to stdout and rules.log
+func ruleLog(format string, a ...interface{}) {
+	writeLog("rules.log", "Rules", fmt.Sprintf(format, a...))
+}
+
+// Which rules match, by when they started to, and window rules that stopped
+// matching, by when they stopped
+type ruleMatches struct {
+	since   map[string]time.Time
+	leaving map[string]time.Time
+}
+
+func newRuleMatches() ruleMatches {
+	return ruleMatches{since: map[string]time.Time{}, leaving: map[string]time.Time{}}
+}
+
+// Match the rules against snap, returning the ones that started and ended
+// matching. Focus only reaches the rules once it settles, and a window rule
+// also has to stop matching for hold before it ends, so a quick look at
+// another window doesn't switch back and forth.
+func (m ruleMatches) update(rules []rule, snap snapshot, now time.Time, hold time.Duration) (started, ended []rule) {
+	for _, r := range rules {
+		_, was := m.since[r.name]
+
+		if r.matches(snap) {
+			delete(m.leaving, r.name)
+			if !was {
+				m.since[r.name] = now
+				started = append(started, r)
+			}
+			continue
+		}
+
+		if !was {
+			continue
+		}
+
+		if r.watchesWindow() {
+			left, ok := m.leaving[r.name]
+			if !ok {
+				m.leaving[r.name], left = now, now
+			}
+			if now.Sub(left) < hold {
+				continue
+			}
+		}
+
+		delete(m.since, r.name)
+		delete(m.leaving, r.name)
+		ended = append(ended, r)
+	}
+
+	// Forget rules that were removed from config
+	for name := range m.since {
+		if slices.IndexFunc(rules, func(r rule) bool { return r.name == name }) < 0 {
+			delete(m.since, name)
+			delete(m.leaving, name)
+		}
+	}
+
+	return started, ended
+}
+
+// The matching rule that wins. Higher priorities win, then the rule that
+// matched most recently.
+func pickRule(rules []rule, since map[string]time.Time) (rule, []rule, bool) {
+	var active []rule
+	for _, r := range rules {
+		if _, ok := since[r.name]; ok {
+			active = append(active, r)
+		}
+	}
+
+	if len(active) == 0 {
+		return rule{}, nil, false
+	}
+
+	slices.SortFunc(active, func(a, b rule) bool {
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if !since[a.name].Equal(since[b.name]) {
+			return since[a.name].After(since[b.name])
+		}
+		return a.name < b.name
+	})
+
+	return active[0], active[1:], true
+}
+
+func (switcher *Switcher) applyRuleOutput(output string) error {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	if output == MUTE_STEP {
+		if cur != switcher.muted() {
+			switcher.muteToggle(false)
+		}
+		return nil
+	}
+
+	x, _ := strconv.Atoi(output)
+	if x-1 == cur {
+		return nil
+	}
+	return switcher.selectOutput(x-1, false)
+}
+
+func (switcher *Switcher) restoreFromRule(r rule, x int) error {
+	cur, _ := switcher.config.Section("").Key("current_output").Int()
+
+	// Undo a mute rule even if switching doesn't unmute
+	if r.output == MUTE_STEP && cur == switcher.muted() {
+		return switcher.unmuteTo(x, false)
+	}
+	return switcher.selectOutput(x, false)
+}
+
+// Poll the rules, switching to the output of the winning rule and back
+// once no rule matches. Focus changes are checked as soon as they settle.
+func (switcher *Switcher) runRules() {
+	matches := newRuleMatches()
+	reported := ""
+
+	var winner *rule
+	var restore int
+
+	for {
+		interval, err := time.ParseDuration(switcher.config.Section("").Key("rules_interval").String())
+		if err != nil {
+			interval = 2 * time.Second
+		}
+		// Focus changes are checked straight away
+		select {
+		case <-time.After(interval):
+		case <-switcher.updated["rules"]:
+		}
+
+		rules, errs := switcher.rules()
+
+		if len(rules) == 0 && winner == nil {
+			continue
+		}
+
+		// Rules that can't be checked just don't match
+		snap, err := switcher.takeSnapshot(rules)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		if msg := strings.Join(errs, "\n"); msg != reported {
+			reported = msg
+			if msg != "" {
+				fmt.Printf("Error: rules: %s\n", msg)
+				utils.Alert("Rule error!", msg, 2)
+			}
+		}
+
+		started, ended := matches.update(rules, snap, time.Now(), switcher.focusDelay())
+		for _, r := range started {
+			if reason := r.reason(snap); reason != "" {
+				ruleLog("rule %s matched %s", r.name, reason)
+			} else {
+				ruleLog("rule %s matched", r.name)
+			}
+		}
+		for _, r := range ended {
+			ruleLog("rule %s no longer matches", r.name)
+		}
+
+		dryRun := switcher.config.Section("").Key("rules_dry_run").MustBool(false)
+		note := ""
+		if dryRun {
+			note = " (dry run, not switching)"
+		}
+
+		next, beaten, ok := pickRule(rules, matches.since)
+
+		switch {
+		case ok && (winner == nil || winner.name != next.name || winner.output != next.output):
+			if winner == nil {
+				restore, _ = switcher.config.Section("").Key("current_output").Int()
+				if restore == switcher.muted() {
+					restore = switcher.prevOutput
+				}
+			}
+
+			ruleLog("rule %s (priority %d) fired: output %s%s", next.name, next.priority, next.output, note)
+			for _, r := range beaten {
+				ruleLog("  rule %s (priority %d) also matches, output %s ignored", r.name, r.priority, r.output)
+			}
+
+			winner = &next
+			if !dryRun {
+				if err := switcher.applyRuleOutput(next.output); err != nil {
+					utils.Alert("Error!", fmt.Sprintf("Rule %s: %s", next.name, err.Error()), 1)
+				}
+			}
+
+		case !ok && winner != nil:
+			if winner.restore {
+				ruleLog("rule %s ended, restoring output %d%s", winner.name, restore+1, note)
+				if !dryRun {
+					if err := switcher.restoreFromRule(*winner, restore); err != nil {
+						utils.Alert("Error!", fmt.Sprintf("Rule %s: %s", winner.name, err.Error()), 1)
+					}
+				}
+			} else {
+				ruleLog("rule %s ended", winner.name)
+			}
+
+			winner = nil
+		}
+	}
+}
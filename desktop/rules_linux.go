@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Names of running processes from /proc, both the kernel's name and the
+// program they were started as, which isn't cut off at 15 characters
+func processes() ([]string, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+
+		// Processes can exit while we read them
+		if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			names = append(names, strings.TrimSpace(string(comm)))
+		}
+
+		if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+			argv0, _, _ := bytes.Cut(cmdline, []byte{0})
+			names = append(names, filepath.Base(string(argv0)))
+		}
+	}
+
+	return names, nil
+}
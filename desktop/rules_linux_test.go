@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+// This test is a running process too
+func TestProcesses(t *testing.T) {
+	names, err := processes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if self := filepath.Base(os.Args[0]); !slices.Contains(names, self) {
+		t.Errorf("%s isn't in %d processes", self, len(names))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func processes() ([]string, error) {
+	return nil, fmt.Errorf("process rules are only supported on Linux")
+}
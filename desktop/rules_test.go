@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessRuleMatches(t *testing.T) {
+	running := snapshot{processes: []string{"systemd", "obs", "zoom.real", "gnome-shell"}}
+
+	tests := []struct {
+		name    string
+		process string
+		want    bool
+	}{
+		{"name", "obs", true},
+		{"ignores case", "OBS", true},
+		{"whole names only", "gnome", false},
+		{"pattern", "zoom(\\.real)?", true},
+		{"either", "discord|obs", true},
+		{"not running", "discord", false},
+	}
+
+	for _, test := range tests {
+		r := rule{process: compilePattern(test.process)}
+		if got := r.matches(running); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Every condition a rule sets has to match
+	both := rule{process: compilePattern("obs"), windowClass: compilePattern("zoom")}
+	if both.matches(running) {
+		t.Errorf("matched without the window")
+	}
+	running.window = window{classes: []string{"zoom"}}
+	if !both.matches(running) {
+		t.Errorf("didn't match with the window")
+	}
+}
+
+func TestPickRule(t *testing.T) {
+	start := time.Now()
+	rules := []rule{
+		{name: "obs", priority: 1},
+		{name: "zoom", priority: 5},
+		{name: "music", priority: 1},
+		{name: "game", priority: 1},
+	}
+
+	tests := []struct {
+		name   string
+		since  map[string]time.Duration
+		winner string
+		beaten string
+	}{
+		{"none match", map[string]time.Duration{}, "", ""},
+		{"only one", map[string]time.Duration{"obs": 0}, "obs", ""},
+		{"higher priority", map[string]time.Duration{"obs": time.Second, "zoom": 0}, "zoom", "obs"},
+		{"then the most recent", map[string]time.Duration{"obs": 0, "music": time.Second}, "music", "obs"},
+		{"then by name", map[string]time.Duration{"obs": 0, "music": 0, "game": 0}, "game", "music, obs"},
+	}
+
+	for _, test := range tests {
+		since := map[string]time.Time{}
+		for name, d := range test.since {
+			since[name] = start.Add(d)
+		}
+
+		winner, beaten, ok := pickRule(rules, since)
+
+		var names []string
+		for _, r := range beaten {
+			names = append(names, r.name)
+		}
+		if ok != (test.winner != "") || winner.name != test.winner || strings.Join(names, ", ") != test.beaten {
+			t.Errorf("%s: got %q over %v, want %q over %q", test.name, winner.name, names, test.winner, test.beaten)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	switcher := testSwitcher(t, `outputs = 2
+dbus = false
+
+[rule.stream]
+process = obs
+output = 2
+priority = 3
+restore = false
+
+[rule.quiet]
+process = zoom
+output = Mute
+
+[rule.badpattern]
+process = (obs
+output = 1
+
+[rule.nooutput]
+process = obs
+
+[rule.twooutputs]
+process = obs
+output = 1, 2
+`)
+	settle(switcher)
+
+	rules, errs := switcher.rules()
+
+	got := map[string]rule{}
+	for _, r := range rules {
+		got[r.name] = r
+	}
+
+	if r := got["stream"]; r.output != "2" || r.priority != 3 || r.restore {
+		t.Errorf("stream: got output %s, priority %d, restore %v", r.output, r.priority, r.restore)
+	}
+	if r := got["quiet"]; r.output != MUTE_STEP || r.priority != 0 || !r.restore {
+		t.Errorf("quiet: got output %s, priority %d, restore %v", r.output, r.priority, r.restore)
+	}
+	if len(got) != 2 {
+		t.Errorf("got rules %v, want only the valid ones", got)
+	}
+
+	for _, name := range []string{"badpattern", "nooutput", "twooutputs"} {
+		found := false
+		for _, err := range errs {
+			found = found || strings.HasPrefix(err, "rule "+name+": ")
+		}
+		if !found {
+			t.Errorf("no error for rule %s in %q", name, errs)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"golang.org/x/exp/slices"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Schedules are [schedule.<name>] sections that run an action at set times
+const SCHEDULE_PREFIX = "schedule."
+
+const (
+	// A run this late was missed, e.g. while the computer was asleep
+	SCHEDULE_GRACE = time.Minute
+
+	// Timers don't count time spent asleep, so the clock is checked at least
+	// this often
+	SCHEDULE_TICK = 30 * time.Second
+
+	// When each schedule last ran, next to config.ini
+	SCHEDULE_RUNS = "schedules.json"
+)
+
+// What to do about runs that were missed
+var missedPolicies = []string{"skip", "run"}
+
+var scheduleSchema = map[string]configKey{
+	"cron":   {"", validCron},
+	"action": {"", validScheduleAction},
+	"missed": {"skip", validMissed},
+}
+
+func validCron(value string) error {
+	if _, err := cron.ParseStandard(value); err != nil {
+		return fmt.Errorf("%q is not a cron expression: %w", value, err)
+	}
+	return nil
+}
+
+func validScheduleAction(value string) error {
+	if value == "" {
+		return fmt.Errorf("no action")
+	}
+	return validAction(value)
+}
+
+func validMissed(value string) error {
+	if !slices.Contains(missedPolicies, value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(missedPolicies, ", "))
+	}
+	return nil
+}
+
+type schedule struct {
+	name   string
+	spec   string
+	action string
+	missed string
+	cron   cron.Schedule
+}
+
+// When a schedule last ran, or was first seen, with the expression it ran
+// by. Runs missed while the app was closed are caught up from there.
+type scheduleRun struct {
+	Spec string    `json:"spec"`
+	Last time.Time `json:"last"`
+}
+
+func scheduleRunsPath() string {
+	return filepath.Join(filepath.Dir(utils.ConfigPath()), SCHEDULE_RUNS)
+}
+
+func readScheduleRuns() map[string]scheduleRun {
+	runs := map[string]scheduleRun{}
+	if data, err := os.ReadFile(scheduleRunsPath()); err == nil {
+		json.Unmarshal(data, &runs)
+	}
+	return runs
+}
+
+func writeScheduleRuns(runs map[string]scheduleRun) error {
+	data, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written aside and moved into place, so a crash can't leave half a file
+	tmp := scheduleRunsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, scheduleRunsPath())
+}
+
+// When a schedule is first due. Carrying on from the last run means a run
+// missed while the app was closed is due straight away, unless the
+// expression changed since.
+func (s schedule) firstDue(last scheduleRun, now time.Time) time.Time {
+	if last.Spec == s.spec && !last.Last.IsZero() {
+		return s.cron.Next(last.Last)
+	}
+	return s.cron.Next(now)
+}
+
+// Whether a run that was due at was missed, and if so whether the missed
+// policy still makes it
+func (s schedule) catchUp(at, now time.Time) (missed bool, run bool) {
+	if now.Sub(at) <= SCHEDULE_GRACE {
+		return false, true
+	}
+	return true, s.missed == "run"
+}
+
+// The valid schedules in config, skipping ones that don't validate
+func (switcher *Switcher) schedules() ([]schedule, []string) {
+	var schedules []schedule
+	var errs []string
+
+	for _, sec := range switcher.config.Sections() {
+		if !strings.HasPrefix(sec.Name(), SCHEDULE_PREFIX) {
+			continue
+		}
+
+		name := strings.TrimPrefix(sec.Name(), SCHEDULE_PREFIX)
+		value := func(key string) string {
+			if sec.HasKey(key) {
+				return sec.Key(key).String()
+			}
+			return scheduleSchema[key].fallback
+		}
+
+		invalid := false
+		for key, k := range scheduleSchema {
+			if err := k.validate(value(key)); err != nil {
+				errs = append(errs, fmt.Sprintf("schedule %s: %s: %s", name, key, err.Error()))
+				invalid = true
+			}
+		}
+		if invalid {
+			continue
+		}
+
+		s := schedule{
+			name:   name,
+			spec:   value("cron"),
+			action: value("action"),
+			missed: value("missed"),
+		}
+		s.cron, _ = cron.ParseStandard(s.spec)
+
+		schedules = append(schedules, s)
+	}
+
+	slices.SortFunc(schedules, func(a, b schedule) bool { return a.name < b.name })
+
+	return schedules, errs
+}
+
+// The schedule that runs next, and when
+func (switcher *Switcher) nextSchedule() (schedule, time.Time, bool) {
+	schedules, _ := switcher.schedules()
+
+	var next schedule
+	var at time.Time
+
+	now := time.Now()
+	for _, s := range schedules {
+		t := s.cron.Next(now)
+		if !t.IsZero() && (at.IsZero() || t.Before(at)) {
+			next, at = s, t
+		}
+	}
+
+	return next, at, !at.IsZero()
+}
+
+// The next run for the tray, e.g. "Next: Mute at 23:00"
+func (switcher *Switcher) scheduleStatus() (string, bool) {
+	s, at, ok := switcher.nextSchedule()
+	if !ok {
+		return "", false
+	}
+
+	var what string
+	if x, ok := outputAction(s.action); ok {
+		what = fmt.Sprintf("Switch to %s", switcher.label(x))
+	} else {
+		what = map[string]string{"mute_on": "Mute", "mute_off": "Unmute"}[s.action]
+		if what == "" {
+			what = fmt.Sprintf("Run %s", s.action)
+		}
+	}
+
+	now := time.Now()
+	when := at.Format("15:04")
+	if at.Format("2006-01-02") != now.Format("2006-01-02") {
+		when = at.Format("Mon 15:04")
+		if at.Sub(now) > 6*24*time.Hour {
+			when = at.Format("Jan 2 15:04")
+		}
+	}
+
+	return fmt.Sprintf("Next: %s at %s", what, when), true
+}
+
+// Run each schedule's action when it comes up, the same way the tray would.
+// Runs missed while asleep or closed are either skipped or run once on
+// waking.
+func (switcher *Switcher) runSchedules() {
+	// When each schedule runs next, and the expression that was worked out
+	// from, by name
+	due := map[string]time.Time{}
+	specs := map[string]string{}
+
+	runs := readScheduleRuns()
+
+	reported := ""
+
+	for {
+		schedules, errs := switcher.schedules()
+
+		if msg := strings.Join(errs, "\n"); msg != reported {
+			reported = msg
+			if msg != "" {
+				fmt.Printf("Error: schedules: %s\n", msg)
+				utils.Alert("Schedule error!", msg, 2)
+			}
+		}
+
+		now := time.Now()
+		ran := false
+		changed := false
+
+		for _, s := range schedules {
+			if specs[s.name] != s.spec {
+				specs[s.name] = s.spec
+				due[s.name] = s.firstDue(runs[s.name], now)
+
+				// New and changed schedules count from now
+				if runs[s.name].Spec != s.spec {
+					runs[s.name] = scheduleRun{s.spec, now}
+					changed = true
+				}
+			}
+
+			at := due[s.name]
+			if at.IsZero() || now.Before(at) {
+				continue
+			}
+
+			// Runs missed in a row only count once
+			due[s.name] = s.cron.Next(now)
+			runs[s.name] = scheduleRun{s.spec, now}
+			ran, changed = true, true
+
+			if missed, run := s.catchUp(at, now); !run {
+				fmt.Printf("Schedule %s: skipped the run missed at %s\n", s.name, at.Format(time.RFC3339))
+				continue
+			} else if missed {
+				fmt.Printf("Schedule %s: running the run missed at %s\n", s.name, at.Format(time.RFC3339))
+			}
+
+			fmt.Printf("Schedule %s: %s\n", s.name, s.action)
+			if err := switcher.run(s.action); err != nil {
+				utils.Alert("Error!", fmt.Sprintf("Schedule %s: %s", s.name, err.Error()), 1)
+			}
+		}
+
+		// Forget schedules that were removed from config
+		for name := range specs {
+			if slices.IndexFunc(schedules, func(s schedule) bool { return s.name == name }) < 0 {
+				delete(specs, name)
+				delete(due, name)
+			}
+		}
+		for name := range runs {
+			if slices.IndexFunc(schedules, func(s schedule) bool { return s.name == name }) < 0 {
+				delete(runs, name)
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := writeScheduleRuns(runs); err != nil {
+				fmt.Printf("Error: could not save when schedules ran: %s\n", err.Error())
+			}
+		}
+
+		if ran {
+			switcher.refreshTray("schedule")
+		}
+
+		wait := SCHEDULE_TICK
+		for _, at := range due {
+			if d := time.Until(at); !at.IsZero() && d < wait {
+				wait = d
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-switcher.updated["schedule"]:
+			switcher.refreshTray("schedule")
+		}
+	}
+}
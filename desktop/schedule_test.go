@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func testSchedule(t *testing.T, spec, missed string) schedule {
+	t.Helper()
+
+	c, err := cron.ParseStandard(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule{name: "test", spec: spec, action: "mute_on", missed: missed, cron: c}
+}
+
+// Nightly at 23:00, with the app started again at 09:00 the next morning
+func TestScheduleFirstDue(t *testing.T) {
+	s := testSchedule(t, "0 23 * * *", "run")
+	now := time.Date(2024, 5, 2, 9, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		last scheduleRun
+		want time.Time
+	}{
+		{"never ran", scheduleRun{}, time.Date(2024, 5, 2, 23, 0, 0, 0, time.Local)},
+		{"closed over a run", scheduleRun{"0 23 * * *", time.Date(2024, 5, 1, 8, 0, 0, 0, time.Local)}, time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)},
+		{"closed over many runs", scheduleRun{"0 23 * * *", time.Date(2024, 4, 20, 8, 0, 0, 0, time.Local)}, time.Date(2024, 4, 20, 23, 0, 0, 0, time.Local)},
+		{"nothing missed", scheduleRun{"0 23 * * *", time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)}, time.Date(2024, 5, 2, 23, 0, 0, 0, time.Local)},
+		{"cron changed", scheduleRun{"0 22 * * *", time.Date(2024, 4, 20, 8, 0, 0, 0, time.Local)}, time.Date(2024, 5, 2, 23, 0, 0, 0, time.Local)},
+	}
+
+	for _, test := range tests {
+		if got := s.firstDue(test.last, now); !got.Equal(test.want) {
+			t.Errorf("%s: due %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	at := time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		missed    string
+		late      time.Duration
+		wasMissed bool
+		run       bool
+	}{
+		{"skip", 0, false, true},
+		{"skip", SCHEDULE_GRACE, false, true},
+		{"skip", SCHEDULE_GRACE + time.Second, true, false},
+		{"skip", 10 * time.Hour, true, false},
+		{"run", SCHEDULE_GRACE + time.Second, true, true},
+		{"run", 10 * time.Hour, true, true},
+	}
+
+	for _, test := range tests {
+		s := testSchedule(t, "0 23 * * *", test.missed)
+		missed, run := s.catchUp(at, at.Add(test.late))
+		if missed != test.wasMissed || run != test.run {
+			t.Errorf("missed = %s, %s late: got missed %v, run %v, want %v, %v", test.missed, test.late, missed, run, test.wasMissed, test.run)
+		}
+	}
+}
+
+// The last runs survive a restart
+func TestScheduleRunsRoundTrip(t *testing.T) {
+	t.Setenv("SOUNDBRICK_CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	if runs := readScheduleRuns(); len(runs) != 0 {
+		t.Errorf("got %v before any were written", runs)
+	}
+
+	last := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	runs := map[string]scheduleRun{"quiet": {"0 23 * * *", last}}
+	if err := writeScheduleRuns(runs); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readScheduleRuns()["quiet"]
+	if got.Spec != "0 23 * * *" || !got.Last.Equal(last) {
+		t.Errorf("got %+v back, want %+v", got, runs["quiet"])
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"golang.org/x/exp/slices"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+const (
+	// Scripts are the .star files in this directory next to the config
+	SCRIPTS_DIR = "scripts"
+
+	// How often the scripts are checked for changes
+	SCRIPTS_POLL = time.Second
+
+	// Each run of a script or callback is stopped after this many steps, so
+	// a loop can't hang the app
+	SCRIPT_STEPS = 10_000_000
+
+	// Timers can't run more often than this
+	MIN_SCRIPT_INTERVAL = 100 * time.Millisecond
+)
+
+// What scripts pass to on(), for each kind of change
+var scriptEvents = map[string]string{
+	CHANGE_OUTPUT:     "output_changed",
+	CHANGE_MUTE:       "muted",
+	CHANGE_UNMUTE:     "unmuted",
+	CHANGE_CONNECT:    "connected",
+	CHANGE_DISCONNECT: "disconnected",
+}
+
+var scriptOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+}
+
+type script struct {
+	name     string
+	handlers map[string][]starlark.Callable
+
+	// Globals are frozen once a script has run, so callbacks keep what they
+	// need between calls here
+	store *starlark.Dict
+
+	// Only the first failing callback is alerted, the rest are logged
+	alerted bool
+}
+
+type scriptTimer struct {
+	timer  *time.Timer
+	script *script
+	fn     starlark.Callable
+	every  time.Duration
+}
+
+// Runs every script and callback, one at a time
+type scriptEngine struct {
+	switcher *Switcher
+	scripts  []*script
+
+	timers map[int]*scriptTimer
+	nextID int
+
+	// Timers hand their callbacks to the engine through calls
+	calls chan func()
+}
+
+func scriptsDir() string {
+	return filepath.Join(filepath.Dir(utils.ConfigPath()), SCRIPTS_DIR)
+}
+
+func scriptFiles() []string {
+	files, _ := filepath.Glob(filepath.Join(scriptsDir(), "*.star"))
+	slices.Sort(files)
+	return files
+}
+
+// Changes when a script is added, removed or edited
+func scriptsStamp() string {
+	var parts []string
+	for _, file := range scriptFiles() {
+		if info, err := os.Stat(file); err == nil {
+			parts = append(parts, fmt.Sprintf("%s %d %d", file, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func scriptLog(format string, a ...interface{}) {
+	writeLog("scripts.log", "Scripts", fmt.Sprintf(format, a...))
+}
+
+// Run the scripts, loading them again when they change or the tray asks
+func (switcher *Switcher) runScripts() {
+	engine := &scriptEngine{
+		switcher: switcher,
+		timers:   map[int]*scriptTimer{},
+		calls:    make(chan func(), 16),
+	}
+
+	changes := switcher.subscribe()
+	poll := time.NewTicker(SCRIPTS_POLL)
+
+	stamp := scriptsStamp()
+	engine.load()
+
+	for {
+		select {
+		case c := <-changes:
+			engine.emit(c)
+
+		case call := <-engine.calls:
+			call()
+
+		case <-switcher.updated["scripts"]:
+			stamp = scriptsStamp()
+			engine.load()
+
+		case <-poll.C:
+			if s := scriptsStamp(); s != stamp {
+				stamp = s
+				engine.load()
+			}
+		}
+	}
+}
+
+// Stop everything the old scripts started and run them all again
+func (engine *scriptEngine) load() {
+	for id, t := range engine.timers {
+		t.timer.Stop()
+		delete(engine.timers, id)
+	}
+	engine.scripts = nil
+
+	files := scriptFiles()
+
+	var errs []string
+	for _, file := range files {
+		s := &script{
+			name:     strings.TrimSuffix(filepath.Base(file), ".star"),
+			handlers: map[string][]starlark.Callable{},
+			store:    starlark.NewDict(0),
+		}
+
+		thread := engine.thread(s)
+		if _, err := starlark.ExecFileOptions(scriptOptions, thread, file, nil, engine.builtins(s)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.name, scriptError(err)))
+			engine.stopTimers(s)
+			continue
+		}
+
+		engine.scripts = append(engine.scripts, s)
+	}
+
+	if len(files) > 0 {
+		scriptLog("loaded %d of %d scripts", len(engine.scripts), len(files))
+	}
+
+	if len(errs) > 0 {
+		msg := strings.Join(errs, "\n")
+		scriptLog("%s", msg)
+		utils.Alert("Script error!", msg, 2)
+	}
+}
+
+func scriptError(err error) string {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return evalErr.Backtrace()
+	}
+	return err.Error()
+}
+
+func (engine *scriptEngine) thread(s *script) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: s.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			scriptLog("%s: %s", s.name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(SCRIPT_STEPS)
+	return thread
+}
+
+func (engine *scriptEngine) call(s *script, fn starlark.Callable, args ...starlark.Value) {
+	if _, err := starlark.Call(engine.thread(s), fn, args, nil); err != nil {
+		scriptLog("%s: %s", s.name, scriptError(err))
+
+		if !s.alerted {
+			s.alerted = true
+			utils.Alert("Script error!", fmt.Sprintf("%s: %s", s.name, err.Error()), 2)
+		}
+	}
+}
+
+// Pass a change to the handlers registered for it
+func (engine *scriptEngine) emit(c stateChange) {
+	name := scriptEvents[c.kind]
+
+	ev := starlark.NewDict(5)
+	ev.SetKey(starlark.String("event"), starlark.String(name))
+	ev.SetKey(starlark.String("output"), engine.outputValue(c.output))
+	ev.SetKey(starlark.String("label"), starlark.String(engine.switcher.outputLabel(c.output)))
+	ev.SetKey(starlark.String("previous"), engine.outputValue(c.previous))
+	ev.SetKey(starlark.String("previous_label"), starlark.String(engine.switcher.outputLabel(c.previous)))
+	ev.Freeze()
+
+	for _, s := range engine.scripts {
+		for _, fn := range s.handlers[name] {
+			engine.call(s, fn, ev)
+		}
+	}
+}
+
+// Outputs count from 1 in scripts, with None for mute
+func (engine *scriptEngine) outputValue(x int) starlark.Value {
+	if !engine.switcher.isOutput(x) {
+		return starlark.None
+	}
+	return starlark.MakeInt(x + 1)
+}
+
+func (engine *scriptEngine) state() starlark.Value {
+	switcher := engine.switcher
+	Key := switcher.config.Section("").Key
+
+	cur, _ := Key("current_output").Int()
+
+	labels := make([]starlark.Value, switcher.outputCount())
+	enabled := make([]starlark.Value, switcher.outputCount())
+	for i, state := range switcher.enabled() {
+		labels[i] = starlark.String(switcher.label(i))
+		enabled[i] = starlark.Bool(state == "ON")
+	}
+
+	state := starlark.NewDict(7)
+	state.SetKey(starlark.String("output"), engine.outputValue(cur))
+	state.SetKey(starlark.String("muted"), starlark.Bool(cur == switcher.muted()))
+	state.SetKey(starlark.String("label"), starlark.String(switcher.outputLabel(cur)))
+	state.SetKey(starlark.String("outputs"), starlark.MakeInt(switcher.outputCount()))
+	state.SetKey(starlark.String("labels"), starlark.NewList(labels))
+	state.SetKey(starlark.String("enabled"), starlark.NewList(enabled))
+	state.SetKey(starlark.String("profile"), starlark.String(Key("profile").String()))
+	return state
+}
+
+func (engine *scriptEngine) startTimer(s *script, d time.Duration, fn starlark.Callable, repeat bool) int {
+	engine.nextID++
+	id := engine.nextID
+
+	t := &scriptTimer{script: s, fn: fn}
+	if repeat {
+		t.every = d
+	}
+
+	var fire func()
+	fire = func() {
+		engine.calls <- func() {
+			// Cancelled or reloaded while waiting
+			if engine.timers[id] != t {
+				return
+			}
+
+			if t.every > 0 {
+				t.timer = time.AfterFunc(t.every, fire)
+			} else {
+				delete(engine.timers, id)
+			}
+
+			engine.call(s, fn)
+		}
+	}
+
+	t.timer = time.AfterFunc(d, fire)
+	engine.timers[id] = t
+
+	return id
+}
+
+func (engine *scriptEngine) stopTimers(s *script) {
+	for id, t := range engine.timers {
+		if t.script == s {
+			t.timer.Stop()
+			delete(engine.timers, id)
+		}
+	}
+}
+
+// The SoundBrick API a script sees
+func (engine *scriptEngine) builtins(s *script) starlark.StringDict {
+	switcher := engine.switcher
+
+	action := func(name string, run func(args starlark.Tuple, kwargs []starlark.Tuple) error) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := run(args, kwargs); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.Name(), err)
+			}
+			return starlark.None, nil
+		})
+	}
+
+	seconds := func(value starlark.Value) (time.Duration, error) {
+		f, ok := starlark.AsFloat(value)
+		if !ok {
+			return 0, fmt.Errorf("got %s, want a number of seconds", value.Type())
+		}
+		d := time.Duration(f * float64(time.Second))
+		if d < MIN_SCRIPT_INTERVAL {
+			d = MIN_SCRIPT_INTERVAL
+		}
+		return d, nil
+	}
+
+	timer := func(name string, repeat bool) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var delay starlark.Value
+			var fn starlark.Callable
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &delay, &fn); err != nil {
+				return nil, err
+			}
+
+			d, err := seconds(delay)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", b.Name(), err)
+			}
+
+			return starlark.MakeInt(engine.startTimer(s, d, fn, repeat)), nil
+		})
+	}
+
+	return starlark.StringDict{
+		"switch": action("switch", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var n int
+			if err := starlark.UnpackPositionalArgs("switch", args, kwargs, 1, &n); err != nil {
+				return err
+			}
+			return switcher.selectOutput(n-1, false)
+		}),
+
+		"mute": action("mute", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackPositionalArgs("mute", args, kwargs, 0); err != nil {
+				return err
+			}
+			return switcher.run("mute_on")
+		}),
+
+		"unmute": action("unmute", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackPositionalArgs("unmute", args, kwargs, 0); err != nil {
+				return err
+			}
+			return switcher.run("mute_off")
+		}),
+
+		"run": action("run", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var name string
+			if err := starlark.UnpackPositionalArgs("run", args, kwargs, 1, &name); err != nil {
+				return err
+			}
+			if err := validAction(name); err != nil {
+				return err
+			}
+			return switcher.run(name)
+		}),
+
+		"state": starlark.NewBuiltin("state", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+				return nil, err
+			}
+			return engine.state(), nil
+		}),
+
+		"on": starlark.NewBuiltin("on", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var fn starlark.Callable
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &name, &fn); err != nil {
+				return nil, err
+			}
+
+			var names []string
+			for _, event := range scriptEvents {
+				names = append(names, event)
+			}
+			if !slices.Contains(names, name) {
+				slices.Sort(names)
+				return nil, fmt.Errorf("on: unknown event %q, want one of %s", name, strings.Join(names, ", "))
+			}
+
+			s.handlers[name] = append(s.handlers[name], fn)
+			return starlark.None, nil
+		}),
+
+		"after": timer("after", false),
+		"every": timer("every", true),
+
+		"cancel": starlark.NewBuiltin("cancel", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var id int
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &id); err != nil {
+				return nil, err
+			}
+
+			if t, ok := engine.timers[id]; ok && t.script == s {
+				t.timer.Stop()
+				delete(engine.timers, id)
+			}
+			return starlark.None, nil
+		}),
+
+		"store": s.store,
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestScriptBuiltins(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 3\ncurrent_output = 0\noutput1 = Speakers\nenabled = ON, OFF, ON\ndbus = false\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 3))
+
+	engine := &scriptEngine{switcher: switcher, timers: map[int]*scriptTimer{}}
+	s := &script{name: "test", handlers: map[string][]starlark.Callable{}, store: starlark.NewDict(0)}
+
+	// Each sets result, or fails with err
+	tests := []struct {
+		src    string
+		result string
+		err    string
+	}{
+		{`result = state()["outputs"]`, "3", ""},
+		{`result = state()["labels"]`, `["Speakers", "Output 2", "Output 3"]`, ""},
+		{`result = state()["enabled"]`, "[True, False, True]", ""},
+		{`result = (state()["output"], state()["label"])`, `(1, "Speakers")`, ""},
+		{`switch(2); result = state()["output"]`, "2", ""},
+		{`mute(); result = (state()["output"], state()["muted"], state()["label"])`, `(None, True, "Muted")`, ""},
+		{`unmute(); result = state()["output"]`, "2", ""},
+		{`run("output3"); result = state()["output"]`, "3", ""},
+		{`run("dance")`, "", `run: unknown action "dance"`},
+		{`switch("two")`, "", "switch: for parameter 1: got string, want int"},
+		{`on("bogus", print)`, "", `on: unknown event "bogus"`},
+		{`after("soon", print)`, "", "after: got string, want a number of seconds"},
+		{`store["n"] = 1; result = store["n"]`, "1", ""},
+		// Callbacks keep what they need between calls in store
+		{`def f(ev): store["last"] = ev["label"]
+on("output_changed", f)`, "", ""},
+		{`result = cancel(every(1, print))`, "None", ""},
+		{`while True: pass`, "", "too many steps"},
+	}
+
+	for _, test := range tests {
+		globals, err := starlark.ExecFileOptions(scriptOptions, engine.thread(s), "test.star", test.src, engine.builtins(s))
+		settle(switcher)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.src, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.src, err)
+			continue
+		}
+		if test.result != "" && globals["result"].String() != test.result {
+			t.Errorf("%s: got %s, want %s", test.src, globals["result"], test.result)
+		}
+	}
+
+	if len(engine.timers) != 0 {
+		t.Errorf("cancelled timer is still running")
+	}
+
+	engine.scripts = []*script{s}
+	engine.emit(stateChange{CHANGE_OUTPUT, 0, 2})
+	if last, _, _ := s.store.Get(starlark.String("last")); last != starlark.String("Speakers") {
+		t.Errorf("handler stored %v, want Speakers", last)
+	}
+}
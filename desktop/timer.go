@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+const (
+	DEFAULT_EXTEND = 10 * time.Minute
+
+	// How often the remaining time in the tray is updated
+	TIMER_TICK = 30 * time.Second
+)
+
+func validTime(value string) error {
+	if _, err := time.Parse(time.RFC3339, value); value != "" && err != nil {
+		return fmt.Errorf("%q is not an RFC 3339 time", value)
+	}
+	return nil
+}
+
+func validDuration(value string) error {
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		return fmt.Errorf("%q is not a duration such as 20m or 1h30m", value)
+	}
+	return nil
+}
+
+func validRevertOutput(value string) error {
+	if value == "" {
+		return nil
+	}
+	return validOutput(value)
+}
+
+// The output to go back to and when, if a timed switch is running
+func (switcher *Switcher) revertTimer() (int, time.Time, bool) {
+	Key := switcher.config.Section("").Key
+	return parseRevertTimer(Key("revert_output").String(), Key("revert_at").String())
+}
+
+func parseRevertTimer(output, deadline string) (int, time.Time, bool) {
+	x, err := strconv.Atoi(output)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	at, err := time.Parse(time.RFC3339, deadline)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	return x, at, true
+}
+
+// runTimer is handed the timer as well, since it can't read config while
+// importConfig writes it
+func (switcher *Switcher) setRevertTimer(x string, at string) error {
+	switcher.updated["revert_output"] <- x
+	switcher.updated["revert_at"] <- at
+	switcher.updated["timer"] <- x + " " + at
+	return switcher.save()
+}
+
+// Switch to x for d, then go back to the current output. Starting another
+// timed switch keeps the output of the first to go back to.
+func (switcher *Switcher) switchFor(x int, d time.Duration) error {
+	back, _ := switcher.config.Section("").Key("current_output").Int()
+	if back == switcher.muted() {
+		back = switcher.prevOutput
+	}
+	if prev, _, ok := switcher.revertTimer(); ok {
+		back = prev
+	}
+
+	if err := switcher.selectOutput(x, false); err != nil {
+		return err
+	}
+
+	return switcher.setRevertTimer(strconv.Itoa(back), time.Now().Add(d).Format(time.RFC3339))
+}
+
+func (switcher *Switcher) extendTimer(d time.Duration) error {
+	x, at, ok := switcher.revertTimer()
+	if !ok {
+		return fmt.Errorf("no timed switch is running")
+	}
+
+	return switcher.setRevertTimer(strconv.Itoa(x), at.Add(d).Format(time.RFC3339))
+}
+
+func (switcher *Switcher) cancelTimer() error {
+	if _, _, ok := switcher.revertTimer(); !ok {
+		return fmt.Errorf("no timed switch is running")
+	}
+
+	return switcher.setRevertTimer("", "")
+}
+
+func (switcher *Switcher) extendBy() time.Duration {
+	d, err := time.ParseDuration(switcher.config.Section("").Key("timer_extend").String())
+	if err != nil {
+		return DEFAULT_EXTEND
+	}
+	return d
+}
+
+// Wait for the running timed switch, including one left over from before a
+// restart, and switch back when it runs out
+func (switcher *Switcher) runTimer() {
+	ticker := time.NewTicker(TIMER_TICK)
+
+	x, at, ok := switcher.revertTimer()
+
+	for {
+		var done <-chan time.Time
+		if ok {
+			done = time.After(time.Until(at))
+		}
+
+		select {
+		case timer := <-switcher.updated["timer"]:
+			output, deadline, _ := strings.Cut(timer, " ")
+			x, at, ok = parseRevertTimer(output, deadline)
+		case <-ticker.C:
+			// Only a running timer has a countdown to show
+			if done != nil {
+				switcher.refreshTray("timer")
+			}
+		case <-done:
+			ok = false
+
+			switcher.updated["revert_output"] <- ""
+			switcher.updated["revert_at"] <- ""
+			switcher.save()
+
+			if err := switcher.selectOutput(x, false); err != nil {
+				utils.Alert("Error!", fmt.Sprintf("Could not switch back to %s: %s", switcher.label(x), err.Error()), 2)
+			}
+		}
+	}
+}
+
+// Remaining time for the tray, e.g. "Back to Headphones in 19 min"
+func (switcher *Switcher) timerStatus() (string, bool) {
+	x, at, ok := switcher.revertTimer()
+	if !ok {
+		return "", false
+	}
+
+	left := time.Until(at)
+	minutes := int(left.Round(time.Minute) / time.Minute)
+
+	var remaining string
+	switch {
+	case left < time.Minute:
+		remaining = "less than a minute"
+	case minutes < 60:
+		remaining = fmt.Sprintf("%d min", minutes)
+	default:
+		remaining = fmt.Sprintf("%dh %02dm", minutes/60, minutes%60)
+	}
+
+	return fmt.Sprintf("Back to %s in %s", switcher.label(x), remaining), true
+}
+
+// Durations without trailing zero units, e.g. 10m rather than 10m0s
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
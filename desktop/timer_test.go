@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimer(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 3\ncurrent_output = 0\noutput1 = Speakers\ndbus = false\n")
+	switcher.setIP(fakeDevice(t, "127.0.0.1:0", 3))
+	go switcher.runTimer()
+	// Once it takes an update it's done reading the timer it started with
+	switcher.updated["timer"] <- ""
+
+	state := func() (int, int, time.Duration, bool) {
+		settle(switcher)
+		cur, _ := switcher.config.Section("").Key("current_output").Int()
+		x, at, ok := switcher.revertTimer()
+		return cur, x, time.Until(at).Round(time.Minute), ok
+	}
+
+	tests := []struct {
+		name  string
+		do    func() error
+		cur   int
+		back  int
+		left  time.Duration
+		timer bool
+		err   bool
+	}{
+		{"switch for an hour", func() error { return switcher.switchFor(1, time.Hour) }, 1, 0, time.Hour, true, false},
+		{"another keeps the first output", func() error { return switcher.switchFor(2, time.Hour) }, 2, 0, time.Hour, true, false},
+		{"extend", func() error { return switcher.extendTimer(30 * time.Minute) }, 2, 0, 90 * time.Minute, true, false},
+		{"cancel", switcher.cancelTimer, 2, 0, 0, false, false},
+		{"nothing to cancel", switcher.cancelTimer, 2, 0, 0, false, true},
+		{"nothing to extend", func() error { return switcher.extendTimer(time.Minute) }, 2, 0, 0, false, true},
+	}
+
+	for _, test := range tests {
+		err := test.do()
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+
+		cur, back, left, ok := state()
+		if cur != test.cur || ok != test.timer || (ok && (back != test.back || left != test.left)) {
+			t.Errorf("%s: on %d, back to %d in %s, running %v, want %d, %d, %s, %v", test.name, cur, back, left, ok, test.cur, test.back, test.left, test.timer)
+		}
+	}
+
+	// Running out switches back and clears the timer
+	changes := switcher.subscribe()
+	if err := switcher.switchFor(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(4 * time.Second)
+	for back := false; !back; {
+		select {
+		case c := <-changes:
+			back = c.kind == CHANGE_OUTPUT && c.output == 2
+		case <-timeout:
+			t.Fatal("didn't switch back")
+		}
+	}
+
+	if cur, _, _, ok := state(); cur != 2 || ok {
+		t.Errorf("on %d, timer running %v, want back on 2 without a timer", cur, ok)
+	}
+}
+
+func TestTimerStatus(t *testing.T) {
+	switcher := testSwitcher(t, "outputs = 2\noutput1 = Speakers\ndbus = false\n")
+	go switcher.runTimer()
+	// Once it takes an update it's done reading the timer it started with
+	switcher.updated["timer"] <- ""
+
+	tests := []struct {
+		left time.Duration
+		want string
+	}{
+		{30 * time.Second, "Back to Speakers in less than a minute"},
+		{19*time.Minute + 10*time.Second, "Back to Speakers in 19 min"},
+		{2*time.Hour + 5*time.Minute + 10*time.Second, "Back to Speakers in 2h 05m"},
+	}
+
+	for _, test := range tests {
+		if err := switcher.setRevertTimer("0", time.Now().Add(test.left).Format(time.RFC3339)); err != nil {
+			t.Fatal(err)
+		}
+		settle(switcher)
+
+		if got, ok := switcher.timerStatus(); !ok || got != test.want {
+			t.Errorf("%s left: got %q, want %q", test.left, got, test.want)
+		}
+	}
+
+	switcher.setRevertTimer("", "")
+	settle(switcher)
+	if got, ok := switcher.timerStatus(); ok {
+		t.Errorf("no timer: got %q", got)
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{10 * time.Minute, "10m"},
+		{2 * time.Hour, "2h"},
+		{90 * time.Minute, "1h30m"},
+		{90 * time.Second, "1m30s"},
+		{45 * time.Second, "45s"},
+	}
+
+	for _, test := range tests {
+		if got := shortDuration(test.d); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.d, got, test.want)
+		}
+	}
+}
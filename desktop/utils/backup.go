@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const DEFAULT_BACKUPS = 5
+
+const backupLayout = "20060102-150405.000"
+
+// All writes to config.ini go through here, one at a time
+var writeMutex sync.Mutex
+
+func BackupDir() string {
+	return filepath.Join(filepath.Dir(ConfigPath()), "backups")
+}
+
+// writeConfig atomically replaces config.ini with data, keeping up to keep
+// backups of the previous contents.
+func writeConfig(data []byte, keep int) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	configFile := ConfigPath()
+	dir := filepath.Dir(configFile)
+	os.MkdirAll(dir, 0755)
+
+	tmp, err := os.CreateTemp(dir, ".config-*.ini")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := backup(configFile, data, keep); err != nil {
+		fmt.Printf("Error: could not back up config: %s\n", err.Error())
+	}
+
+	// Remember what we wrote so the watcher doesn't treat it as an external edit
+	written.Store(sha256.Sum256(data))
+
+	return os.Rename(tmp.Name(), configFile)
+}
+
+// Copy the current config into the backup directory before it is replaced
+func backup(configFile string, data []byte, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	old, err := os.ReadFile(configFile)
+	if err != nil || len(bytes.TrimSpace(old)) == 0 || bytes.Equal(old, data) {
+		return nil
+	}
+
+	dir := BackupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("config-%s.ini", time.Now().Format(backupLayout))
+	if err := os.WriteFile(filepath.Join(dir, name), old, 0644); err != nil {
+		return err
+	}
+
+	// Remove the oldest backups
+	backups := Backups()
+	for _, b := range backups[min(keep, len(backups)):] {
+		os.Remove(filepath.Join(dir, b))
+	}
+
+	return nil
+}
+
+// Backups lists backup file names, newest first
+func Backups() []string {
+	entries, _ := os.ReadDir(BackupDir())
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "config-") && strings.HasSuffix(e.Name(), ".ini") {
+			names = append(names, e.Name())
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	return names
+}
+
+// Restore replaces config.ini with a backup, itself backing up the current
+// config first. A running app picks the change up like any external edit.
+func Restore(name string) error {
+	backups := Backups()
+	if !slices.Contains(backups, name) {
+		return fmt.Errorf("no backup named %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(BackupDir(), name))
+	if err != nil {
+		return err
+	}
+
+	if _, err := Parse(data); err != nil {
+		return fmt.Errorf("backup %s is not a valid config: %w", name, err)
+	}
+
+	return writeConfig(data, backupCount(ConfigPath()))
+}
+
+func backupCount(source interface{}) int {
+	cfg, err := Parse(source)
+	if err != nil {
+		return DEFAULT_BACKUPS
+	}
+	return cfg.Section("").Key("backups").MustInt(DEFAULT_BACKUPS)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
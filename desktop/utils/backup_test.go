@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		keep   int
+		writes int
+		want   int
+	}{
+		{"disabled", 0, 3, 0},
+		{"first write has nothing to back up", 2, 1, 0},
+		{"under the limit", 5, 3, 2},
+		{"oldest removed", 2, 5, 2},
+	}
+
+	for _, test := range tests {
+		t.Setenv(ENV_PREFIX+"CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+		for i := 0; i < test.writes; i++ {
+			if err := writeConfig([]byte(fmt.Sprintf("outputs = %d\n", i+1)), test.keep); err != nil {
+				t.Fatal(err)
+			}
+			// Backups are named by the millisecond
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		backups := Backups()
+		if len(backups) != test.want {
+			t.Errorf("%s: got %d backups, want %d", test.name, len(backups), test.want)
+			continue
+		}
+
+		// Newest first, holding the contents each write replaced
+		for i, name := range backups {
+			data, _ := os.ReadFile(filepath.Join(BackupDir(), name))
+			if want := fmt.Sprintf("outputs = %d\n", test.writes-1-i); string(data) != want {
+				t.Errorf("%s: %s has %q, want %q", test.name, name, data, want)
+			}
+		}
+	}
+}
+
+// Nothing is left behind but config.ini itself
+func TestWriteConfigAtomic(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ENV_PREFIX+"CONFIG", filepath.Join(dir, "config.ini"))
+
+	for _, data := range []string{"outputs = 1\n", "outputs = 2\n", "outputs = 2\n"} {
+		if err := writeConfig([]byte(data), 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(ConfigPath()); string(got) != data {
+			t.Errorf("got %q, want %q", got, data)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("left in %s: %v", dir, names)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Setenv(ENV_PREFIX+"CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	for _, data := range []string{"backups = 3\noutputs = 1\n", "backups = 3\noutputs = 2\n"} {
+		if err := writeConfig([]byte(data), 3); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// An unparsable backup is refused
+	broken := "config-20000101-000000.000.ini"
+	if err := os.WriteFile(filepath.Join(BackupDir(), broken), []byte("[unclosed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+		want string
+	}{
+		{"config-missing.ini", false, "backups = 3\noutputs = 2\n"},
+		{broken, false, "backups = 3\noutputs = 2\n"},
+		{Backups()[0], true, "backups = 3\noutputs = 1\n"},
+	}
+
+	for _, test := range tests {
+		err := Restore(test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("restoring %s: got %v", test.name, err)
+		}
+		if got, _ := os.ReadFile(ConfigPath()); string(got) != test.want {
+			t.Errorf("after restoring %s, got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// The config that was replaced is itself backed up
+	data, _ := os.ReadFile(filepath.Join(BackupDir(), Backups()[0]))
+	if string(data) != "backups = 3\noutputs = 2\n" {
+		t.Errorf("newest backup has %q", data)
+	}
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+const ENV_PREFIX = "SOUNDBRICK_"
+
+// Environment variables that configure the app rather than override a key
+var envReserved = []string{"CONFIG", "PORTABLE"}
+
+const WATCH_INTERVAL = time.Second
+
+// Values of keys overridden by the environment, as they were in the file
+var fileValues = map[string]*string{}
+var envMutex sync.Mutex
+
+var written configHash
+
+// Keys are case insensitive, and values such as hotkey = \ end in a backslash,
+// which would otherwise carry on to the next line
+var LoadOptions = ini.LoadOptions{Insensitive: true, IgnoreContinuation: true}
+
+// Parse config from a file name or its contents
+func Parse(source interface{}) (*ini.File, error) {
+	return ini.LoadSources(LoadOptions, source)
+}
+
+// ConfigPath resolves where config.ini lives. In order of precedence:
+// --config, $SOUNDBRICK_CONFIG, dev mode, portable mode and finally the
+// platform config directory ($XDG_CONFIG_HOME on Linux).
+func ConfigPath() string {
+	if configFile != "" {
+		return filepath.Clean(configFile)
+	}
+
+	if path := os.Getenv(ENV_PREFIX + "CONFIG"); path != "" {
+		return filepath.Clean(path)
+	}
+
+	if IsDev() {
+		return "./config.ini"
+	}
+
+	if path := portablePath(); path != "" {
+		return path
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return portableDir() + "/config.ini"
+	}
+
+	configPath := filepath.Join(dir, "soundbrick", "config.ini")
+
+	// Older releases read from "SoundBrick" but wrote to "soundbrick"
+	legacyPath := filepath.Join(dir, "SoundBrick", "config.ini")
+	if !exists(configPath) && exists(legacyPath) {
+		os.MkdirAll(filepath.Dir(configPath), 0755)
+		os.Rename(legacyPath, configPath)
+	}
+
+	return configPath
+}
+
+// Portable mode keeps config.ini next to the executable. It is enabled with
+// --portable, $SOUNDBRICK_PORTABLE or by placing a config.ini there.
+func portablePath() string {
+	configPath := filepath.Join(portableDir(), "config.ini")
+
+	if IsPortable() || exists(configPath) {
+		return configPath
+	}
+
+	return ""
+}
+
+func portableDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	return filepath.Dir(exe)
+}
+
+func IsPortable() bool {
+	return portable || isPortableShort || os.Getenv(ENV_PREFIX+"PORTABLE") != ""
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func Load() *ini.File {
+	configFile := ConfigPath()
+
+	// Check if config exists, if not create it
+	if !exists(configFile) {
+		os.MkdirAll(filepath.Dir(configFile), 0755)
+		os.Create(configFile)
+	}
+
+	data, _ := os.ReadFile(configFile)
+	written.Store(sha256.Sum256(data))
+
+	file, err := Parse(data)
+	if err != nil {
+		file = ini.Empty(LoadOptions)
+	}
+
+	applyEnv(file.Section(""))
+
+	return file
+}
+
+// Apply SOUNDBRICK_<KEY> overrides, e.g. SOUNDBRICK_IP=192.168.1.20
+func applyEnv(sec *ini.Section) {
+	envMutex.Lock()
+	defer envMutex.Unlock()
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, ENV_PREFIX) {
+			continue
+		}
+
+		name = strings.TrimPrefix(name, ENV_PREFIX)
+		if name == "" || slices.Contains(envReserved, name) {
+			continue
+		}
+
+		key := strings.ToLower(name)
+
+		var old *string
+		if sec.HasKey(key) {
+			v := sec.Key(key).String()
+			old = &v
+		}
+		fileValues[key] = old
+
+		sec.Key(key).SetValue(value)
+	}
+}
+
+func Save(cfg *ini.File) error {
+	data, err := Contents(cfg)
+	if err != nil {
+		return err
+	}
+
+	return writeConfig(data, cfg.Section("").Key("backups").MustInt(DEFAULT_BACKUPS))
+}
+
+// Contents returns cfg as it would be saved to config.ini
+func Contents(cfg *ini.File) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := cfg.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return stripEnv(buf.Bytes())
+}
+
+// Don't persist environment overrides, only changes made since
+func stripEnv(data []byte) ([]byte, error) {
+	envMutex.Lock()
+	defer envMutex.Unlock()
+
+	if len(fileValues) == 0 {
+		return data, nil
+	}
+
+	out, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sec := out.Section("")
+	for key, old := range fileValues {
+		if sec.Key(key).String() != os.Getenv(ENV_PREFIX+strings.ToUpper(key)) {
+			continue
+		}
+
+		if old == nil {
+			sec.DeleteKey(key)
+		} else {
+			sec.Key(key).SetValue(*old)
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err = out.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// WatchConfig polls config.ini and calls fn with the parsed file whenever it
+// is changed by something other than Save.
+func WatchConfig(fn func(*ini.File)) {
+	go func() {
+		var modTime time.Time
+		var size int64
+
+		for range time.Tick(WATCH_INTERVAL) {
+			info, err := os.Stat(ConfigPath())
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+
+			data, err := os.ReadFile(ConfigPath())
+			if err != nil {
+				continue
+			}
+
+			sum := sha256.Sum256(data)
+			if sum == written.Load() {
+				continue
+			}
+			written.Store(sum)
+
+			file, err := Parse(data)
+			if err != nil {
+				fmt.Printf("Error: could not parse %s: %s\n", ConfigPath(), err.Error())
+				continue
+			}
+
+			applyEnv(file.Section(""))
+
+			fn(file)
+		}
+	}()
+}
+
+// Hash of the config contents last loaded or written by the app
+type configHash struct {
+	mutex sync.Mutex
+	sum   [sha256.Size]byte
+}
+
+func (h *configHash) Store(sum [sha256.Size]byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sum = sum
+}
+
+func (h *configHash) Load() [sha256.Size]byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	env := filepath.Join(dir, "env.ini")
+
+	tests := []struct {
+		name     string
+		flag     string
+		env      string
+		dev      bool
+		portable bool
+		want     string
+	}{
+		{"flag first", filepath.Join(dir, "a", "..", "flag.ini"), env, true, true, filepath.Join(dir, "flag.ini")},
+		{"then the environment", "", env, true, true, env},
+		{"then dev mode", "", "", true, true, "./config.ini"},
+		{"then portable", "", "", false, true, filepath.Join(portableDir(), "config.ini")},
+		{"then the config directory", "", "", false, false, filepath.Join(dir, "soundbrick", "config.ini")},
+	}
+
+	defer func() { configFile, isDev, portable = "", false, false }()
+
+	for _, test := range tests {
+		configFile, isDev, portable = test.flag, test.dev, test.portable
+		t.Setenv(ENV_PREFIX+"CONFIG", test.env)
+
+		if got := ConfigPath(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// Older releases read from "SoundBrick", which is moved over once
+func TestConfigPathLegacy(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv(ENV_PREFIX+"CONFIG", "")
+
+	legacy := filepath.Join(dir, "SoundBrick", "config.ini")
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	if err := os.WriteFile(legacy, []byte("ip = 10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := ConfigPath()
+	if data, err := os.ReadFile(path); err != nil || string(data) != "ip = 10.0.0.2\n" {
+		t.Errorf("%s has %q, %v", path, data, err)
+	}
+	if exists(legacy) {
+		t.Errorf("%s was left behind", legacy)
+	}
+}
+
+// Overrides apply to what's loaded but aren't saved, unless changed since
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv(ENV_PREFIX+"CONFIG", "/tmp/reserved.ini")
+	t.Setenv(ENV_PREFIX+"IP", "192.168.1.20")
+	t.Setenv(ENV_PREFIX+"HOTKEY", "ctrl+m")
+	t.Setenv(ENV_PREFIX+"OUTPUTS", "6")
+	defer func() { fileValues = map[string]*string{} }()
+
+	cfg, err := Parse([]byte("ip = 10.0.0.2\nhotkey = \\\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyEnv(cfg.Section(""))
+	sec := cfg.Section("")
+
+	loaded := []struct {
+		key  string
+		want string
+	}{
+		{"ip", "192.168.1.20"},
+		{"hotkey", "ctrl+m"},
+		{"outputs", "6"},
+		// Configures the app, it's not a key
+		{"config", ""},
+	}
+	for _, test := range loaded {
+		if got := sec.Key(test.key).String(); got != test.want {
+			t.Errorf("loaded %s = %q, want %q", test.key, got, test.want)
+		}
+	}
+
+	// Changed in the app, so kept
+	sec.Key("hotkey").SetValue("ctrl+n")
+
+	data, err := Contents(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+		has  bool
+	}{
+		{"ip", "10.0.0.2", true},
+		{"hotkey", "ctrl+n", true},
+		{"outputs", "", false},
+	}
+	for _, test := range tests {
+		root := saved.Section("")
+		if root.HasKey(test.key) != test.has || root.Key(test.key).String() != test.want {
+			t.Errorf("saved %s = %q, want %q in:\n%s", test.key, root.Key(test.key).String(), test.want, strings.TrimSpace(string(data)))
+		}
+	}
+}
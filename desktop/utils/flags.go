@@ -5,9 +5,18 @@ import "flag"
 var isDev bool
 var isDevShort bool
 
+var configFile string
+
+var portable bool
+var isPortableShort bool
+
 func SetupFlags() {
 	flag.BoolVar(&isDev, "dev", false, "Running in development environment")
 	flag.BoolVar(&isDevShort, "D", false, "Running in development environment")
+	flag.StringVar(&configFile, "config", "", "Path to config.ini")
+	flag.StringVar(&configFile, "c", "", "Path to config.ini")
+	flag.BoolVar(&portable, "portable", false, "Keep config.ini next to the executable")
+	flag.BoolVar(&isPortableShort, "P", false, "Keep config.ini next to the executable")
 	flag.Parse()
 
 	Dev(func() { println("Dev!") })
@@ -1,20 +1,14 @@
 package utils
 
 import (
-	"errors"
 	"fmt"
 	"log"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
-	"kyleschwartz/soundbrick/assets/icon"
-
-	"github.com/electricbubble/go-toast"
 	"github.com/ethereum/go-ethereum/common/prque"
-	"gopkg.in/ini.v1"
 )
 
 func OpenLink(url string) {
@@ -35,53 +29,36 @@ func OpenLink(url string) {
 	}
 }
 
+// Alerts come from many goroutines, and the queue isn't safe for that
 var queue = prque.New(nil)
+var queueMutex sync.Mutex
+
+// Shows a notification the platform's way. Tests swap it out so nothing pops
+// up while they run.
+var Notify = notify
 
 type AlertItem struct {
 	title, content string
 }
 
 func Alert(title string, content string, priority int64) {
+	queueMutex.Lock()
 	queue.Push(AlertItem{title, content}, priority)
+	queueMutex.Unlock()
 
 	go func() {
 		time.Sleep(350 * time.Millisecond)
 
+		queueMutex.Lock()
 		if queue.Empty() {
+			queueMutex.Unlock()
 			return
 		}
 
 		data := queue.PopItem().(AlertItem)
 		queue.Reset()
+		queueMutex.Unlock()
 
-		toast.Push(data.content,
-			toast.WithTitle(data.title),
-			toast.WithAppID("Sound Brick"),
-			toast.WithAudio(toast.Default),
-			toast.WithShortDuration(),
-			toast.WithIconRaw(icon.Data),
-		)
+		Notify(data.title, data.content)
 	}()
 }
-
-func Load() *ini.File {
-	dir, _ := os.UserConfigDir()
-	var configFile string
-
-	if IsDev() {
-		configFile = "./config.ini"
-	} else {
-		configPath := filepath.Clean(fmt.Sprintf("%s/SoundBrick", dir))
-		configFile = filepath.Clean(fmt.Sprintf("%s/config.ini", configPath))
-
-		// Check if config exists, if not create it
-		if _, err := os.Stat(configFile); errors.Is(err, os.ErrNotExist) {
-			os.MkdirAll(configPath, 0644)
-			os.Create(configFile)
-		}
-	}
-
-	file, _ := ini.InsensitiveLoad(configFile)
-
-	return file
-}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kyleschwartz/soundbrick/assets/icon"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Every Linux desktop shows notifications through this service on the
+// session bus
+const (
+	NOTIFY_NAME = "org.freedesktop.Notifications"
+	NOTIFY_PATH = "/org/freedesktop/Notifications"
+)
+
+// As long as the short toasts on other platforms
+const NOTIFY_TIMEOUT = 7 * time.Second
+
+var iconMutex sync.Mutex
+
+// The service takes icons as files, so the embedded one is written out, and
+// again if the cache is cleared while the app runs
+func notifyIcon() string {
+	iconMutex.Lock()
+	defer iconMutex.Unlock()
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	path := filepath.Join(dir, "soundbrick", "icon.png")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if os.MkdirAll(filepath.Dir(path), 0755) != nil || os.WriteFile(path, icon.Data, 0644) != nil {
+		return ""
+	}
+	return path
+}
+
+func notify(title string, content string) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+
+	return conn.Object(NOTIFY_NAME, NOTIFY_PATH).Call(NOTIFY_NAME+".Notify", 0,
+		"Sound Brick",
+		uint32(0),
+		notifyIcon(),
+		title,
+		content,
+		[]string{},
+		map[string]dbus.Variant{},
+		int32(NOTIFY_TIMEOUT.Milliseconds()),
+	).Err
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type notification struct {
+	app, icon, title, content string
+	timeout                   int32
+}
+
+// Stands in for the desktop's notification service
+type notifications chan notification
+
+func (n notifications) Notify(app string, replaces uint32, icon, title, content string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	n <- notification{app, icon, title, content, timeout}
+	return 1, nil
+}
+
+func TestNotify(t *testing.T) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	err = os.WriteFile(config, []byte(fmt.Sprintf(`<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`, filepath.Join(dir, "bus"))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address=1")
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon didn't start: %s", err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(address))
+	t.Setenv("XDG_CACHE_HOME", dir)
+
+	service, err := dbus.Connect(strings.TrimSpace(address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	shown := make(notifications, 1)
+	service.Export(shown, NOTIFY_PATH, NOTIFY_NAME)
+	if _, err := service.RequestName(NOTIFY_NAME, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := notify("Muted!", "Output has been muted."); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-shown:
+		if n.app != "Sound Brick" || n.title != "Muted!" || n.content != "Output has been muted." || n.timeout != 7000 {
+			t.Errorf("got %+v", n)
+		}
+		if n.icon != filepath.Join(dir, "soundbrick", "icon.png") {
+			t.Errorf("icon is %q", n.icon)
+		}
+		if _, err := os.Stat(n.icon); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification was shown")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package utils
+
+import (
+	"kyleschwartz/soundbrick/assets/icon"
+
+	"github.com/electricbubble/go-toast"
+)
+
+func notify(title string, content string) error {
+	return toast.Push(content,
+		toast.WithTitle(title),
+		toast.WithAppID("Sound Brick"),
+		toast.WithAudio(toast.Default),
+		toast.WithShortDuration(),
+		toast.WithIconRaw(icon.Data),
+	)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"kyleschwartz/soundbrick/utils"
+)
+
+// Webhooks are [webhook.<name>] sections that POST changes to a URL
+const WEBHOOK_PREFIX = "webhook."
+
+const (
+	// Deliveries wait here, next to the config, until they succeed
+	WEBHOOKS_DIR = "webhooks"
+
+	// The oldest deliveries are dropped past this many per webhook
+	WEBHOOK_QUEUE = 1000
+
+	// How often queued deliveries are tried again
+	WEBHOOK_FLUSH = time.Minute
+
+	// Retries wait twice as long each time, up to this
+	WEBHOOK_MAX_BACKOFF = 30 * time.Second
+)
+
+var webhookEvents = []string{CHANGE_OUTPUT, CHANGE_MUTE, CHANGE_UNMUTE, CHANGE_CONNECT, CHANGE_DISCONNECT}
+
+var webhookSchema = map[string]configKey{
+	"url":     {"", validWebhookURL},
+	"secret":  {"", validSecret},
+	"events":  {strings.Join(webhookEvents, ", "), validWebhookEvents},
+	"timeout": {"5s", validDuration},
+	"retries": {"3", validCount},
+}
+
+func validWebhookURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", value)
+	}
+	return nil
+}
+
+// Any secret will do, an empty one leaves bodies unsigned
+func validSecret(value string) error {
+	return nil
+}
+
+func parseWebhookEvents(value string) ([]string, error) {
+	var events []string
+	for _, event := range strings.Split(value, ",") {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if event == "" {
+			continue
+		}
+		if !slices.Contains(webhookEvents, event) {
+			return nil, fmt.Errorf("%q is not one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events")
+	}
+	return events, nil
+}
+
+func validWebhookEvents(value string) error {
+	_, err := parseWebhookEvents(value)
+	return err
+}
+
+type webhook struct {
+	name    string
+	url     string
+	secret  string
+	events  []string
+	timeout time.Duration
+	retries int
+}
+
+// The webhook named name, if it's set up properly
+func (switcher *Switcher) webhook(name string) (webhook, error) {
+	sec, err := switcher.config.GetSection(WEBHOOK_PREFIX + name)
+	if err != nil {
+		return webhook{}, fmt.Errorf("no webhook named %q", name)
+	}
+
+	value := func(key string) string {
+		if sec.HasKey(key) {
+			return sec.Key(key).String()
+		}
+		return webhookSchema[key].fallback
+	}
+
+	for key, k := range webhookSchema {
+		if err := k.validate(value(key)); err != nil {
+			return webhook{}, fmt.Errorf("webhook %s: %s: %w", name, key, err)
+		}
+	}
+
+	h := webhook{name: name, url: value("url"), secret: value("secret")}
+	h.events, _ = parseWebhookEvents(value("events"))
+	h.timeout, _ = time.ParseDuration(value("timeout"))
+	h.retries, _ = strconv.Atoi(value("retries"))
+
+	return h, nil
+}
+
+func (switcher *Switcher) webhooks() ([]webhook, []string) {
+	var hooks []webhook
+	var errs []string
+
+	for _, sec := range switcher.config.Sections() {
+		if !strings.HasPrefix(sec.Name(), WEBHOOK_PREFIX) {
+			continue
+		}
+
+		h, err := switcher.webhook(strings.TrimPrefix(sec.Name(), WEBHOOK_PREFIX))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+
+	return hooks, errs
+}
+
+// The JSON body of every delivery. Outputs count from 1 and are null while
+// muted.
+type webhookPayload struct {
+	ID            string `json:"id"`
+	Event         string `json:"event"`
+	Time          string `json:"time"`
+	Output        *int   `json:"output"`
+	Label         string `json:"label"`
+	Previous      *int   `json:"previous"`
+	PreviousLabel string `json:"previous_label"`
+	Muted         bool   `json:"muted"`
+	Online        bool   `json:"online"`
+	Outputs       int    `json:"outputs"`
+	Profile       string `json:"profile,omitempty"`
+}
+
+func (switcher *Switcher) webhookPayload(c stateChange) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	number := func(x int) *int {
+		if x == switcher.muted() {
+			return nil
+		}
+		n := x + 1
+		return &n
+	}
+
+	return json.Marshal(webhookPayload{
+		ID:            hex.EncodeToString(id),
+		Event:         c.kind,
+		Time:          time.Now().Format(time.RFC3339),
+		Output:        number(c.output),
+		Label:         switcher.outputLabel(c.output),
+		Previous:      number(c.previous),
+		PreviousLabel: switcher.outputLabel(c.previous),
+		Muted:         c.output == switcher.muted(),
+		Online:        c.kind != CHANGE_DISCONNECT,
+		Outputs:       switcher.outputCount(),
+		Profile:       switcher.config.Section("").Key("profile").String(),
+	})
+}
+
+// Signed the way GitHub signs its webhooks, as the hex HMAC-SHA256 of the
+// body
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookLog(format string, a ...interface{}) {
+	writeLog("webhooks.log", "Webhooks", fmt.Sprintf(format, a...))
+}
+
+// A delivery the other end turned down, which sending again won't fix
+type rejectedError struct {
+	status string
+}
+
+func (err rejectedError) Error() string {
+	return "rejected with " + err.status
+}
+
+func (h webhook) post(body []byte) error {
+	var payload struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+	}
+	json.Unmarshal(body, &payload)
+
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return rejectedError{err.Error()}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SoundBrick")
+	req.Header.Set("X-SoundBrick-Event", payload.Event)
+	req.Header.Set("X-SoundBrick-Delivery", payload.ID)
+	if h.secret != "" {
+		req.Header.Set("X-SoundBrick-Signature", signature(h.secret, body))
+	}
+
+	client := http.Client{Timeout: h.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500:
+		return fmt.Errorf("failed with %s", resp.Status)
+	}
+	return rejectedError{resp.Status}
+}
+
+// Send a body, trying again with backoff unless it's rejected
+func (h webhook) deliver(body []byte) error {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := h.post(body)
+		if err == nil || errors.As(err, &rejectedError{}) || attempt >= h.retries {
+			return err
+		}
+
+		webhookLog("%s: %s, trying again in %s", h.name, err.Error(), backoff)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > WEBHOOK_MAX_BACKOFF {
+			backoff = WEBHOOK_MAX_BACKOFF
+		}
+	}
+}
+
+// Deliveries for a webhook, one JSON body per line. Every delivery goes
+// through the queue, so none are lost if the app quits while sending.
+type webhookQueue struct {
+	sync.Mutex
+	name  string
+	flush chan bool
+}
+
+func webhooksDir() string {
+	return filepath.Join(filepath.Dir(utils.ConfigPath()), WEBHOOKS_DIR)
+}
+
+func (q *webhookQueue) path() string {
+	return filepath.Join(webhooksDir(), url.PathEscape(q.name)+".jsonl")
+}
+
+func (q *webhookQueue) read() [][]byte {
+	f, err := os.Open(q.path())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var bodies [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			bodies = append(bodies, append([]byte{}, line...))
+		}
+	}
+	return bodies
+}
+
+func (q *webhookQueue) write(bodies [][]byte) error {
+	if len(bodies) == 0 {
+		if err := os.Remove(q.path()); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(webhooksDir(), 0755); err != nil {
+		return err
+	}
+
+	// Written aside and moved into place, so a crash can't leave half a queue
+	tmp := q.path() + ".tmp"
+	if err := os.WriteFile(tmp, append(bytes.Join(bodies, []byte("\n")), '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path())
+}
+
+func (q *webhookQueue) push(body []byte) {
+	q.Lock()
+	defer q.Unlock()
+
+	bodies := append(q.read(), body)
+	if over := len(bodies) - WEBHOOK_QUEUE; over > 0 {
+		webhookLog("%s: queue is full, dropped the %d oldest deliveries", q.name, over)
+		bodies = bodies[over:]
+	}
+
+	if err := q.write(bodies); err != nil {
+		webhookLog("%s: could not queue a delivery: %s", q.name, err.Error())
+	}
+
+	q.poke()
+}
+
+// Ask for the queue to be sent, without waiting
+func (q *webhookQueue) poke() {
+	select {
+	case q.flush <- true:
+	default:
+	}
+}
+
+// Send what's queued in order, stopping at the first delivery that fails so
+// it's tried again later
+func (switcher *Switcher) flushWebhook(q *webhookQueue) {
+	q.Lock()
+	bodies := q.read()
+	q.Unlock()
+
+	if len(bodies) == 0 {
+		return
+	}
+
+	// Deliveries to webhooks that were removed or broken wait until they're
+	// fixed
+	h, err := switcher.webhook(q.name)
+	if err != nil {
+		return
+	}
+
+	sent := map[string]bool{}
+	for _, body := range bodies {
+		err := h.deliver(body)
+
+		var rejected rejectedError
+		if errors.As(err, &rejected) {
+			webhookLog("%s: delivery %s, dropping it", h.name, err.Error())
+		} else if err != nil {
+			webhookLog("%s: %s, keeping %d deliveries for later", h.name, err.Error(), len(bodies)-len(sent))
+			break
+		}
+		sent[deliveryID(body)] = true
+	}
+
+	if len(sent) == 0 {
+		return
+	}
+
+	// More may have been queued meanwhile and the oldest dropped, so the
+	// ones sent are found again by their id
+	q.Lock()
+	defer q.Unlock()
+
+	var left [][]byte
+	for _, body := range q.read() {
+		if !sent[deliveryID(body)] {
+			left = append(left, body)
+		}
+	}
+	if err := q.write(left); err != nil {
+		webhookLog("%s: could not update the queue: %s", q.name, err.Error())
+	}
+}
+
+// Every payload has a random id. Anything else queued is told apart by its
+// body.
+func deliveryID(body []byte) string {
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(body, &payload) != nil || payload.ID == "" {
+		return string(body)
+	}
+	return payload.ID
+}
+
+// Queue each change for the webhooks that want it, and keep sending the
+// queues
+func (switcher *Switcher) runWebhooks() {
+	changes := switcher.subscribe()
+	queues := map[string]*webhookQueue{}
+
+	queue := func(name string) *webhookQueue {
+		q, ok := queues[name]
+		if !ok {
+			q = &webhookQueue{name: name, flush: make(chan bool, 1)}
+			queues[name] = q
+
+			go func() {
+				for range q.flush {
+					switcher.flushWebhook(q)
+				}
+			}()
+		}
+		return q
+	}
+
+	// Pick up deliveries left from before
+	flushAll := func() {
+		files, _ := filepath.Glob(filepath.Join(webhooksDir(), "*.jsonl"))
+		for _, file := range files {
+			if name, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".jsonl")); err == nil {
+				queue(name).poke()
+			}
+		}
+	}
+
+	flushAll()
+
+	ticker := time.NewTicker(WEBHOOK_FLUSH)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-changes:
+			hooks, _ := switcher.webhooks()
+			if len(hooks) == 0 {
+				continue
+			}
+
+			body, err := switcher.webhookPayload(c)
+			if err != nil {
+				webhookLog("could not make a payload: %s", err.Error())
+				continue
+			}
+
+			for _, h := range hooks {
+				if slices.Contains(h.events, c.kind) {
+					queue(h.name).push(body)
+				}
+			}
+
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+}
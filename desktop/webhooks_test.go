@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// A server that answers with each status in turn, then 200, and keeps the
+// bodies it was sent
+type webhookServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.Lock()
+		defer s.Unlock()
+		s.bodies = append(s.bodies, string(body))
+		s.headers = append(s.headers, r.Header.Clone())
+
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.bodies...)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server := newWebhookServer(t)
+	body := []byte(`{"id":"abc","event":"output"}`)
+
+	h := webhook{name: "test", url: server.URL, secret: "s3cret", timeout: time.Second}
+	if err := h.post(body); err != nil {
+		t.Fatal(err)
+	}
+
+	header := server.headers[0]
+	if got, want := header.Get("X-SoundBrick-Signature"), signature("s3cret", body); got != want {
+		t.Errorf("signature is %q, want %q", got, want)
+	}
+	if got := header.Get("X-SoundBrick-Event"); got != "output" {
+		t.Errorf("event header is %q", got)
+	}
+	if got := header.Get("X-SoundBrick-Delivery"); got != "abc" {
+		t.Errorf("delivery header is %q", got)
+	}
+
+	// The HMAC-SHA256 example from Wikipedia
+	if got, want := signature("key", []byte("The quick brown fox jumps over the lazy dog")),
+		"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"; got != want {
+		t.Errorf("signature is %q, want %q", got, want)
+	}
+
+	// No secret, no signature
+	h.secret = ""
+	if err := h.post(body); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.headers[1].Get("X-SoundBrick-Signature"); got != "" {
+		t.Errorf("unsigned delivery has signature %q", got)
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		rejected bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusGone, true},
+	}
+
+	for _, test := range tests {
+		server := newWebhookServer(t, test.status)
+		h := webhook{name: "test", url: server.URL, timeout: time.Second}
+
+		err := h.post([]byte("{}"))
+		ok := test.status < 300
+		if ok != (err == nil) {
+			t.Errorf("%d: got %v", test.status, err)
+		}
+		if rejected := errors.As(err, &rejectedError{}); rejected != test.rejected {
+			t.Errorf("%d: rejected is %v, want %v", test.status, rejected, test.rejected)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	t.Setenv("SOUNDBRICK_CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	// Tried again after a second
+	server := newWebhookServer(t, http.StatusServiceUnavailable)
+	h := webhook{name: "test", url: server.URL, timeout: time.Second, retries: 3}
+
+	start := time.Now()
+	if err := h.deliver([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.received()); n != 2 {
+		t.Errorf("sent %d times, want 2", n)
+	}
+	if took := time.Since(start); took < time.Second {
+		t.Errorf("tried again after %s, want a second", took)
+	}
+
+	// Rejections and running out of retries give up
+	server = newWebhookServer(t, http.StatusBadRequest, http.StatusBadGateway)
+	h.url = server.URL
+	if err := h.deliver([]byte("{}")); !errors.As(err, &rejectedError{}) {
+		t.Errorf("got %v, want it rejected", err)
+	}
+	h.retries = 0
+	if err := h.deliver([]byte("{}")); err == nil {
+		t.Errorf("got no error with no retries left")
+	}
+	if n := len(server.received()); n != 2 {
+		t.Errorf("sent %d times, want 2", n)
+	}
+}
+
+func TestWebhookQueueTrim(t *testing.T) {
+	t.Setenv("SOUNDBRICK_CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	q := &webhookQueue{name: "team chat"}
+
+	var bodies [][]byte
+	for i := 0; i < WEBHOOK_QUEUE; i++ {
+		bodies = append(bodies, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	if err := q.write(bodies); err != nil {
+		t.Fatal(err)
+	}
+
+	q.push([]byte(`{"n":1000}`))
+	q.push([]byte(`{"n":1001}`))
+
+	queued := q.read()
+	if len(queued) != WEBHOOK_QUEUE {
+		t.Fatalf("queue has %d deliveries, want %d", len(queued), WEBHOOK_QUEUE)
+	}
+	if first, last := string(queued[0]), string(queued[len(queued)-1]); first != `{"n":2}` || last != `{"n":1001}` {
+		t.Errorf("queue runs from %s to %s, want the oldest dropped", first, last)
+	}
+
+	// Names are escaped into one file
+	if filepath.Base(q.path()) != "team%20chat.jsonl" {
+		t.Errorf("queue is at %s", q.path())
+	}
+}
+
+func TestFlushWebhook(t *testing.T) {
+	t.Setenv("SOUNDBRICK_CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	// The second delivery fails, then the third is rejected
+	server := newWebhookServer(t, http.StatusOK, http.StatusBadGateway, http.StatusOK, http.StatusBadRequest)
+
+	switcher := &Switcher{config: ini.Empty()}
+	sec := switcher.config.Section(WEBHOOK_PREFIX + "test")
+	sec.Key("url").SetValue(server.URL)
+	sec.Key("retries").SetValue("0")
+
+	q := &webhookQueue{name: "test"}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		q.push([]byte(fmt.Sprintf(`{"id":"%s"}`, id)))
+	}
+
+	ids := func(bodies []string) string {
+		var got []string
+		for _, body := range bodies {
+			got = append(got, deliveryID([]byte(body)))
+		}
+		return fmt.Sprint(got)
+	}
+
+	switcher.flushWebhook(q)
+	if got := ids(server.received()); got != "[1 2]" {
+		t.Errorf("sent %s, want [1 2]", got)
+	}
+	if got := len(q.read()); got != 3 {
+		t.Errorf("%d deliveries left, want 3", got)
+	}
+
+	// Picks up where it stopped, dropping the rejected one
+	switcher.flushWebhook(q)
+	if got := ids(server.received()); got != "[1 2 2 3 4]" {
+		t.Errorf("sent %s, want [1 2 2 3 4]", got)
+	}
+	if got := len(q.read()); got != 0 {
+		t.Errorf("%d deliveries left, want none", got)
+	}
+}
+
+// Changes queued while a flush is sending can push the oldest deliveries out
+// of a full queue, which mustn't take unsent ones with them
+func TestFlushWebhookTrimmed(t *testing.T) {
+	t.Setenv("SOUNDBRICK_CONFIG", filepath.Join(t.TempDir(), "config.ini"))
+
+	q := &webhookQueue{name: "test"}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		// Two more while the first is sent drop it and the one after it
+		q.push([]byte(`{"id":"new 1"}`))
+		q.push([]byte(`{"id":"new 2"}`))
+	}))
+	defer server.Close()
+
+	switcher := &Switcher{config: ini.Empty()}
+	sec := switcher.config.Section(WEBHOOK_PREFIX + "test")
+	sec.Key("url").SetValue(server.URL)
+	sec.Key("retries").SetValue("0")
+
+	var bodies [][]byte
+	for i := 0; i < WEBHOOK_QUEUE; i++ {
+		bodies = append(bodies, []byte(fmt.Sprintf(`{"id":"%d"}`, i)))
+	}
+	if err := q.write(bodies); err != nil {
+		t.Fatal(err)
+	}
+
+	switcher.flushWebhook(q)
+
+	queued := q.read()
+	if len(queued) != WEBHOOK_QUEUE {
+		t.Fatalf("queue has %d deliveries, want %d", len(queued), WEBHOOK_QUEUE)
+	}
+	if first, last := deliveryID(queued[0]), deliveryID(queued[len(queued)-1]); first != "2" || last != "new 2" {
+		t.Errorf("queue runs from %s to %s, want 2 to new 2", first, last)
+	}
+}
+
+// A device that stops answering while nothing is being sent is only noticed
+// by the heartbeat, which has to tell webhooks
+func TestIdleDisconnect(t *testing.T) {
+	device, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	switcher := &Switcher{config: ini.Empty(), ip: device.LocalAddr().(*net.UDPAddr)}
+	switcher.outputs.Store(4)
+	switcher.config.Section("").Key("current_output").SetValue("1")
+	changes := switcher.subscribe()
+
+	// Answer one check
+	go func() {
+		buffer := make([]byte, 16)
+		if _, addr, err := device.ReadFrom(buffer); err == nil {
+			device.WriteTo([]byte("1/4"), addr)
+		}
+	}()
+
+	next := func(want string) stateChange {
+		t.Helper()
+		select {
+		case c := <-changes:
+			if c.kind != want {
+				t.Fatalf("got %s, want %s", c.kind, want)
+			}
+			return c
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s change", want)
+		}
+		return stateChange{}
+	}
+
+	if _, err := switcher.exchange(CLIENT_CHECK); err != nil {
+		t.Fatal(err)
+	}
+	next(CHANGE_CONNECT)
+
+	// Gone quiet
+	if _, err := switcher.exchange(CLIENT_CHECK); err != errNoReply {
+		t.Fatalf("got %v, want no reply", err)
+	}
+	c := next(CHANGE_DISCONNECT)
+
+	body, err := switcher.webhookPayload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := regexp.Match(`"event":"disconnect".*"output":2,.*"online":false`, body); !ok {
+		t.Errorf("payload is %s", body)
+	}
+
+	// Only once
+	switcher.exchange(CLIENT_CHECK)
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected %s change", c.kind)
+	default:
+	}
+}